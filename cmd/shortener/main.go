@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/blocklist"
 	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/geoip"
 	"github.com/rvkarpov/url_shortener/internal/handler"
+	"github.com/rvkarpov/url_shortener/internal/healthcheck"
+	"github.com/rvkarpov/url_shortener/internal/metafetch"
 	"github.com/rvkarpov/url_shortener/internal/middleware"
+	"github.com/rvkarpov/url_shortener/internal/oidc"
+	"github.com/rvkarpov/url_shortener/internal/policy"
 	"github.com/rvkarpov/url_shortener/internal/service"
 	"github.com/rvkarpov/url_shortener/internal/storage"
 )
@@ -27,6 +35,12 @@ func main() {
 		logger.Fatalw(err.Error(), "event", "load config")
 	}
 
+	// behind a reverse proxy every request would come from the proxy
+	if cfg.LimitsByClientIP() && len(cfg.TrustedProxies) == 0 {
+		logger.Warnw("rate limits and quotas count clients by peer address, set -trusted-proxies when running behind a reverse proxy",
+			"event", "load config")
+	}
+
 	db := storage.ConnectToDB(cfg.DBConnParams)
 	defer db.Close()
 
@@ -36,22 +50,138 @@ func main() {
 	}
 	defer urlStorage.Finalize()
 
+	urlPolicy, err := policy.NewPolicy(cfg)
+	if err != nil {
+		logger.Fatalw(err.Error(), "event", "load URL policy")
+	}
+
 	urlService := service.NewURLService(urlStorage, cfg)
+	urlService.SetPolicy(urlPolicy)
+
+	auditSink, err := audit.NewSink(&db, cfg)
+	if err != nil {
+		logger.Fatalw(err.Error(), "event", "open audit log")
+	}
+	if auditSink != nil {
+		defer auditSink.Finalize()
+
+		urlService.SetAudit(auditSink)
+	}
+
+	if cfg.GeoIPFile != "" {
+		geoDB, err := geoip.Load(cfg.GeoIPFile)
+		if err != nil {
+			logger.Fatalw(err.Error(), "event", "load GeoIP database")
+		}
+
+		urlService.SetGeoIP(geoDB)
+	}
+
+	if cfg.BlocklistFile != "" {
+		urlBlocklist, err := blocklist.NewBlocklist(cfg.BlocklistFile)
+		if err != nil {
+			logger.Fatalw(err.Error(), "event", "load blocklist")
+		}
+		defer urlBlocklist.Finalize()
+
+		urlService.SetBlocklist(urlBlocklist)
+		refreshBlocked := func() {
+			if err := urlService.RefreshBlockedFlags(context.Background()); err != nil {
+				logger.Errorw(err.Error(), "event", "refresh blocked URLs")
+			}
+		}
+
+		refreshBlocked()
+		urlBlocklist.Watch(cfg.BlocklistReloadInterval, refreshBlocked)
+	}
+	if cfg.HealthCheckInterval > 0 {
+		checker := healthcheck.NewChecker(urlStorage, cfg)
+		defer checker.Finalize()
+
+		go checker.RunAsync()
+	}
+
+	if cfg.MetadataFetchWorkers > 0 {
+		fetcher := metafetch.NewFetcher(urlStorage, cfg)
+		defer fetcher.Finalize()
+
+		fetcher.RunAsync()
+		urlService.SetFetcher(fetcher)
+	}
+
+	sessions := middleware.NewSessions(cfg)
+	sessions.SetAPIKeys(urlService)
+
 	handler := handler.NewURLHandler(urlService, cfg)
+	if cfg.OIDCIssuer != "" {
+		handler.SetLogin(oidc.NewProvider(cfg), sessions)
+	}
 
 	logger.Infof("Server started on %s:%d", cfg.LaunchAddr.Host, cfg.LaunchAddr.Port)
 
 	handleChain := func(h http.HandlerFunc) http.HandlerFunc {
-		return middleware.Authorize(middleware.Compress(middleware.Log(h, logger)), logger, cfg.SecretKey)
+		return middleware.Authorize(middleware.Compress(middleware.Log(h, logger)), logger, sessions)
+	}
+
+	handleScoped := func(h http.HandlerFunc, scope string) http.HandlerFunc {
+		return handleChain(middleware.RequireScope(h, scope))
+	}
+	handleSession := func(h http.HandlerFunc) http.HandlerFunc {
+		return handleChain(middleware.RequireSession(h))
+	}
+
+	writeLimiter := middleware.NewRateLimiter(cfg.WriteRateLimit, cfg.WriteRateBurst, cfg.RateLimitIdle)
+	redirectLimiter := middleware.NewRateLimiter(cfg.RedirectRateLimit, cfg.RedirectRateBurst, cfg.RateLimitIdle)
+	handleWrite := func(h http.HandlerFunc, scope string) http.HandlerFunc {
+		return handleScoped(middleware.RateLimitByUser(h, writeLimiter), scope)
+	}
+	handleSessionWrite := func(h http.HandlerFunc) http.HandlerFunc {
+		return handleSession(middleware.RateLimitByUser(h, writeLimiter))
+	}
+	handleRedirect := func(h http.HandlerFunc) http.HandlerFunc {
+		return handleChain(middleware.RateLimitByIP(h, redirectLimiter))
 	}
 
-	handlePostString := handleChain(handler.ProcessPostURLString)
-	handlePostObject := handleChain(handler.ProcessPostURLObject)
-	handlePostBatch := handleChain(handler.ProcessPostURLBatch)
-	handleGet := handleChain(handler.ProcessGet)
-	handleGetSummary := handleChain(handler.ProcessGetSummary)
-	handleDeleteUrls := handleChain(handler.ProcessDeleteUrls)
+	handlePostString := handleWrite(handler.ProcessPostURLString, service.ScopeShorten)
+	handlePostObject := handleWrite(handler.ProcessPostURLObject, service.ScopeShorten)
+	handlePostBatch := handleWrite(handler.ProcessPostURLBatch, service.ScopeShorten)
+	handleGet := handleRedirect(handler.ProcessGet)
+	handleGetQR := handleRedirect(handler.ProcessGetQR)
+	handleGetSummary := handleScoped(handler.ProcessGetSummary, service.ScopeRead)
+	handleDeleteUrls := handleWrite(handler.ProcessDeleteUrls, service.ScopeDelete)
+	handleGetUTMTemplates := handleScoped(handler.ProcessGetUTMTemplates, service.ScopeRead)
+	handlePutUTMTemplate := handleWrite(handler.ProcessPutUTMTemplate, service.ScopeShorten)
+	handleDeleteUTMTemplate := handleWrite(handler.ProcessDeleteUTMTemplate, service.ScopeShorten)
+	handleGetRules := handleScoped(handler.ProcessGetRules, service.ScopeRead)
+	handlePutRules := handleWrite(handler.ProcessPutRules, service.ScopeShorten)
+	handlePutVariants := handleWrite(handler.ProcessPutVariants, service.ScopeShorten)
+	handleGetStats := handleScoped(handler.ProcessGetStats, service.ScopeRead)
+	handlePatchMetadata := handleWrite(handler.ProcessPatchMetadata, service.ScopeShorten)
+	handlePostAPIKey := handleSessionWrite(handler.ProcessPostAPIKey)
+	handleGetAPIKeys := handleSession(handler.ProcessGetAPIKeys)
+	handleDeleteAPIKey := handleSession(handler.ProcessDeleteAPIKey)
+	handleGetUser := handleScoped(handler.ProcessGetUser, service.ScopeRead)
+	handlePostTeam := handleSessionWrite(handler.ProcessPostTeam)
+	handleGetTeams := handleScoped(handler.ProcessGetTeams, service.ScopeRead)
+	handleGetMembers := handleScoped(handler.ProcessGetMembers, service.ScopeRead)
+	handlePutMember := handleSessionWrite(handler.ProcessPutMember)
+	handleDeleteMember := handleSessionWrite(handler.ProcessDeleteMember)
+	handleAdminSearch := handleScoped(handler.ProcessAdminSearch, service.ScopeAdmin)
+	handleAdminGetURL := handleScoped(handler.ProcessAdminGetURL, service.ScopeAdmin)
+	handleAdminDisableURL := handleScoped(handler.ProcessAdminDisableURL, service.ScopeAdmin)
+	handleAdminEnableURL := handleScoped(handler.ProcessAdminEnableURL, service.ScopeAdmin)
+	handleAdminPutOwner := handleScoped(handler.ProcessAdminPutOwner, service.ScopeAdmin)
+	handleAdminGetUserURLs := handleScoped(handler.ProcessAdminGetUserURLs, service.ScopeAdmin)
+	handleAdminDisableUser := handleScoped(handler.ProcessAdminDisableUser, service.ScopeAdmin)
+	handleAdminGetQuota := handleScoped(handler.ProcessAdminGetQuota, service.ScopeAdmin)
+	handleAdminPutQuota := handleScoped(handler.ProcessAdminPutQuota, service.ScopeAdmin)
+	handleAdminDeleteQuota := handleScoped(handler.ProcessAdminDeleteQuota, service.ScopeAdmin)
+	handleAdminGetAudit := handleScoped(handler.ProcessAdminGetAudit, service.ScopeAdmin)
+	handleLogin := middleware.Log(handler.ProcessLogin, logger)
+	handleCallback := handleSession(handler.ProcessCallback)
+	handleLogout := middleware.Log(handler.ProcessLogout, logger)
 	handlePing := handler.ProcessPing(db)
+	handleGetInternalStats := middleware.Log(middleware.TrustedSubnet(handler.ProcessGetInternalStats, cfg.TrustedSubnet), logger)
 
 	router := chi.NewRouter()
 	router.Route("/", func(router chi.Router) {
@@ -60,8 +190,45 @@ func main() {
 		router.Post("/api/shorten/batch", handlePostBatch)
 		router.Get("/api/user/urls", handleGetSummary)
 		router.Get("/ping", handlePing)
+		router.Get("/api/internal/stats", handleGetInternalStats)
+		router.Get("/login", handleLogin)
+		router.Get("/callback", handleCallback)
+		router.Get("/logout", handleLogout)
+		router.Post("/logout", handleLogout)
 		router.Get("/{URL}", handleGet)
+		router.Get("/{URL}/qr", handleGetQR)
+		router.Get("/{URL}/*", handleGet)
+		router.Post("/{URL}", handleGet)
+		router.Post("/{URL}/*", handleGet)
 		router.Delete("/api/user/urls", handleDeleteUrls)
+		router.Get("/api/user/utm", handleGetUTMTemplates)
+		router.Put("/api/user/utm/{name}", handlePutUTMTemplate)
+		router.Delete("/api/user/utm/{name}", handleDeleteUTMTemplate)
+		router.Get("/api/user/urls/{URL}/rules", handleGetRules)
+		router.Put("/api/user/urls/{URL}/rules", handlePutRules)
+		router.Put("/api/user/urls/{URL}/variants", handlePutVariants)
+		router.Get("/api/user/urls/{URL}/stats", handleGetStats)
+		router.Patch("/api/user/urls/{URL}", handlePatchMetadata)
+		router.Post("/api/user/keys", handlePostAPIKey)
+		router.Get("/api/user/keys", handleGetAPIKeys)
+		router.Delete("/api/user/keys/{id}", handleDeleteAPIKey)
+		router.Get("/api/user", handleGetUser)
+		router.Post("/api/user/teams", handlePostTeam)
+		router.Get("/api/user/teams", handleGetTeams)
+		router.Get("/api/user/teams/{id}/members", handleGetMembers)
+		router.Put("/api/user/teams/{id}/members/{userID}", handlePutMember)
+		router.Delete("/api/user/teams/{id}/members/{userID}", handleDeleteMember)
+		router.Get("/api/admin/urls", handleAdminSearch)
+		router.Get("/api/admin/urls/{URL}", handleAdminGetURL)
+		router.Post("/api/admin/urls/{URL}/disable", handleAdminDisableURL)
+		router.Post("/api/admin/urls/{URL}/enable", handleAdminEnableURL)
+		router.Put("/api/admin/urls/{URL}/owner", handleAdminPutOwner)
+		router.Get("/api/admin/users/{userID}/urls", handleAdminGetUserURLs)
+		router.Post("/api/admin/users/{userID}/disable", handleAdminDisableUser)
+		router.Get("/api/admin/users/{userID}/quota", handleAdminGetQuota)
+		router.Put("/api/admin/users/{userID}/quota", handleAdminPutQuota)
+		router.Delete("/api/admin/users/{userID}/quota", handleAdminDeleteQuota)
+		router.Get("/api/admin/audit", handleAdminGetAudit)
 	})
 
 	params := fmt.Sprintf("%s:%d", cfg.LaunchAddr.Host, cfg.LaunchAddr.Port)
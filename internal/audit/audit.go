@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionCreate   = "create"
+	ActionEdit     = "edit"
+	ActionDelete   = "delete"
+	ActionDisable  = "disable"
+	ActionRestore  = "restore"
+	ActionTransfer = "transfer"
+	ActionQuota    = "quota"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// Event is one entry of the audit log. ActorID did the action, UserID is the
+// owner of the link or the user the action is about. Before and After hold
+// the values the action changed.
+type Event struct {
+	Time     time.Time      `json:"time"`
+	Action   string         `json:"action"`
+	ActorID  string         `json:"actor_id"`
+	ClientIP string         `json:"client_ip,omitempty"`
+	ShortURL string         `json:"short_url,omitempty"`
+	UserID   string         `json:"user_id,omitempty"`
+	Before   map[string]any `json:"before,omitempty"`
+	After    map[string]any `json:"after,omitempty"`
+}
+
+// Filter selects events, UserID matches the actor and the subject user. Zero
+// fields match everything.
+type Filter struct {
+	UserID   string
+	ShortURL string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+func (filter *Filter) match(event *Event) bool {
+	if filter.UserID != "" && event.ActorID != filter.UserID && event.UserID != filter.UserID {
+		return false
+	}
+
+	if filter.ShortURL != "" && event.ShortURL != filter.ShortURL {
+		return false
+	}
+
+	if !filter.From.IsZero() && event.Time.Before(filter.From) {
+		return false
+	}
+
+	return filter.To.IsZero() || event.Time.Before(filter.To)
+}
+
+// limit returns the number of events to return, a limit out of range is
+// replaced by the default or the maximum.
+func (filter *Filter) limit() int {
+	if filter.Limit <= 0 {
+		return defaultQueryLimit
+	}
+
+	return min(filter.Limit, maxQueryLimit)
+}
+
+// Sink is an append-only store of audit events, Query returns the newest
+// matching events first.
+type Sink interface {
+	Record(ctx context.Context, event Event) error
+	Query(ctx context.Context, filter Filter) ([]Event, error)
+	Finalize()
+}
+
+// NewSink keeps the log in the database if there is one and in the audit
+// file otherwise, without either nothing is logged.
+func NewSink(dbState *storage.DBState, cfg *config.Config) (Sink, error) {
+	if dbState.DB != nil {
+		sink, err := NewDBSink(dbState, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
+
+	if cfg.AuditFile != "" {
+		sink, err := NewFileSink(cfg.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
+
+	return nil, nil
+}
+
+func newestFirst(events []Event) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.After(events[j].Time) })
+}
+
+type clientIPKey struct{}
+
+// WithClientIP stores the address of the client the request came from.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
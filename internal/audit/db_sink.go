@@ -0,0 +1,171 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// DBSink keeps the events in a table next to the URL table.
+type DBSink struct {
+	state *storage.DBState
+	table string
+}
+
+func NewDBSink(state *storage.DBState, cfg *config.Config) (*DBSink, error) {
+	name := cfg.TableName + "_audit"
+	table := pq.QuoteIdentifier(name)
+
+	createTable := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+		id BIGSERIAL PRIMARY KEY,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		action TEXT NOT NULL,
+		actor_id TEXT NOT NULL,
+		client_ip TEXT NOT NULL DEFAULT '',
+		short_url TEXT NOT NULL DEFAULT '',
+		user_id TEXT NOT NULL DEFAULT '',
+		before JSONB,
+		after JSONB);
+		CREATE INDEX IF NOT EXISTS %s ON %s (created_at);
+		CREATE INDEX IF NOT EXISTS %s ON %s (short_url);
+		CREATE INDEX IF NOT EXISTS %s ON %s (actor_id);
+		CREATE INDEX IF NOT EXISTS %s ON %s (user_id);`,
+		table,
+		pq.QuoteIdentifier(name+"_created_at_idx"), table,
+		pq.QuoteIdentifier(name+"_short_url_idx"), table,
+		pq.QuoteIdentifier(name+"_actor_id_idx"), table,
+		pq.QuoteIdentifier(name+"_user_id_idx"), table,
+	)
+
+	if _, err := state.DB.ExecContext(context.Background(), createTable); err != nil {
+		return nil, fmt.Errorf("failed to create audit table: %w", err)
+	}
+
+	return &DBSink{state: state, table: table}, nil
+}
+
+// jsonValue encodes the values for a JSONB column, no values are stored as NULL.
+func jsonValue(values map[string]any) (any, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+func (sink *DBSink) Record(ctx context.Context, event Event) error {
+	before, err := jsonValue(event.Before)
+	if err != nil {
+		return err
+	}
+
+	after, err := jsonValue(event.After)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(
+		`INSERT INTO %s (created_at, action, actor_id, client_ip, short_url, user_id, before, after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		sink.table,
+	)
+
+	_, err = sink.state.DB.ExecContext(ctx, query,
+		event.Time, event.Action, event.ActorID, event.ClientIP, event.ShortURL, event.UserID, before, after)
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+
+	return nil
+}
+
+func (sink *DBSink) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	conditions := make([]string, 0)
+	args := make([]any, 0)
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UserID != "" {
+		where("(actor_id = $%[1]d OR user_id = $%[1]d)", filter.UserID)
+	}
+	if filter.ShortURL != "" {
+		where("short_url = $%d", filter.ShortURL)
+	}
+	if !filter.From.IsZero() {
+		where("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("created_at < $%d", filter.To)
+	}
+
+	query := fmt.Sprintf(
+		`SELECT created_at, action, actor_id, client_ip, short_url, user_id, before, after FROM %s`,
+		sink.table,
+	)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, filter.limit())
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := sink.state.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		var event Event
+		var createdAt time.Time
+		var before, after []byte
+		err := rows.Scan(&createdAt, &event.Action, &event.ActorID, &event.ClientIP, &event.ShortURL, &event.UserID, &before, &after)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+
+		event.Time = createdAt
+		if err := decodeValues(before, &event.Before); err != nil {
+			return nil, err
+		}
+		if err := decodeValues(after, &event.After); err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return events, nil
+}
+
+func decodeValues(data []byte, values *map[string]any) error {
+	if data == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, values)
+}
+
+// Finalize leaves the database to the storage that shares it.
+func (sink *DBSink) Finalize() {
+}
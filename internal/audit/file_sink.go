@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileSink appends the events to a JSON lines file and scans it on queries.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{path: path, file: file}, nil
+}
+
+func (sink *FileSink) Record(ctx context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	// a single write per line keeps lines whole
+	if _, err := sink.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+
+	return nil
+}
+
+// Query scans the file without holding up Record, it reads the lines that
+// were complete when it started.
+func (sink *FileSink) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	sink.mu.Lock()
+	info, err := sink.file.Stat()
+	sink.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(sink.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := make([]Event, 0)
+	scanner := bufio.NewScanner(io.LimitReader(file, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("invalid audit file line: %w", err)
+		}
+
+		if filter.match(&event) {
+			events = append(events, event)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	newestFirst(events)
+	if limit := filter.limit(); len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
+
+func (sink *FileSink) Finalize() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	sink.file.Close()
+}
@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ctx := context.Background()
+
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Time: start, Action: ActionCreate, ActorID: "alice", ClientIP: "10.0.0.1", ShortURL: "abc", UserID: "alice",
+			After: map[string]any{"long_url": "https://foo.com"}},
+		{Time: start.Add(time.Minute), Action: ActionEdit, ActorID: "bob", ShortURL: "abc", UserID: "alice",
+			Before: map[string]any{"title": ""}, After: map[string]any{"title": "Foo"}},
+		{Time: start.Add(2 * time.Minute), Action: ActionCreate, ActorID: "bob", ShortURL: "def", UserID: "bob"},
+		{Time: start.Add(3 * time.Minute), Action: ActionDisable, ActorID: "root", ShortURL: "abc", UserID: "alice"},
+	}
+	for _, event := range events {
+		require.NoError(t, sink.Record(ctx, event))
+	}
+	sink.Finalize()
+
+	// the log outlives the sink
+	sink, err = NewFileSink(path)
+	require.NoError(t, err)
+	defer sink.Finalize()
+
+	tests := []struct {
+		name    string
+		filter  Filter
+		actions []string
+	}{
+		{name: "all newest first", filter: Filter{}, actions: []string{ActionDisable, ActionCreate, ActionEdit, ActionCreate}},
+		{name: "by code", filter: Filter{ShortURL: "abc"}, actions: []string{ActionDisable, ActionEdit, ActionCreate}},
+		{name: "by actor or owner", filter: Filter{UserID: "alice"}, actions: []string{ActionDisable, ActionEdit, ActionCreate}},
+		{name: "by time", filter: Filter{From: start.Add(time.Minute), To: start.Add(3 * time.Minute)}, actions: []string{ActionCreate, ActionEdit}},
+		{name: "limit", filter: Filter{UserID: "bob", Limit: 1}, actions: []string{ActionCreate}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, err := sink.Query(ctx, test.filter)
+			require.NoError(t, err)
+
+			actions := make([]string, 0, len(found))
+			for _, event := range found {
+				actions = append(actions, event.Action)
+			}
+			assert.Equal(t, test.actions, actions)
+		})
+	}
+
+	found, err := sink.Query(ctx, Filter{UserID: "bob", ShortURL: "abc"})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, map[string]any{"title": ""}, found[0].Before)
+	assert.Equal(t, map[string]any{"title": "Foo"}, found[0].After)
+	assert.True(t, found[0].Time.Equal(start.Add(time.Minute)))
+}
+
+func TestFileSinkConcurrentQuery(t *testing.T) {
+	sink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	defer sink.Finalize()
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, sink.Record(ctx, Event{Time: time.Now(), Action: ActionCreate, ActorID: "alice", ShortURL: fmt.Sprint(i)}))
+		}
+	}()
+
+	// queries see whole lines only, however far the writer is
+	seen := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		found, err := sink.Query(ctx, Filter{Limit: maxQueryLimit})
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, len(found), seen)
+		seen = len(found)
+	}
+
+	found, err := sink.Query(ctx, Filter{Limit: maxQueryLimit})
+	require.NoError(t, err)
+	assert.Len(t, found, 200)
+}
@@ -0,0 +1,169 @@
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rules struct {
+	domains  []string
+	prefixes []string
+	patterns []*regexp.Regexp
+}
+
+// Blocklist holds phishing/malware rules loaded from a local file. The file
+// consists of "domain <domain>", "prefix <URL prefix>" and "regex <pattern>"
+// lines, empty lines and lines starting with '#' are ignored.
+type Blocklist struct {
+	path     string
+	mu       sync.RWMutex
+	rules    rules
+	modTime  time.Time
+	stopChan chan struct{}
+}
+
+func (blocklist *Blocklist) Match(longURL string) (string, bool) {
+	blocklist.mu.RLock()
+	defer blocklist.mu.RUnlock()
+
+	if parsedURL, err := url.Parse(longURL); err == nil {
+		host := strings.ToLower(parsedURL.Hostname())
+		for _, domain := range blocklist.rules.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return "domain " + domain, true
+			}
+		}
+	}
+
+	for _, prefix := range blocklist.rules.prefixes {
+		if strings.HasPrefix(longURL, prefix) {
+			return "prefix " + prefix, true
+		}
+	}
+
+	for _, pattern := range blocklist.rules.patterns {
+		if pattern.MatchString(longURL) {
+			return "regex " + pattern.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// Watch polls the file modification time and reloads the rules when it
+// changes, onReload is called after every successful reload.
+func (blocklist *Blocklist) Watch(interval time.Duration, onReload func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				reloaded, err := blocklist.reloadIfChanged()
+				if err != nil {
+					log.Printf("Failed to reload blocklist: %v", err)
+					continue
+				}
+
+				if reloaded {
+					log.Printf("Blocklist reloaded from %s", blocklist.path)
+					onReload()
+				}
+			case <-blocklist.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (blocklist *Blocklist) Finalize() {
+	close(blocklist.stopChan)
+}
+
+func (blocklist *Blocklist) reloadIfChanged() (bool, error) {
+	info, err := os.Stat(blocklist.path)
+	if err != nil {
+		return false, err
+	}
+
+	blocklist.mu.RLock()
+	unchanged := info.ModTime().Equal(blocklist.modTime)
+	blocklist.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	return true, blocklist.load()
+}
+
+func (blocklist *Blocklist) load() error {
+	file, err := os.Open(blocklist.path)
+	if err != nil {
+		return fmt.Errorf("error reading blocklist file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var loaded rules
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, value, found := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		if !found || value == "" {
+			return fmt.Errorf("blocklist line %d: expected '<domain|prefix|regex> <value>'", lineNum)
+		}
+
+		switch strings.ToLower(kind) {
+		case "domain":
+			loaded.domains = append(loaded.domains, strings.ToLower(strings.TrimPrefix(value, ".")))
+		case "prefix":
+			loaded.prefixes = append(loaded.prefixes, value)
+		case "regex":
+			pattern, err := regexp.Compile(value)
+			if err != nil {
+				return fmt.Errorf("blocklist line %d: %w", lineNum, err)
+			}
+			loaded.patterns = append(loaded.patterns, pattern)
+		default:
+			return fmt.Errorf("blocklist line %d: unknown rule type '%s'", lineNum, kind)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	blocklist.mu.Lock()
+	blocklist.rules = loaded
+	blocklist.modTime = info.ModTime()
+	blocklist.mu.Unlock()
+
+	return nil
+}
+
+func NewBlocklist(path string) (*Blocklist, error) {
+	blocklist := &Blocklist{path: path, stopChan: make(chan struct{})}
+	if err := blocklist.load(); err != nil {
+		return nil, err
+	}
+
+	return blocklist, nil
+}
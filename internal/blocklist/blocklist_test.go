@@ -0,0 +1,66 @@
+package blocklist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	rules := "# test rules\ndomain evil.com\nprefix https://docs.foo.com/forms/\nregex \\.zip$\n"
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0644))
+
+	blocklist, err := NewBlocklist(path)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		longURL string
+		blocked bool
+	}{
+		{name: "domain", longURL: "https://evil.com/login", blocked: true},
+		{name: "subdomain", longURL: "https://login.evil.com", blocked: true},
+		{name: "prefix", longURL: "https://docs.foo.com/forms/123", blocked: true},
+		{name: "regex", longURL: "https://www.bar.com/setup.zip", blocked: true},
+		{name: "clean", longURL: "https://docs.foo.com/page", blocked: false},
+		{name: "similar domain", longURL: "https://notevil.com", blocked: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, blocked := blocklist.Match(test.longURL)
+			assert.Equal(t, test.blocked, blocked)
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("domain evil.com\n"), 0644))
+
+	blocklist, err := NewBlocklist(path)
+	require.NoError(t, err)
+	defer blocklist.Finalize()
+
+	reloaded := make(chan struct{}, 1)
+	blocklist.Watch(10*time.Millisecond, func() { reloaded <- struct{}{} })
+
+	require.NoError(t, os.WriteFile(path, []byte("domain bad.org\n"), 0644))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("blocklist was not reloaded")
+	}
+
+	_, blocked := blocklist.Match("https://bad.org")
+	assert.True(t, blocked)
+	_, blocked = blocklist.Match("https://evil.com")
+	assert.False(t, blocked)
+}
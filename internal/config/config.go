@@ -2,8 +2,12 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"log"
-	"os"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 )
@@ -16,16 +20,162 @@ type Config struct {
 	TableName    string      `env:"DB_TABLE_NAME"`
 	ShortURLLen  uint        `env:"SHORT_URL_LEN"`
 	SecretKey    string      `env:"SECRET_KEY"`
+
+	SigningKeys       SigningKeys   `env:"SIGNING_KEYS"`
+	SessionIssuer     string        `env:"SESSION_ISSUER"`
+	SessionTTL        time.Duration `env:"SESSION_TTL"`
+	SessionRenewAfter time.Duration `env:"SESSION_RENEW_AFTER"`
+
+	// InvalidSessionPolicy is "renew", "previous" or "reject". PreviousSigningKeys
+	// are retired keys whose sessions the "previous" policy moves to the current
+	// key, sessions that do not verify with them are renewed. Sessions without
+	// expiry are only moved before LegacySessionsUntil
+	InvalidSessionPolicy string      `env:"INVALID_SESSION_POLICY"`
+	PreviousSigningKeys  SigningKeys `env:"PREVIOUS_SIGNING_KEYS"`
+	LegacySessionsUntil  time.Time   `env:"LEGACY_SESSIONS_UNTIL"`
+
+	CookiePath     string `env:"COOKIE_PATH"`
+	CookieSecure   bool   `env:"COOKIE_SECURE"`
+	CookieHTTPOnly bool   `env:"COOKIE_HTTP_ONLY"`
+	CookieSameSite string `env:"COOKIE_SAME_SITE"`
+
+	// OIDCIssuer enables login with an OpenID Connect provider when not empty,
+	// OIDCRedirectURL defaults to /callback under PublishAddr
+	OIDCIssuer       string `env:"OIDC_ISSUER"`
+	OIDCClientID     string `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string `env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL  string `env:"OIDC_REDIRECT_URL"`
+	OIDCScopes       string `env:"OIDC_SCOPES"`
+
+	// AdminUserIDs may use /api/admin, either with a session or with an API key that has the admin scope
+	AdminUserIDs string `env:"ADMIN_USER_IDS"`
+
+	// AuditFile keeps the audit log when there is no database, empty disables it
+	AuditFile string `env:"AUDIT_FILE"`
+
+	// TrustedSubnet may read /api/internal, the client address is taken from X-Real-IP
+	TrustedSubnet TrustedSubnet `env:"TRUSTED_SUBNET"`
+
+	// TrustedProxies may set X-Real-IP for rate limits, the audit log and
+	// GeoIP rules, other requests are attributed to their peer address
+	TrustedProxies TrustedProxies `env:"TRUSTED_PROXIES"`
+
+	// Rate limits are requests per minute on top of a burst, 0 disables a limit.
+	// Writes are limited per user, redirects per client IP
+	WriteRateLimit    int           `env:"WRITE_RATE_LIMIT"`
+	WriteRateBurst    int           `env:"WRITE_RATE_BURST"`
+	RedirectRateLimit int           `env:"REDIRECT_RATE_LIMIT"`
+	RedirectRateBurst int           `env:"REDIRECT_RATE_BURST"`
+	RateLimitIdle     time.Duration `env:"RATE_LIMIT_IDLE"`
+
+	// MaxActiveLinks caps the links a user has that are not deleted, MaxDailyLinks
+	// the links a user creates within 24 hours. 0 lifts a quota, operators
+	// override both per user
+	MaxActiveLinks int `env:"MAX_ACTIVE_LINKS"`
+	MaxDailyLinks  int `env:"MAX_DAILY_LINKS"`
+
+	AllowedSchemes  string `env:"ALLOWED_SCHEMES"`
+	DomainListFile  string `env:"DOMAIN_LIST_FILE"`
+	BlockPrivateIPs bool   `env:"BLOCK_PRIVATE_IPS"`
+
+	BlocklistFile           string        `env:"BLOCKLIST_FILE"`
+	BlocklistReloadInterval time.Duration `env:"BLOCKLIST_RELOAD_INTERVAL"`
+
+	HealthCheckInterval     time.Duration `env:"HEALTH_CHECK_INTERVAL"`
+	HealthCheckConcurrency  int           `env:"HEALTH_CHECK_CONCURRENCY"`
+	HealthCheckHostInterval time.Duration `env:"HEALTH_CHECK_HOST_INTERVAL"`
+	HealthCheckTimeout      time.Duration `env:"HEALTH_CHECK_TIMEOUT"`
+
+	DefaultRedirectCode int           `env:"DEFAULT_REDIRECT_CODE"`
+	RedirectCacheMaxAge time.Duration `env:"REDIRECT_CACHE_MAX_AGE"`
+
+	PassthroughConflict string `env:"PASSTHROUGH_CONFLICT"`
+
+	GeoIPFile string `env:"GEOIP_FILE"`
+
+	PasswordAttempts      int           `env:"PASSWORD_ATTEMPTS"`
+	PasswordAttemptWindow time.Duration `env:"PASSWORD_ATTEMPT_WINDOW"`
+
+	ComingSoonURL string `env:"COMING_SOON_URL"`
+
+	MetadataFetchWorkers  int           `env:"METADATA_FETCH_WORKERS"`
+	MetadataFetchQueue    int           `env:"METADATA_FETCH_QUEUE"`
+	MetadataFetchTimeout  time.Duration `env:"METADATA_FETCH_TIMEOUT"`
+	MetadataFetchMaxBytes int64         `env:"METADATA_FETCH_MAX_BYTES"`
+}
+
+// IsAdmin reports whether the user is listed as an operator.
+func (cfg *Config) IsAdmin(userID string) bool {
+	if userID == "" {
+		return false
+	}
+
+	for _, adminID := range strings.Split(cfg.AdminUserIDs, ",") {
+		if strings.TrimSpace(adminID) == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LimitsByClientIP reports whether limits count requests per client address.
+// Those are redirects, writes and quotas of requests without a session.
+func (cfg *Config) LimitsByClientIP() bool {
+	return cfg.RedirectRateLimit > 0 || cfg.WriteRateLimit > 0 || cfg.MaxActiveLinks > 0 || cfg.MaxDailyLinks > 0
+}
+
+// IsPassthroughConflict reports whether rule names a passthrough query conflict rule.
+func IsPassthroughConflict(rule string) bool {
+	return rule == "incoming" || rule == "target"
+}
+
+// IsInvalidSessionPolicy reports whether policy names a way to treat unverifiable sessions.
+func IsInvalidSessionPolicy(policy string) bool {
+	return policy == "renew" || policy == "previous" || policy == "reject"
+}
+
+// IsSameSite reports whether mode is a SameSite cookie attribute value.
+func IsSameSite(mode string) bool {
+	return mode == "lax" || mode == "strict" || mode == "none"
+}
+
+// IsRedirectCode reports whether code may be used to answer a short link visit.
+func IsRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
 }
 
-func loadSecretKey() (string, error) {
-	keyData, err := os.ReadFile("pseudo_secret_key_file.txt")
-	if err != nil {
-		return "pseudo_secret_key", nil
-		//return "", fmt.Errorf("error reading secret key file: %w", err)
+// minSecretLen is the shortest signing key accepted, HS256 keys should be as
+// long as the hash.
+const minSecretLen = 32
+
+// placeholderSecrets are sample keys that were once shipped with the source.
+var placeholderSecrets = []string{"pseudo_secret_key", "secret", "changeme"}
+
+// checkSigningKeys refuses keys anyone could guess, sessions signed with them
+// could be forged for any user.
+func checkSigningKeys(keys SigningKeys) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("no session signing key configured, set SIGNING_KEYS or SECRET_KEY")
+	}
+
+	for _, key := range keys {
+		if slices.Contains(placeholderSecrets, strings.ToLower(strings.TrimSpace(key.Secret))) {
+			return fmt.Errorf("signing key '%s' is a placeholder, configure a random one", key.ID)
+		}
+
+		if len(key.Secret) < minSecretLen {
+			return fmt.Errorf("signing key '%s' is shorter than %d bytes", key.ID, minSecretLen)
+		}
 	}
 
-	return string(keyData), nil
+	return nil
 }
 
 func LoadConfig() (*Config, error) {
@@ -40,19 +190,116 @@ func LoadConfig() (*Config, error) {
 	flag.StringVar(&cfg.StorageFile, "f", "storage.dat", "Storage file path (format: filesystem path)")
 	flag.StringVar(&cfg.DBConnParams, "d", "", "DB connection params (format: host=%s user=%s password=%s dbname=%s)")
 	flag.StringVar(&cfg.TableName, "t", "urls", "DB table name (format: string)")
-	flag.StringVar(&cfg.SecretKey, "k", "", "DB table name (format: string)")
+	flag.StringVar(&cfg.SecretKey, "k", "", "Session signing key, used as key 'default' (format: string)")
+	flag.Var(&cfg.SigningKeys, "signing-keys", "Session signing keys, the first one signs new sessions (format: kid:secret,kid:secret)")
+	flag.StringVar(&cfg.SessionIssuer, "session-issuer", "url_shortener", "Issuer of session tokens (format: string)")
+	flag.DurationVar(&cfg.SessionTTL, "session-ttl", 30*24*time.Hour, "Session lifetime (format: duration)")
+	flag.DurationVar(&cfg.SessionRenewAfter, "session-renew-after", 24*time.Hour, "Session age after which it is renewed on use (format: duration)")
+	flag.StringVar(&cfg.InvalidSessionPolicy, "invalid-session-policy", "renew", "Handling of unverifiable session cookies (format: renew, previous or reject)")
+	flag.Var(&cfg.PreviousSigningKeys, "previous-signing-keys", "Retired session signing keys (format: kid:secret,kid:secret)")
+	flag.Func("legacy-sessions-until", "End of the acceptance of sessions without expiry signed with retired keys, empty refuses them (format: RFC 3339 time)", func(value string) error {
+		until, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("RFC 3339 time required")
+		}
+
+		cfg.LegacySessionsUntil = until
+		return nil
+	})
+	flag.StringVar(&cfg.CookiePath, "cookie-path", "/", "Session cookie path (format: string)")
+	flag.BoolVar(&cfg.CookieSecure, "cookie-secure", false, "Send the session cookie over HTTPS only (format: bool)")
+	flag.BoolVar(&cfg.CookieHTTPOnly, "cookie-http-only", true, "Hide the session cookie from scripts (format: bool)")
+	flag.StringVar(&cfg.CookieSameSite, "cookie-same-site", "lax", "Session cookie SameSite mode (format: lax, strict or none)")
+	flag.StringVar(&cfg.OIDCIssuer, "oidc-issuer", "", "OpenID Connect issuer, empty disables login (format: URL)")
+	flag.StringVar(&cfg.OIDCClientID, "oidc-client-id", "", "OpenID Connect client ID (format: string)")
+	flag.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", "", "OpenID Connect client secret (format: string)")
+	flag.StringVar(&cfg.OIDCRedirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL, empty means <base URL>/callback (format: URL)")
+	flag.StringVar(&cfg.OIDCScopes, "oidc-scopes", "openid,email", "OpenID Connect scopes (format: comma separated list)")
+	flag.StringVar(&cfg.AdminUserIDs, "admin-users", "", "User IDs of operators (format: comma separated list)")
+	flag.Var(&cfg.TrustedSubnet, "trusted-subnet", "Subnet allowed to read internal stats, empty denies everyone (format: CIDR)")
+	flag.Var(&cfg.TrustedProxies, "trusted-proxies", "Reverse proxies allowed to set X-Real-IP, which rate limits, quotas and the audit log take as the client IP, empty trusts none (format: comma separated CIDRs)")
+	flag.IntVar(&cfg.WriteRateLimit, "write-rate-limit", 60, "Write requests per minute of a user or of a client IP without a session, 0 disables the limit (format: int)")
+	flag.IntVar(&cfg.WriteRateBurst, "write-rate-burst", 20, "Write requests a user may make at once (format: int)")
+	flag.IntVar(&cfg.RedirectRateLimit, "redirect-rate-limit", 600, "Redirects per minute of a client IP, behind a reverse proxy set -trusted-proxies or all clients share one limit, 0 disables the limit (format: int)")
+	flag.IntVar(&cfg.RedirectRateBurst, "redirect-rate-burst", 100, "Redirects a client IP may request at once (format: int)")
+	flag.DurationVar(&cfg.RateLimitIdle, "rate-limit-idle", 10*time.Minute, "Idle time after which a rate limit bucket is forgotten (format: duration)")
+	flag.IntVar(&cfg.MaxActiveLinks, "max-active-links", 0, "Links a user may have, 0 means unlimited (format: int)")
+	flag.IntVar(&cfg.MaxDailyLinks, "max-daily-links", 0, "Links a user may create within 24 hours, 0 means unlimited (format: int)")
+	flag.StringVar(&cfg.AuditFile, "audit-file", "audit.log", "Audit log file path used without a database, empty disables the log (format: filesystem path)")
 	flag.UintVar(&cfg.ShortURLLen, "l", 8, "short URL len (format: uint)")
+	flag.StringVar(&cfg.AllowedSchemes, "allowed-schemes", "http,https", "Allowed long URL schemes (format: comma separated list)")
+	flag.StringVar(&cfg.DomainListFile, "domain-list", "", "Domain allow/deny list file path (format: filesystem path)")
+	flag.BoolVar(&cfg.BlockPrivateIPs, "block-private-ips", true, "Reject long URLs pointing into private networks (format: bool)")
+	flag.StringVar(&cfg.BlocklistFile, "blocklist", "", "Phishing/malware blocklist file path (format: filesystem path)")
+	flag.DurationVar(&cfg.BlocklistReloadInterval, "blocklist-reload", 30*time.Second, "Blocklist file check interval (format: duration)")
+	flag.DurationVar(&cfg.HealthCheckInterval, "health-check", 0, "Link health check interval, 0 disables checks (format: duration)")
+	flag.IntVar(&cfg.HealthCheckConcurrency, "health-check-concurrency", 4, "Max simultaneous health check requests (format: int)")
+	flag.DurationVar(&cfg.HealthCheckHostInterval, "health-check-host-interval", time.Second, "Min delay between health checks of one host (format: duration)")
+	flag.DurationVar(&cfg.HealthCheckTimeout, "health-check-timeout", 10*time.Second, "Health check request timeout (format: duration)")
+	flag.IntVar(&cfg.DefaultRedirectCode, "redirect-code", http.StatusTemporaryRedirect, "Default redirect status (format: 301, 302, 303, 307 or 308)")
+	flag.DurationVar(&cfg.RedirectCacheMaxAge, "redirect-cache-max-age", 24*time.Hour, "Cache lifetime of permanent redirects (format: duration)")
+	flag.StringVar(&cfg.PassthroughConflict, "passthrough-conflict", "incoming", "Query parameter that wins on passthrough (format: incoming or target)")
+	flag.StringVar(&cfg.GeoIPFile, "geoip", "", "GeoIP database file path (format: CSV of network,country)")
+	flag.IntVar(&cfg.PasswordAttempts, "password-attempts", 5, "Wrong password attempts allowed per link within the window (format: int)")
+	flag.DurationVar(&cfg.PasswordAttemptWindow, "password-attempt-window", time.Minute, "Wrong password attempts window (format: duration)")
+	flag.StringVar(&cfg.ComingSoonURL, "coming-soon-url", "", "Redirect target of links not active yet, empty shows a page (format: URL)")
+	flag.IntVar(&cfg.MetadataFetchWorkers, "metadata-fetch-workers", 2, "Workers fetching titles of new links, 0 disables fetching (format: int)")
+	flag.IntVar(&cfg.MetadataFetchQueue, "metadata-fetch-queue", 256, "Links waiting for title fetching (format: int)")
+	flag.DurationVar(&cfg.MetadataFetchTimeout, "metadata-fetch-timeout", 5*time.Second, "Title fetch request timeout (format: duration)")
+	flag.Int64Var(&cfg.MetadataFetchMaxBytes, "metadata-fetch-max-bytes", 512*1024, "Max bytes of a page read for its title (format: int)")
 	flag.Parse()
 
 	env.Parse(cfg)
 
-	if cfg.SecretKey == "" {
-		secretKey, err := loadSecretKey()
-		if err != nil {
-			return nil, err
+	if !IsRedirectCode(cfg.DefaultRedirectCode) {
+		return nil, fmt.Errorf("unsupported default redirect code %d", cfg.DefaultRedirectCode)
+	}
+
+	if !IsPassthroughConflict(cfg.PassthroughConflict) {
+		return nil, fmt.Errorf("unsupported passthrough conflict rule '%s'", cfg.PassthroughConflict)
+	}
+
+	if len(cfg.SigningKeys) == 0 && cfg.SecretKey != "" {
+		cfg.SigningKeys = SigningKeys{{ID: "default", Secret: cfg.SecretKey}}
+	}
+
+	if err := checkSigningKeys(cfg.SigningKeys); err != nil {
+		return nil, err
+	}
+
+	if !IsInvalidSessionPolicy(cfg.InvalidSessionPolicy) {
+		return nil, fmt.Errorf("unsupported invalid session policy '%s'", cfg.InvalidSessionPolicy)
+	}
+
+	if !IsSameSite(cfg.CookieSameSite) {
+		return nil, fmt.Errorf("unsupported cookie SameSite mode '%s'", cfg.CookieSameSite)
+	}
+
+	// browsers drop SameSite=None cookies that are not Secure
+	if cfg.CookieSameSite == "none" && !cfg.CookieSecure {
+		return nil, fmt.Errorf("SameSite=None cookies must be secure")
+	}
+
+	if cfg.OIDCIssuer != "" {
+		if cfg.OIDCClientID == "" {
+			return nil, fmt.Errorf("OpenID Connect login needs a client ID")
+		}
+
+		if cfg.OIDCRedirectURL == "" {
+			cfg.OIDCRedirectURL = cfg.PublishAddr.String() + "/callback"
 		}
+	}
+
+	if cfg.MaxActiveLinks < 0 || cfg.MaxDailyLinks < 0 {
+		return nil, fmt.Errorf("link quotas must not be negative")
+	}
+
+	if cfg.WriteRateLimit < 0 || cfg.RedirectRateLimit < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
 
-		cfg.SecretKey = secretKey
+	if cfg.SessionTTL <= 0 {
+		return nil, fmt.Errorf("session lifetime must be positive")
 	}
 
 	return cfg, nil
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSigningKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    SigningKeys
+		wantErr string
+	}{
+		{
+			name:    "missing",
+			wantErr: "no session signing key configured",
+		},
+		{
+			name:    "placeholder",
+			keys:    SigningKeys{{ID: "default", Secret: "pseudo_secret_key"}},
+			wantErr: "placeholder",
+		},
+		{
+			name:    "too short",
+			keys:    SigningKeys{{ID: "default", Secret: "0123456789"}},
+			wantErr: "shorter than 32 bytes",
+		},
+		{
+			name:    "short rotated key",
+			keys:    SigningKeys{{ID: "new", Secret: "f3Jq8vX2mB9tR6wL1cY5nH7kP0sD4gZa"}, {ID: "old", Secret: "old"}},
+			wantErr: "signing key 'old' is shorter",
+		},
+		{
+			name: "random keys",
+			keys: SigningKeys{{ID: "new", Secret: "f3Jq8vX2mB9tR6wL1cY5nH7kP0sD4gZa"}, {ID: "old", Secret: "Qe7uT1oI9pA3sD5fG8hJ2kL4zX6cV0bN"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkSigningKeys(test.keys)
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestLimitsByClientIP(t *testing.T) {
+	assert.False(t, (&Config{}).LimitsByClientIP())
+	assert.True(t, (&Config{RedirectRateLimit: 600}).LimitsByClientIP())
+	assert.True(t, (&Config{WriteRateLimit: 60}).LimitsByClientIP())
+	assert.True(t, (&Config{MaxDailyLinks: 10}).LimitsByClientIP())
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+type SigningKey struct {
+	ID     string
+	Secret string
+}
+
+// SigningKeys are the session signing keys in the form "kid:secret,kid:secret".
+// The first key signs new sessions, the rest are only accepted, which lets
+// a key be rotated out without logging everyone out.
+type SigningKeys []SigningKey
+
+func (keys SigningKeys) String() string {
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key.ID+":***")
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func (keys *SigningKeys) Set(value string) error {
+	parsed := SigningKeys{}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		id, secret, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found || id == "" || secret == "" {
+			return fmt.Errorf("signing key in a form kid:secret required")
+		}
+
+		if seen[id] {
+			return fmt.Errorf("duplicate signing key id '%s'", id)
+		}
+		seen[id] = true
+
+		parsed = append(parsed, SigningKey{ID: id, Secret: secret})
+	}
+
+	*keys = parsed
+	return nil
+}
+
+func (keys *SigningKeys) UnmarshalText(text []byte) error {
+	return keys.Set(string(text))
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TrustedProxies are the CIDRs of the reverse proxies whose X-Real-IP header
+// is believed, in the form "cidr,cidr". Requests from other peers are
+// attributed to the peer address.
+type TrustedProxies []*net.IPNet
+
+func (proxies TrustedProxies) String() string {
+	networks := make([]string, 0, len(proxies))
+	for _, network := range proxies {
+		networks = append(networks, network.String())
+	}
+
+	return strings.Join(networks, ",")
+}
+
+func (proxies *TrustedProxies) Set(value string) error {
+	parsed := TrustedProxies{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return fmt.Errorf("trusted proxy subnet in CIDR notation required")
+		}
+
+		parsed = append(parsed, network)
+	}
+
+	*proxies = parsed
+	return nil
+}
+
+func (proxies *TrustedProxies) UnmarshalText(text []byte) error {
+	return proxies.Set(string(text))
+}
+
+// Contains reports whether ip belongs to a trusted proxy.
+func (proxies TrustedProxies) Contains(ip net.IP) bool {
+	for _, network := range proxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// TrustedSubnet is the CIDR internal endpoints answer to, an empty subnet
+// trusts nobody.
+type TrustedSubnet struct {
+	network *net.IPNet
+}
+
+func (subnet TrustedSubnet) String() string {
+	if subnet.network == nil {
+		return ""
+	}
+
+	return subnet.network.String()
+}
+
+func (subnet *TrustedSubnet) Set(value string) error {
+	if value == "" {
+		subnet.network = nil
+		return nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return fmt.Errorf("subnet in CIDR notation required")
+	}
+
+	subnet.network = network
+	return nil
+}
+
+func (subnet *TrustedSubnet) UnmarshalText(text []byte) error {
+	return subnet.Set(string(text))
+}
+
+// Contains reports whether ip is inside the subnet.
+func (subnet TrustedSubnet) Contains(ip net.IP) bool {
+	return subnet.network != nil && ip != nil && subnet.network.Contains(ip)
+}
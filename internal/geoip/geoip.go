@@ -0,0 +1,83 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DB maps IP networks to ISO country codes. It is loaded from a CSV file
+// of "network,country" rows, e.g. "81.2.69.0/24,GB".
+type DB struct {
+	// networks are keyed by prefix length and then by the masked network address
+	networks map[int]map[string]string
+	lengths  []int
+}
+
+func (db *DB) Lookup(ipAddr string) (string, bool) {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return "", false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, length := range db.lengths {
+		if length > len(ip)*8 {
+			continue
+		}
+
+		network := ip.Mask(net.CIDRMask(length, len(ip)*8))
+		if country, ok := db.networks[length][network.String()]; ok {
+			return country, true
+		}
+	}
+
+	return "", false
+}
+
+func Load(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GeoIP file: %w", err)
+	}
+	defer file.Close()
+
+	db := &DB{networks: make(map[int]map[string]string)}
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	for {
+		row, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("error reading GeoIP file: %w", err)
+		}
+
+		_, network, err := net.ParseCIDR(strings.TrimSpace(row[0]))
+		if err != nil {
+			return nil, fmt.Errorf("error reading GeoIP file: %w", err)
+		}
+
+		ones, _ := network.Mask.Size()
+		if _, exists := db.networks[ones]; !exists {
+			db.networks[ones] = make(map[string]string)
+			db.lengths = append(db.lengths, ones)
+		}
+
+		db.networks[ones][network.IP.String()] = strings.ToUpper(strings.TrimSpace(row[1]))
+	}
+
+	// the most specific network wins
+	sort.Sort(sort.Reverse(sort.IntSlice(db.lengths)))
+	return db, nil
+}
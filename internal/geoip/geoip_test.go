@@ -0,0 +1,38 @@
+package geoip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.csv")
+	data := "# network,country\n81.2.0.0/16,gb\n81.2.69.0/24,DE\n2a02:c7f::/32,GB\n"
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	db, err := Load(path)
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip      string
+		country string
+		found   bool
+	}{
+		{ip: "81.2.1.1", country: "GB", found: true},
+		{ip: "81.2.69.160", country: "DE", found: true},
+		{ip: "2a02:c7f:1234::1", country: "GB", found: true},
+		{ip: "8.8.8.8", found: false},
+		{ip: "not an ip", found: false},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			country, found := db.Lookup(test.ip)
+			assert.Equal(t, test.found, found)
+			assert.Equal(t, test.country, country)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/service"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+func (handler *URLHandler) newAdminURLItem(record *storage.URLRecord) AdminURLItem {
+	return AdminURLItem{
+		ShortURL:       fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, record.ShortURL),
+		Code:           record.ShortURL,
+		LongURL:        record.LongURL,
+		UserID:         record.UserID,
+		Team:           record.TeamID,
+		Deleted:        record.Deleted,
+		Blocked:        record.Blocked,
+		Disabled:       record.Disabled,
+		DisabledReason: record.DisabledReason,
+		CreatedAt:      record.CreatedAt,
+	}
+}
+
+func (handler *URLHandler) writeAdminURLs(rsp http.ResponseWriter, records []storage.URLRecord) {
+	items := make([]AdminURLItem, 0, len(records))
+	for _, record := range records {
+		items = append(items, handler.newAdminURLItem(&record))
+	}
+
+	writeJSON(rsp, http.StatusOK, items)
+}
+
+func (handler *URLHandler) ProcessAdminSearch(rsp http.ResponseWriter, rqs *http.Request) {
+	query := rqs.URL.Query()
+
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil {
+			http.Error(rsp, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := handler.urlService.AdminSearch(rqs.Context(), query.Get("q"), limit)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	handler.writeAdminURLs(rsp, records)
+}
+
+func (handler *URLHandler) ProcessAdminGetURL(rsp http.ResponseWriter, rqs *http.Request) {
+	record, err := handler.urlService.AdminGetURL(rqs.Context(), chi.URLParam(rqs, "URL"))
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, handler.newAdminURLItem(record))
+}
+
+func (handler *URLHandler) ProcessAdminDisableURL(rsp http.ResponseWriter, rqs *http.Request) {
+	handler.setDisabled(rsp, rqs, true)
+}
+
+func (handler *URLHandler) ProcessAdminEnableURL(rsp http.ResponseWriter, rqs *http.Request) {
+	handler.setDisabled(rsp, rqs, false)
+}
+
+func (handler *URLHandler) setDisabled(rsp http.ResponseWriter, rqs *http.Request, disabled bool) {
+	var request DisableRequest
+	if rqs.ContentLength != 0 && !readJSON(rsp, rqs, &request) {
+		return
+	}
+
+	shortURL := chi.URLParam(rqs, "URL")
+	log.Printf("New admin request to set disabled=%t for %s", disabled, shortURL)
+
+	record, err := handler.urlService.AdminSetDisabled(rqs.Context(), shortURL, disabled, request.Reason)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, handler.newAdminURLItem(record))
+}
+
+func (handler *URLHandler) ProcessAdminPutOwner(rsp http.ResponseWriter, rqs *http.Request) {
+	var request OwnerRequest
+	if !readJSON(rsp, rqs, &request) {
+		return
+	}
+
+	shortURL := chi.URLParam(rqs, "URL")
+	log.Printf("New admin request to transfer %s to %s", shortURL, request.UserID)
+
+	record, err := handler.urlService.AdminTransfer(rqs.Context(), shortURL, request.UserID)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, handler.newAdminURLItem(record))
+}
+
+func (handler *URLHandler) ProcessAdminGetUserURLs(rsp http.ResponseWriter, rqs *http.Request) {
+	records, err := handler.urlService.AdminGetUserURLs(rqs.Context(), chi.URLParam(rqs, "userID"))
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	handler.writeAdminURLs(rsp, records)
+}
+
+func (handler *URLHandler) ProcessAdminDisableUser(rsp http.ResponseWriter, rqs *http.Request) {
+	var request DisableRequest
+	if rqs.ContentLength != 0 && !readJSON(rsp, rqs, &request) {
+		return
+	}
+
+	userID := chi.URLParam(rqs, "userID")
+	log.Printf("New admin request to disable links of %s", userID)
+
+	count, err := handler.urlService.AdminDisableUser(rqs.Context(), userID, request.Reason)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, DisableUserInfo{Disabled: count})
+}
+
+func newQuotaInfo(status *service.QuotaStatus) QuotaInfo {
+	return QuotaInfo{
+		MaxActive: status.MaxActive,
+		MaxDaily:  status.MaxDaily,
+		Custom:    status.Custom,
+		Active:    status.Usage.Active,
+		Daily:     status.Usage.Created,
+	}
+}
+
+func (handler *URLHandler) ProcessAdminGetQuota(rsp http.ResponseWriter, rqs *http.Request) {
+	status, err := handler.urlService.AdminGetQuota(rqs.Context(), chi.URLParam(rqs, "userID"))
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, newQuotaInfo(status))
+}
+
+func (handler *URLHandler) ProcessAdminPutQuota(rsp http.ResponseWriter, rqs *http.Request) {
+	var request QuotaRequest
+	if !readJSON(rsp, rqs, &request) {
+		return
+	}
+
+	userID := chi.URLParam(rqs, "userID")
+	log.Printf("New admin request to set quota of %s", userID)
+
+	status, err := handler.urlService.AdminSetQuota(rqs.Context(), userID, request.MaxActive, request.MaxDaily)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, newQuotaInfo(status))
+}
+
+func (handler *URLHandler) ProcessAdminDeleteQuota(rsp http.ResponseWriter, rqs *http.Request) {
+	userID := chi.URLParam(rqs, "userID")
+	log.Printf("New admin request to reset quota of %s", userID)
+
+	if err := handler.urlService.AdminDeleteQuota(rqs.Context(), userID); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *URLHandler) ProcessAdminGetAudit(rsp http.ResponseWriter, rqs *http.Request) {
+	query := rqs.URL.Query()
+	filter := audit.Filter{UserID: query.Get("user"), ShortURL: query.Get("code")}
+
+	var err error
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			http.Error(rsp, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for name, bound := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(name); value != "" {
+			if *bound, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(rsp, fmt.Sprintf("%s must be an RFC 3339 time", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	events, err := handler.urlService.AdminQueryAudit(rqs.Context(), filter)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, events)
+}
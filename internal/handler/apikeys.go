@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (handler *URLHandler) ProcessPostAPIKey(rsp http.ResponseWriter, rqs *http.Request) {
+	if rqs.Header.Get("Content-Type") != "application/json" {
+		http.Error(rsp, "incorrect content type", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(rqs.Body)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request APIKeyRequest
+	if err = json.Unmarshal(buf.Bytes(), &request); err != nil {
+		http.Error(rsp, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	token, key, err := handler.urlService.CreateAPIKey(rqs.Context(), request.Name, request.Scopes)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	log.Printf("Created API key: %s", key.ID)
+
+	info := newAPIKeyInfo(key)
+	info.Key = token
+	out, err := json.Marshal(info)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(http.StatusCreated)
+	rsp.Write(out)
+}
+
+func (handler *URLHandler) ProcessGetAPIKeys(rsp http.ResponseWriter, rqs *http.Request) {
+	keys, err := handler.urlService.GetAPIKeys(rqs.Context())
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	infos := make([]APIKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		infos = append(infos, newAPIKeyInfo(&key))
+	}
+
+	out, err := json.Marshal(infos)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(out)
+}
+
+func (handler *URLHandler) ProcessDeleteAPIKey(rsp http.ResponseWriter, rqs *http.Request) {
+	id := chi.URLParam(rqs, "id")
+	log.Printf("New DELETE request for API key: %s", id)
+
+	if err := handler.urlService.RevokeAPIKey(rqs.Context(), id); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/oidc"
+)
+
+// loginCookie keeps the state, nonce and code verifier of a login in progress.
+const (
+	loginCookie   = "login"
+	loginLifetime = 10 * time.Minute
+)
+
+// SessionIssuer replaces the session cookie of a visitor.
+type SessionIssuer interface {
+	Issue(userID string, rsp http.ResponseWriter) error
+	Clear(rsp http.ResponseWriter)
+}
+
+// SetLogin enables /login, /callback and /logout.
+func (handler *URLHandler) SetLogin(provider *oidc.Provider, sessions SessionIssuer) {
+	handler.login = provider
+	handler.sessions = sessions
+}
+
+// ProcessLogin sends the visitor to the provider, the optional "next"
+// parameter is the local path to return to afterwards.
+func (handler *URLHandler) ProcessLogin(rsp http.ResponseWriter, rqs *http.Request) {
+	if handler.login == nil {
+		http.Error(rsp, "login is not configured", http.StatusNotFound)
+		return
+	}
+
+	state := url.Values{
+		"state":    {oidc.NewSecret()},
+		"nonce":    {oidc.NewSecret()},
+		"verifier": {oidc.NewSecret()},
+		"next":     {localPath(rqs.URL.Query().Get("next"))},
+	}
+
+	target, err := handler.login.AuthCodeURL(rqs.Context(), state.Get("state"), state.Get("nonce"), state.Get("verifier"))
+	if err != nil {
+		log.Printf("Login failed: %v", err)
+		http.Error(rsp, "identity provider is not available", http.StatusBadGateway)
+		return
+	}
+
+	// Lax lets the cookie come back with the redirect from the provider
+	http.SetCookie(rsp, &http.Cookie{
+		Name:     loginCookie,
+		Value:    state.Encode(),
+		Path:     handler.cfg.CookiePath,
+		MaxAge:   int(loginLifetime.Seconds()),
+		Secure:   handler.cfg.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(rsp, rqs, target, http.StatusFound)
+}
+
+// ProcessCallback completes the login and replaces the session with one of the account.
+func (handler *URLHandler) ProcessCallback(rsp http.ResponseWriter, rqs *http.Request) {
+	if handler.login == nil {
+		http.Error(rsp, "login is not configured", http.StatusNotFound)
+		return
+	}
+
+	cookie, err := rqs.Cookie(loginCookie)
+	if err != nil {
+		http.Error(rsp, "no login in progress", http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(rsp, &http.Cookie{Name: loginCookie, Path: handler.cfg.CookiePath, MaxAge: -1})
+
+	state, err := url.ParseQuery(cookie.Value)
+	if err != nil {
+		http.Error(rsp, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	query := rqs.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.Get("state"))) != 1 || state.Get("state") == "" {
+		http.Error(rsp, "login state mismatch", http.StatusBadRequest)
+		return
+	}
+
+	if reason := query.Get("error"); reason != "" {
+		log.Printf("Login refused by provider: %s %s", reason, query.Get("error_description"))
+		http.Error(rsp, "login refused: "+reason, http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := handler.login.Exchange(rqs.Context(), query.Get("code"), state.Get("verifier"), state.Get("nonce"))
+	if err != nil {
+		log.Printf("Login failed: %v", err)
+		http.Error(rsp, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := handler.urlService.Login(rqs.Context(), identity.Issuer, identity.Subject, identity.Email)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	if err := handler.sessions.Issue(userID, rsp); err != nil {
+		http.Error(rsp, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Logged in user %s", userID)
+	http.Redirect(rsp, rqs, localPath(state.Get("next")), http.StatusSeeOther)
+}
+
+// ProcessLogout drops the session, the links stay with the account.
+func (handler *URLHandler) ProcessLogout(rsp http.ResponseWriter, rqs *http.Request) {
+	if handler.sessions == nil {
+		http.Error(rsp, "login is not configured", http.StatusNotFound)
+		return
+	}
+
+	handler.sessions.Clear(rsp)
+	http.Redirect(rsp, rqs, localPath(rqs.URL.Query().Get("next")), http.StatusSeeOther)
+}
+
+// localPath keeps redirects after login on this host.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+
+	return path
+}
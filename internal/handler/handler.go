@@ -2,23 +2,36 @@ package handler
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
 	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/oidc"
+	"github.com/rvkarpov/url_shortener/internal/policy"
 	"github.com/rvkarpov/url_shortener/internal/service"
 	"github.com/rvkarpov/url_shortener/internal/storage"
 	"github.com/rvkarpov/url_shortener/internal/urlutils"
 )
 
+// linkPasswordHeader carries the password of a protected link for API clients.
+const linkPasswordHeader = "X-Link-Password"
+
 type URLHandler struct {
 	urlService *service.URLService
 	cfg        *config.Config
+
+	login    *oidc.Provider
+	sessions SessionIssuer
 }
 
 func NewURLHandler(urlService_ *service.URLService, cfg_ *config.Config) *URLHandler {
@@ -34,14 +47,14 @@ func (handler *URLHandler) ProcessPostURLString(rsp http.ResponseWriter, rqs *ht
 		return
 	}
 
-	shortURL, err := handler.urlService.ProcessLongURL(ctx, recvURL)
+	shortURL, err := handler.urlService.ProcessLongURL(ctx, recvURL, service.LinkOptions{})
 	if err != nil {
 		if errors.Is(err, &storage.DuplicateURLError{}) {
 			log.Printf("Duplicate URL found: %s", shortURL)
 			rsp.WriteHeader(http.StatusConflict)
 			rsp.Write([]byte(fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, shortURL)))
 		} else {
-			http.Error(rsp, err.Error(), http.StatusInternalServerError)
+			httpError(rsp, err)
 		}
 
 		return
@@ -77,15 +90,21 @@ func (handler *URLHandler) ProcessPostURLObject(rsp http.ResponseWriter, rqs *ht
 		return
 	}
 
+	opts, err := origin.options()
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	log.Printf("New POST request with URL: %s", origin.URL)
 
-	shortURL, err := handler.urlService.ProcessLongURL(ctx, origin.URL)
+	shortURL, err := handler.urlService.ProcessLongURL(ctx, origin.URL, opts)
 	if err != nil {
 		if errors.Is(err, &storage.DuplicateURLError{}) {
 			log.Printf("Duplicate URL found: %s", shortURL)
 			handler.publishURLObject(rsp, shortURL, http.StatusConflict)
 		} else {
-			http.Error(rsp, err.Error(), http.StatusInternalServerError)
+			httpError(rsp, err)
 		}
 
 		return
@@ -95,6 +114,42 @@ func (handler *URLHandler) ProcessPostURLObject(rsp http.ResponseWriter, rqs *ht
 	handler.publishURLObject(rsp, shortURL, http.StatusCreated)
 }
 
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, &policy.ViolationError{}):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, &service.InvalidRequestError{}):
+		return http.StatusBadRequest
+	case errors.Is(err, &storage.NotFoundError{}):
+		return http.StatusNotFound
+	case errors.Is(err, &service.ForbiddenError{}):
+		return http.StatusForbidden
+	case errors.Is(err, &service.UnauthorizedError{}):
+		return http.StatusUnauthorized
+	}
+
+	var quotaErr *service.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		if quotaErr.RetryAfter > 0 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusForbidden
+	}
+
+	return http.StatusInternalServerError
+}
+
+// httpError answers with the status of the error, a quota that frees up by
+// itself tells when to retry.
+func httpError(rsp http.ResponseWriter, err error) {
+	var quotaErr *service.QuotaExceededError
+	if errors.As(err, &quotaErr) && quotaErr.RetryAfter > 0 {
+		rsp.Header().Set("Retry-After", strconv.Itoa(int(quotaErr.RetryAfter.Seconds())+1))
+	}
+
+	http.Error(rsp, err.Error(), errorStatus(err))
+}
+
 func (handler *URLHandler) publishURLObject(rsp http.ResponseWriter, shortURL string, status int) {
 	short := ShortURLInfo{
 		Result: fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, shortURL),
@@ -138,7 +193,26 @@ func (handler *URLHandler) ProcessPostURLBatch(rsp http.ResponseWriter, rqs *htt
 		return
 	}
 
-	err = handler.urlService.BeginBatchProcessing(ctx)
+	batchOpts := make([]service.LinkOptions, len(inputBatch))
+	longURLs := make([]string, len(inputBatch))
+	for i, item := range inputBatch {
+		if batchOpts[i], err = item.options(); err != nil {
+			http.Error(rsp, fmt.Sprintf("%s: %v", item.ID, err), http.StatusBadRequest)
+			return
+		}
+
+		if longURLs[i], err = handler.urlService.PrepareLongURL(ctx, item.URL, batchOpts[i]); err != nil {
+			http.Error(rsp, fmt.Sprintf("%s: %v", item.ID, err), errorStatus(err))
+			return
+		}
+	}
+
+	if err := handler.urlService.CheckBatchQuota(ctx, longURLs, batchOpts); err != nil {
+		httpError(rsp, err)
+		return
+	}
+
+	ctx, err = handler.urlService.BeginBatchProcessing(ctx)
 	if err != nil {
 		http.Error(rsp, err.Error(), http.StatusInternalServerError)
 		return
@@ -146,9 +220,9 @@ func (handler *URLHandler) ProcessPostURLBatch(rsp http.ResponseWriter, rqs *htt
 
 	outputBatch := make([]ShortURLBatchItem, 0, len(inputBatch))
 
-	for _, item := range inputBatch {
+	for i, item := range inputBatch {
 		log.Printf("New POST request with URL: %s", item.URL)
-		shortURL, err := handler.urlService.ProcessLongURL(ctx, item.URL)
+		shortURL, err := handler.urlService.ProcessLongURL(ctx, item.URL, batchOpts[i])
 		if err != nil {
 			if errors.Is(err, &storage.DuplicateURLError{}) {
 				log.Printf("Duplicate URL found: %s", shortURL)
@@ -167,7 +241,7 @@ func (handler *URLHandler) ProcessPostURLBatch(rsp http.ResponseWriter, rqs *htt
 				rsp.WriteHeader(http.StatusConflict)
 				rsp.Write(out)
 			} else {
-				http.Error(rsp, err.Error(), http.StatusInternalServerError)
+				httpError(rsp, err)
 			}
 
 			return
@@ -202,36 +276,349 @@ func (handler *URLHandler) ProcessGet(rsp http.ResponseWriter, rqs *http.Request
 	recvURL := chi.URLParam(rqs, "URL")
 	if len(recvURL) == 0 {
 		http.Error(rsp, "a non-empty path is expected", http.StatusBadRequest)
+		return
+	}
+
+	// "/{URL}+" and "/{URL}?preview=1" show the link details instead of redirecting
+	preview := strings.HasSuffix(recvURL, "+")
+	if preview {
+		recvURL = strings.TrimSuffix(recvURL, "+")
+	} else {
+		preview, _ = strconv.ParseBool(rqs.URL.Query().Get("preview"))
 	}
 
 	log.Printf("New GET request with short URL: %s", recvURL)
 
-	longURL, deleted, err := handler.urlService.ProcessShortURL(rqs.Context(), recvURL)
+	record, err := handler.urlService.ProcessShortURL(rqs.Context(), recvURL)
 	if err != nil {
 		http.Error(rsp, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if deleted {
+	now := time.Now()
+	if record.Deleted || record.Disabled || record.Exhausted() || record.Expired(now) {
+		rsp.WriteHeader(http.StatusGone)
+		return
+	}
+
+	if record.Pending(now) {
+		handler.comingSoon(rsp, record)
+		return
+	}
+
+	if record.PasswordHash != "" && !handler.unlock(rsp, rqs, record) {
+		return
+	}
+
+	if record.Blocked {
+		handler.blocked(rsp, record, record.LongURL)
+		return
+	}
+
+	if preview {
+		renderPage(rsp, http.StatusOK, "preview.html", previewPage{
+			ShortURL:  fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, record.ShortURL),
+			LongURL:   record.LongURL,
+			Title:     record.Title,
+			ImageURL:  record.ImageURL,
+			CreatedAt: record.CreatedAt,
+		})
+		return
+	}
+
+	extraPath := chi.URLParam(rqs, "*")
+	if extraPath != "" && !record.Passthrough {
+		http.NotFound(rsp, rqs)
+		return
+	}
+
+	target, variant := handler.urlService.SelectTarget(record, service.Visit{
+		UserAgent:      rqs.Header.Get("User-Agent"),
+		AcceptLanguage: rqs.Header.Get("Accept-Language"),
+		ClientIP:       urlutils.ClientIP(rqs, handler.cfg.TrustedProxies),
+		StickyVariant:  stickyVariant(rqs, record),
+	})
+	if target != record.LongURL && handler.urlService.IsBlocked(target) {
+		handler.blocked(rsp, record, target)
+		return
+	}
+
+	servedVariant := ""
+	if variant >= 0 {
+		servedVariant = target
+	}
+
+	if record.Passthrough {
+		conflict := record.PassthroughConflict
+		if conflict == "" {
+			conflict = handler.cfg.PassthroughConflict
+		}
+
+		target, err = urlutils.MergeURL(target, extraPath, rqs.URL.Query(), conflict != "target")
+		if err != nil {
+			http.Error(rsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	consumed, err := handler.urlService.ConsumeClick(rqs.Context(), record)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !consumed {
 		rsp.WriteHeader(http.StatusGone)
+		return
 	}
 
-	log.Printf("Found original URL: %s", longURL)
-	rsp.Header().Set("Location", longURL)
-	rsp.WriteHeader(http.StatusTemporaryRedirect)
+	if variant >= 0 && record.StickyVariants {
+		setStickyVariant(rsp, record, variant)
+	}
+
+	handler.urlService.RecordClick(rqs.Context(), record.ShortURL, servedVariant)
+
+	log.Printf("Found original URL: %s", target)
+	handler.redirect(rsp, rqs, record, target)
 }
 
-func (handler *URLHandler) ProcessGetSummary(rsp http.ResponseWriter, rqs *http.Request) {
-	summary := handler.urlService.GetSummary(rqs.Context())
+// blocked shows the warning page instead of redirecting to a blocklisted target.
+func (handler *URLHandler) blocked(rsp http.ResponseWriter, record *storage.URLRecord, target string) {
+	log.Printf("Blocked target URL: %s", target)
+
+	page := *record
+	page.LongURL = target
+	renderPage(rsp, http.StatusForbidden, "blocked.html", &page)
+}
+
+// comingSoon answers a visit before the activation window with the link
+// fallback URL, the configured one or a page telling when the link opens.
+func (handler *URLHandler) comingSoon(rsp http.ResponseWriter, record *storage.URLRecord) {
+	if record.FallbackURL != "" && handler.urlService.IsBlocked(record.FallbackURL) {
+		handler.blocked(rsp, record, record.FallbackURL)
+		return
+	}
+
+	fallbackURL := record.FallbackURL
+	if fallbackURL == "" {
+		fallbackURL = handler.cfg.ComingSoonURL
+	}
+
+	if fallbackURL != "" {
+		rsp.Header().Set("Cache-Control", "private, no-cache")
+		rsp.Header().Set("Location", fallbackURL)
+		rsp.WriteHeader(http.StatusFound)
+		return
+	}
+
+	renderPage(rsp, http.StatusNotFound, "coming_soon.html", comingSoonPage{
+		ShortURL:  fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, record.ShortURL),
+		Title:     record.Title,
+		NotBefore: record.NotBefore,
+	})
+}
 
-	if summary == "" {
+// unlock checks the password of a protected link sent in the link password
+// header or posted from the password form, and answers the request if it is
+// missing or wrong.
+func (handler *URLHandler) unlock(rsp http.ResponseWriter, rqs *http.Request, record *storage.URLRecord) bool {
+	password := rqs.Header.Get(linkPasswordHeader)
+	if rqs.Method == http.MethodPost {
+		password = rqs.PostFormValue("password")
+	} else if password == "" {
+		handler.promptPassword(rsp, rqs, record, http.StatusUnauthorized, "password required")
+		return false
+	}
+
+	err := handler.urlService.CheckPassword(record, password)
+	if err == nil {
+		return true
+	}
+
+	status := http.StatusUnauthorized
+	var tooMany *service.TooManyAttemptsError
+	if errors.As(err, &tooMany) {
+		status = http.StatusTooManyRequests
+		rsp.Header().Set("Retry-After", strconv.Itoa(int(tooMany.RetryAfter.Seconds())+1))
+	}
+
+	log.Printf("Password check of short URL %s failed: %v", record.ShortURL, err)
+	handler.promptPassword(rsp, rqs, record, status, err.Error())
+	return false
+}
+
+// promptPassword shows the password form to browsers and a plain error to API clients.
+func (handler *URLHandler) promptPassword(rsp http.ResponseWriter, rqs *http.Request, record *storage.URLRecord, status int, reason string) {
+	if !strings.Contains(rqs.Header.Get("Accept"), "text/html") {
+		http.Error(rsp, reason, status)
+		return
+	}
+
+	page := passwordPage{ShortURL: fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, record.ShortURL)}
+	if rqs.Method == http.MethodPost || status != http.StatusUnauthorized {
+		page.Error = reason
+	}
+
+	renderPage(rsp, status, "password.html", page)
+}
+
+func (handler *URLHandler) redirect(rsp http.ResponseWriter, rqs *http.Request, record *storage.URLRecord, target string) {
+	status := record.RedirectCode
+	if status == 0 {
+		status = handler.cfg.DefaultRedirectCode
+	}
+	if status == 0 {
+		status = http.StatusTemporaryRedirect
+	}
+
+	// the password form is posted, 307 and 308 would repeat the POST on the target
+	if rqs.Method == http.MethodPost {
+		status = http.StatusSeeOther
+	}
+
+	// browsers cache permanent redirects, keep them from living forever and
+	// from skipping the checks of links decided per visit
+	permanent := status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect
+	if record.Dynamic() {
+		rsp.Header().Set("Cache-Control", "private, no-store")
+	} else if permanent {
+		maxAge := int(handler.cfg.RedirectCacheMaxAge.Seconds())
+		rsp.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	} else {
+		rsp.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	rsp.Header().Set("Location", target)
+	rsp.WriteHeader(status)
+}
+
+func (handler *URLHandler) ProcessGetQR(rsp http.ResponseWriter, rqs *http.Request) {
+	recvURL := chi.URLParam(rqs, "URL")
+	query := rqs.URL.Query()
+
+	size := 256
+	if value := query.Get("size"); value != "" {
+		var err error
+		size, err = strconv.Atoi(value)
+		if err != nil || size < 64 || size > 2048 {
+			http.Error(rsp, "size must be an integer between 64 and 2048", http.StatusBadRequest)
+			return
+		}
+	}
+
+	level := strings.ToUpper(query.Get("level"))
+	if level == "" {
+		level = "M"
+	}
+
+	if len(level) != 1 || !strings.Contains("LMQH", level) {
+		http.Error(rsp, "level must be one of L, M, Q, H", http.StatusBadRequest)
+		return
+	}
+
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = "png"
+	}
+
+	contentType, ok := map[string]string{"png": "image/png", "svg": "image/svg+xml"}[format]
+	if !ok {
+		http.Error(rsp, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+
+	record, err := handler.urlService.ProcessShortURL(rqs.Context(), recvURL)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if record.Deleted || record.Disabled || record.Exhausted() || record.Expired(now) {
+		rsp.WriteHeader(http.StatusGone)
+		return
+	}
+
+	shortURL := fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, record.ShortURL)
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s|%s", shortURL, size, level, format)))
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:16]))
+
+	rsp.Header().Set("ETag", etag)
+	rsp.Header().Set("Cache-Control", "public, max-age=86400")
+	if rqs.Header.Get("If-None-Match") == etag {
+		rsp.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	image, err := urlutils.GenerateQRCode(shortURL, size, level, format)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rsp.Header().Set("Content-Type", contentType)
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(image)
+}
+
+func (handler *URLHandler) ProcessGetSummary(rsp http.ResponseWriter, rqs *http.Request) {
+	records, err := handler.urlService.GetSummary(rqs.Context(), rqs.URL.Query().Get("tag"))
+	if err != nil || len(records) == 0 {
 		rsp.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	summary := make([]URLSummaryItem, 0, len(records))
+	for _, record := range records {
+		summary = append(summary, handler.newURLSummaryItem(&record))
+	}
+
+	out, err := json.Marshal(summary)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	rsp.Header().Add("Content-Type", "application/json")
 	rsp.WriteHeader(http.StatusOK)
-	rsp.Write([]byte(summary))
+	rsp.Write(out)
+}
+
+func (handler *URLHandler) newURLSummaryItem(record *storage.URLRecord) URLSummaryItem {
+	item := URLSummaryItem{
+		ShortURL: fmt.Sprintf("%s/%s", handler.cfg.PublishAddr, record.ShortURL),
+		LongURL:  record.LongURL,
+		Title:    record.Title,
+		ImageURL: record.ImageURL,
+		Note:     record.Note,
+		Tags:     record.Tags,
+		Team:     record.TeamID,
+
+		UTMTemplate: record.UTMTemplate,
+		MaxClicks:   record.MaxClicks,
+		ClickCount:  record.ClickCount,
+
+		Disabled:       record.Disabled,
+		DisabledReason: record.DisabledReason,
+	}
+
+	if !record.NotBefore.IsZero() {
+		notBefore := record.NotBefore
+		item.NotBefore = &notBefore
+	}
+
+	if !record.NotAfter.IsZero() {
+		notAfter := record.NotAfter
+		item.NotAfter = &notAfter
+	}
+
+	if !record.LastChecked.IsZero() {
+		lastChecked := record.LastChecked
+		item.LastStatus = record.LastStatus
+		item.LastChecked = &lastChecked
+		item.Broken = record.Broken()
+	}
+
+	return item
 }
 
 func (handler *URLHandler) ProcessDeleteUrls(rsp http.ResponseWriter, rqs *http.Request) {
@@ -264,6 +651,16 @@ func (handler *URLHandler) ProcessDeleteUrls(rsp http.ResponseWriter, rqs *http.
 	rsp.WriteHeader(http.StatusAccepted)
 }
 
+func (handler *URLHandler) ProcessGetInternalStats(rsp http.ResponseWriter, rqs *http.Request) {
+	stats, err := handler.urlService.GetStats(rqs.Context())
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, InternalStatsInfo{URLs: stats.URLs, Users: stats.Users})
+}
+
 func (handler *URLHandler) ProcessPing(db storage.DBState) http.HandlerFunc {
 	return func(rsp http.ResponseWriter, rqs *http.Request) {
 		if db.DB == nil {
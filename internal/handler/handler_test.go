@@ -2,18 +2,38 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/blocklist"
+	"github.com/rvkarpov/url_shortener/internal/metafetch"
+	"github.com/rvkarpov/url_shortener/internal/middleware"
 	"github.com/rvkarpov/url_shortener/internal/mocks"
+	"github.com/rvkarpov/url_shortener/internal/oidc"
+	"github.com/rvkarpov/url_shortener/internal/policy"
+	"github.com/rvkarpov/url_shortener/internal/rules"
 	"github.com/rvkarpov/url_shortener/internal/service"
+	"github.com/rvkarpov/url_shortener/internal/storage"
 	"github.com/rvkarpov/url_shortener/internal/testutils"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGetHandler(t *testing.T) {
@@ -91,6 +111,1018 @@ func TestGetHandler(t *testing.T) {
 	}
 }
 
+func TestGetBlockedHandler(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	storage := mocks.NewStorageMock()
+	storage.AddTestData("oeapEa", "https://www.foo.com")
+	storage.SetBlocked(context.Background(), []string{"oeapEa"}, true)
+
+	urlService := service.NewURLService(storage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Get("/{URL}", handler.ProcessGet)
+
+	rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, rqs)
+
+	res := rsp.Result()
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, "", res.Header.Get("Location"))
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	resBody, _ := io.ReadAll(res.Body)
+	assert.Contains(t, string(resBody), "https://www.foo.com")
+}
+
+func TestGetPreviewHandler(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	storage := mocks.NewStorageMock()
+	storage.AddTestData("oeapEa", "https://www.foo.com")
+
+	urlService := service.NewURLService(storage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Get("/{URL}", handler.ProcessGet)
+
+	for _, path := range []string{"/oeapEa+", "/oeapEa?preview=1"} {
+		t.Run(path, func(t *testing.T) {
+			rqs := httptest.NewRequest(http.MethodGet, path, nil)
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			res := rsp.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, "", res.Header.Get("Location"))
+			resBody, _ := io.ReadAll(res.Body)
+			assert.Contains(t, string(resBody), `href="https://www.foo.com"`)
+			assert.Contains(t, string(resBody), "http://localhost:8080/oeapEa")
+		})
+	}
+}
+
+func TestGetQRHandler(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	storage := mocks.NewStorageMock()
+	storage.AddTestData("oeapEa", "https://www.foo.com")
+
+	urlService := service.NewURLService(storage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Get("/{URL}/qr", handler.ProcessGetQR)
+
+	type want struct {
+		code        int
+		contentType string
+		prefix      string
+	}
+	tests := []struct {
+		name string
+		rqs  string
+		want want
+	}{
+		{
+			name: "default png",
+			rqs:  "/oeapEa/qr",
+			want: want{code: 200, contentType: "image/png", prefix: "\x89PNG"},
+		},
+		{
+			name: "svg",
+			rqs:  "/oeapEa/qr?format=svg&size=128&level=H",
+			want: want{code: 200, contentType: "image/svg+xml", prefix: "<svg"},
+		},
+		{
+			name: "bad size",
+			rqs:  "/oeapEa/qr?size=big",
+			want: want{code: 400, contentType: "text/plain; charset=utf-8", prefix: "size must be"},
+		},
+		{
+			name: "bad level",
+			rqs:  "/oeapEa/qr?level=X",
+			want: want{code: 400, contentType: "text/plain; charset=utf-8", prefix: "level must be"},
+		},
+		{
+			name: "not existed short URL",
+			rqs:  "/3Zgnmj/qr",
+			want: want{code: 400, contentType: "text/plain; charset=utf-8", prefix: "URL not found"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rqs := httptest.NewRequest(http.MethodGet, test.rqs, nil)
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			res := rsp.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, test.want.code, res.StatusCode)
+			assert.Equal(t, test.want.contentType, res.Header.Get("Content-Type"))
+			resBody, _ := io.ReadAll(res.Body)
+			assert.True(t, strings.HasPrefix(string(resBody), test.want.prefix))
+		})
+	}
+
+	t.Run("etag", func(t *testing.T) {
+		rqs := httptest.NewRequest(http.MethodGet, "/oeapEa/qr", nil)
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, rqs)
+
+		etag := rsp.Result().Header.Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		rqs = httptest.NewRequest(http.MethodGet, "/oeapEa/qr", nil)
+		rqs.Header.Set("If-None-Match", etag)
+		rsp = httptest.NewRecorder()
+		router.ServeHTTP(rsp, rqs)
+
+		assert.Equal(t, http.StatusNotModified, rsp.Result().StatusCode)
+		assert.Equal(t, 0, rsp.Body.Len())
+	})
+}
+
+func TestRedirectCode(t *testing.T) {
+	type want struct {
+		code         int
+		cacheControl string
+	}
+	tests := []struct {
+		name        string
+		defaultCode int
+		rqsData     string
+		want        want
+	}{
+		{
+			name:        "global default",
+			defaultCode: 302,
+			rqsData:     `{"url":"https://www.foo.com"}`,
+			want:        want{code: 302, cacheControl: "private, no-cache"},
+		},
+		{
+			name:        "per link permanent",
+			defaultCode: 307,
+			rqsData:     `{"url":"https://www.foo.com", "redirect_code": 308}`,
+			want:        want{code: 308, cacheControl: "public, max-age=86400"},
+		},
+		{
+			name:        "unsupported code",
+			defaultCode: 307,
+			rqsData:     `{"url":"https://www.foo.com", "redirect_code": 200}`,
+			want:        want{code: 400},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testutils.LoadTestConfig()
+			cfg.DefaultRedirectCode = test.defaultCode
+
+			urlService := service.NewURLService(mocks.NewStorageMock(), &cfg)
+			handler := NewURLHandler(urlService, &cfg)
+
+			router := chi.NewRouter()
+			router.Post("/api/shorten", handler.ProcessPostURLObject)
+			router.Get("/{URL}", handler.ProcessGet)
+
+			rqs := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewBufferString(test.rqsData))
+			rqs.Header.Set("Content-Type", "application/json")
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			if test.want.code == 400 {
+				assert.Equal(t, http.StatusBadRequest, rsp.Code)
+				return
+			}
+			assert.Equal(t, http.StatusCreated, rsp.Code)
+
+			var info ShortURLInfo
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &info))
+
+			rqs = httptest.NewRequest(http.MethodGet, strings.TrimPrefix(info.Result, "http://localhost:8080"), nil)
+			rsp = httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			assert.Equal(t, test.want.code, rsp.Code)
+			assert.Equal(t, "https://www.foo.com", rsp.Header().Get("Location"))
+			assert.Equal(t, test.want.cacheControl, rsp.Header().Get("Cache-Control"))
+		})
+	}
+}
+
+func TestPermanentRedirectCaching(t *testing.T) {
+	now := time.Now()
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		record       storage.URLRecord
+		header       string
+		cacheControl string
+	}{
+		{
+			name:         "plain",
+			cacheControl: "public, max-age=86400",
+		},
+		{
+			name:         "password",
+			record:       storage.URLRecord{PasswordHash: string(passwordHash)},
+			header:       "secret",
+			cacheControl: "private, no-store",
+		},
+		{
+			name:         "click limit",
+			record:       storage.URLRecord{MaxClicks: 5},
+			cacheControl: "private, no-store",
+		},
+		{
+			name:         "activation window",
+			record:       storage.URLRecord{NotAfter: now.Add(time.Hour)},
+			cacheControl: "private, no-store",
+		},
+		{
+			name:         "rules",
+			record:       storage.URLRecord{Rules: []rules.Rule{{Device: rules.DeviceMobile, Target: "https://m.foo.com"}}},
+			cacheControl: "private, no-store",
+		},
+		{
+			name:         "variants",
+			record:       storage.URLRecord{Variants: []storage.Variant{{URL: "https://www.foo.com", Weight: 1}}},
+			cacheControl: "private, no-store",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testutils.LoadTestConfig()
+
+			record := test.record
+			record.ShortURL = "oeapEa"
+			record.LongURL = "https://www.foo.com"
+			record.RedirectCode = http.StatusPermanentRedirect
+			urlStorage := mocks.NewStorageMock()
+			urlStorage.StoreURL(context.Background(), record)
+
+			handler := NewURLHandler(service.NewURLService(urlStorage, &cfg), &cfg)
+			router := chi.NewRouter()
+			router.Get("/{URL}", handler.ProcessGet)
+
+			rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+			if test.header != "" {
+				rqs.Header.Set("X-Link-Password", test.header)
+			}
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			assert.Equal(t, http.StatusPermanentRedirect, rsp.Code)
+			assert.Equal(t, test.cacheControl, rsp.Header().Get("Cache-Control"))
+		})
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	tests := []struct {
+		name     string
+		rqsData  string
+		rqs      string
+		code     int
+		location string
+	}{
+		{
+			name:     "incoming wins by default",
+			rqsData:  `{"url":"https://www.foo.com/landing?ref=site", "passthrough": true}`,
+			rqs:      "/v3_WMnKl/extra/path?ref=newsletter&lang=en",
+			code:     307,
+			location: "https://www.foo.com/landing/extra/path?lang=en&ref=newsletter",
+		},
+		{
+			name:     "target wins",
+			rqsData:  `{"url":"https://www.foo.com/landing?ref=site", "passthrough": true, "passthrough_conflict": "target"}`,
+			rqs:      "/v3_WMnKl?ref=newsletter&lang=en",
+			code:     307,
+			location: "https://www.foo.com/landing?lang=en&ref=site",
+		},
+		{
+			name:     "disabled",
+			rqsData:  `{"url":"https://www.foo.com/landing?ref=site"}`,
+			rqs:      "/v3_WMnKl/extra/path",
+			code:     404,
+			location: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testutils.LoadTestConfig()
+			urlService := service.NewURLService(mocks.NewStorageMock(), &cfg)
+			handler := NewURLHandler(urlService, &cfg)
+
+			router := chi.NewRouter()
+			router.Post("/api/shorten", handler.ProcessPostURLObject)
+			router.Get("/{URL}", handler.ProcessGet)
+			router.Get("/{URL}/*", handler.ProcessGet)
+
+			rqs := httptest.NewRequest(http.MethodPost, "/api/shorten", bytes.NewBufferString(test.rqsData))
+			rqs.Header.Set("Content-Type", "application/json")
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+			assert.Equal(t, http.StatusCreated, rsp.Code)
+
+			// passthrough links get a code of their own
+			var info ShortURLInfo
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &info))
+			shortURL := strings.TrimPrefix(info.Result, "http://localhost:8080")
+
+			rqs = httptest.NewRequest(http.MethodGet, strings.Replace(test.rqs, "/v3_WMnKl", shortURL, 1), nil)
+			rsp = httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			assert.Equal(t, test.code, rsp.Code)
+			assert.Equal(t, test.location, rsp.Header().Get("Location"))
+		})
+	}
+}
+
+func withUser(rqs *http.Request, userID string) *http.Request {
+	ctx := context.WithValue(rqs.Context(), storage.UserIDKey{Name: "userID"}, userID)
+	return rqs.WithContext(ctx)
+}
+
+func TestUTMTemplates(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Put("/api/user/utm/{name}", handler.ProcessPutUTMTemplate)
+	router.Get("/api/user/utm", handler.ProcessGetUTMTemplates)
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		rqsData string
+		code    int
+		rsp     string
+	}{
+		{
+			name:    "store template",
+			method:  http.MethodPut,
+			path:    "/api/user/utm/spring",
+			rqsData: `{"utm_source":"newsletter","utm_campaign":"spring"}`,
+			code:    200,
+			rsp:     `{"name":"spring","params":{"utm_campaign":"spring","utm_source":"newsletter"}}`,
+		},
+		{
+			name:    "not utm parameter",
+			method:  http.MethodPut,
+			path:    "/api/user/utm/bad",
+			rqsData: `{"ref":"newsletter"}`,
+			code:    400,
+			rsp:     "invalid request: parameter 'ref' is not a utm_* parameter\n",
+		},
+		{
+			name:   "list templates",
+			method: http.MethodGet,
+			path:   "/api/user/utm",
+			code:   200,
+			rsp:    `[{"name":"spring","params":{"utm_campaign":"spring","utm_source":"newsletter"}}]`,
+		},
+		{
+			name:    "shorten with template",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			rqsData: `{"url":"https://www.foo.com/?utm_source=site", "utm_template":"spring"}`,
+			code:    201,
+			rsp:     `{"result":"http://localhost:8080/fsvmd_1N"}`,
+		},
+		{
+			name:    "unknown template",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			rqsData: `{"url":"https://www.foo.com", "utm_template":"autumn"}`,
+			code:    400,
+			rsp:     "invalid request: UTM template 'autumn' not found\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rqs := httptest.NewRequest(test.method, test.path, bytes.NewBufferString(test.rqsData))
+			rqs.Header.Set("Content-Type", "application/json")
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, withUser(rqs, "user1"))
+
+			assert.Equal(t, test.code, rsp.Code)
+			assert.Equal(t, test.rsp, rsp.Body.String())
+		})
+	}
+
+	record, err := urlStorage.TryGetURL(context.Background(), "fsvmd_1N")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://www.foo.com/?utm_campaign=spring&utm_source=newsletter", record.LongURL)
+	assert.Equal(t, "spring", record.UTMTemplate)
+}
+
+func TestRedirectRules(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlStorage.StoreURL(context.Background(), storage.URLRecord{ShortURL: "oeapEa", LongURL: "https://www.foo.com", UserID: "owner"})
+
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Put("/api/user/urls/{URL}/rules", handler.ProcessPutRules)
+	router.Get("/api/user/urls/{URL}/rules", handler.ProcessGetRules)
+	router.Get("/{URL}", handler.ProcessGet)
+
+	rulesData := `[{"device":"ios","target":"https://apps.apple.com/app/foo"},
+		{"device":"android","target":"https://play.google.com/store/apps/details?id=foo"}]`
+
+	putRules := func(userID, data string) int {
+		rqs := httptest.NewRequest(http.MethodPut, "/api/user/urls/oeapEa/rules", bytes.NewBufferString(data))
+		rqs.Header.Set("Content-Type", "application/json")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, putRules("stranger", rulesData))
+	assert.Equal(t, http.StatusBadRequest, putRules("owner", `[{"target":"https://foo.com"}]`))
+	assert.Equal(t, http.StatusNoContent, putRules("owner", rulesData))
+
+	rqs := httptest.NewRequest(http.MethodGet, "/api/user/urls/oeapEa/rules", nil)
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, withUser(rqs, "owner"))
+	assert.Equal(t, http.StatusOK, rsp.Code)
+	assert.Contains(t, rsp.Body.String(), "https://apps.apple.com/app/foo")
+
+	tests := []struct {
+		name      string
+		userAgent string
+		location  string
+	}{
+		{name: "ios", userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)", location: "https://apps.apple.com/app/foo"},
+		{name: "android", userAgent: "Mozilla/5.0 (Linux; Android 14)", location: "https://play.google.com/store/apps/details?id=foo"},
+		{name: "fallback", userAgent: "Mozilla/5.0 (X11; Linux x86_64)", location: "https://www.foo.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+			rqs.Header.Set("User-Agent", test.userAgent)
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			assert.Equal(t, http.StatusTemporaryRedirect, rsp.Code)
+			assert.Equal(t, test.location, rsp.Header().Get("Location"))
+		})
+	}
+}
+
+func TestBlockedRuleTarget(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlStorage.StoreURL(context.Background(), storage.URLRecord{ShortURL: "oeapEa", LongURL: "https://www.foo.com", UserID: "owner"})
+
+	blocklistFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("domain evil.com\n"), 0644))
+	urlBlocklist, err := blocklist.NewBlocklist(blocklistFile)
+	require.NoError(t, err)
+
+	urlService := service.NewURLService(urlStorage, &cfg)
+	urlService.SetBlocklist(urlBlocklist)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Put("/api/user/urls/{URL}/rules", handler.ProcessPutRules)
+	router.Get("/{URL}", handler.ProcessGet)
+
+	rqs := httptest.NewRequest(http.MethodPut, "/api/user/urls/oeapEa/rules",
+		strings.NewReader(`[{"device":"ios","target":"https://apps.foo-mirror.com/app"}]`))
+	rqs.Header.Set("Content-Type", "application/json")
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, withUser(rqs, "owner"))
+	require.Equal(t, http.StatusNoContent, rsp.Code)
+
+	// the target is reported after the rule was set
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("domain evil.com\ndomain foo-mirror.com\n"), 0644))
+	reloaded, err := blocklist.NewBlocklist(blocklistFile)
+	require.NoError(t, err)
+	urlService.SetBlocklist(reloaded)
+
+	visit := func(userAgent string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+		rqs.Header.Set("User-Agent", userAgent)
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, rqs)
+		return rsp
+	}
+
+	rsp = visit("Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)")
+	assert.Equal(t, http.StatusForbidden, rsp.Code)
+	assert.Empty(t, rsp.Header().Get("Location"))
+	assert.Contains(t, rsp.Body.String(), "https://apps.foo-mirror.com/app")
+
+	// visitors no rule matches still reach the long URL
+	rsp = visit("Mozilla/5.0 (X11; Linux x86_64)")
+	assert.Equal(t, http.StatusTemporaryRedirect, rsp.Code)
+	assert.Equal(t, "https://www.foo.com", rsp.Header().Get("Location"))
+}
+
+func TestRulesAndVariantsOnSharedCode(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	urlStorage, err := storage.NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer urlStorage.Finalize()
+
+	handler := NewURLHandler(service.NewURLService(urlStorage, &cfg), &cfg)
+
+	router := chi.NewRouter()
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+	router.Put("/api/user/urls/{URL}/rules", handler.ProcessPutRules)
+	router.Put("/api/user/urls/{URL}/variants", handler.ProcessPutVariants)
+	router.Get("/{URL}", handler.ProcessGet)
+
+	call := func(userID, method, target, body string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(method, target, strings.NewReader(body))
+		rqs.Header.Set("Content-Type", "application/json")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp
+	}
+
+	shortURL := func(rsp *httptest.ResponseRecorder) string {
+		var info ShortURLInfo
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &info))
+		return strings.TrimPrefix(info.Result, "http://localhost:8080/")
+	}
+
+	rsp := call("alice", http.MethodPost, "/api/shorten", `{"url":"https://www.foo.com/page"}`)
+	require.Equal(t, http.StatusCreated, rsp.Code)
+	shared := shortURL(rsp)
+
+	// bob publishes the same code
+	rsp = call("bob", http.MethodPost, "/api/shorten", `{"url":"https://www.foo.com/page"}`)
+	require.Equal(t, http.StatusConflict, rsp.Code)
+	require.Equal(t, shared, shortURL(rsp))
+
+	rulesData := `[{"device":"ios","target":"https://evil.example.com"}]`
+	rsp = call("alice", http.MethodPut, "/api/user/urls/"+shared+"/rules", rulesData)
+	assert.Equal(t, http.StatusBadRequest, rsp.Code)
+	assert.Contains(t, rsp.Body.String(), "own_code")
+
+	variantsData := `{"variants":[{"url":"https://evil.example.com","weight":1}]}`
+	rsp = call("alice", http.MethodPut, "/api/user/urls/"+shared+"/variants", variantsData)
+	assert.Equal(t, http.StatusBadRequest, rsp.Code)
+	assert.Contains(t, rsp.Body.String(), "own_code")
+
+	rqs := httptest.NewRequest(http.MethodGet, "/"+shared, nil)
+	rqs.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)")
+	rsp = httptest.NewRecorder()
+	router.ServeHTTP(rsp, rqs)
+	assert.Equal(t, "https://www.foo.com/page", rsp.Header().Get("Location"))
+
+	// a link of its own takes rules and variants
+	rsp = call("alice", http.MethodPost, "/api/shorten", `{"url":"https://www.foo.com/page","own_code":true}`)
+	require.Equal(t, http.StatusCreated, rsp.Code)
+	own := shortURL(rsp)
+	assert.NotEqual(t, shared, own)
+	assert.Equal(t, http.StatusNoContent, call("alice", http.MethodPut, "/api/user/urls/"+own+"/rules", rulesData).Code)
+	assert.Equal(t, http.StatusNoContent, call("alice", http.MethodPut, "/api/user/urls/"+own+"/variants", variantsData).Code)
+}
+
+func TestSplitRedirects(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlStorage.StoreURL(context.Background(), storage.URLRecord{ShortURL: "oeapEa", LongURL: "https://www.foo.com", UserID: "owner"})
+
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Put("/api/user/urls/{URL}/variants", handler.ProcessPutVariants)
+	router.Get("/api/user/urls/{URL}/stats", handler.ProcessGetStats)
+	router.Get("/{URL}", handler.ProcessGet)
+
+	putVariants := func(userID, data string) int {
+		rqs := httptest.NewRequest(http.MethodPut, "/api/user/urls/oeapEa/variants", bytes.NewBufferString(data))
+		rqs.Header.Set("Content-Type", "application/json")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp.Code
+	}
+
+	variantsData := `{"variants":[{"url":"https://www.foo.com/a","weight":1},{"url":"https://www.foo.com/b","weight":3}],"sticky":true}`
+	assert.Equal(t, http.StatusForbidden, putVariants("stranger", variantsData))
+	assert.Equal(t, http.StatusBadRequest, putVariants("owner", `{"variants":[{"url":"https://www.foo.com/a","weight":0}]}`))
+	assert.Equal(t, http.StatusNoContent, putVariants("owner", variantsData))
+
+	rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, rqs)
+	assert.Equal(t, http.StatusTemporaryRedirect, rsp.Code)
+	assert.Contains(t, []string{"https://www.foo.com/a", "https://www.foo.com/b"}, rsp.Header().Get("Location"))
+
+	cookies := rsp.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	location := rsp.Header().Get("Location")
+
+	for i := 0; i < 10; i++ {
+		rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+		rqs.AddCookie(cookies[0])
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, rqs)
+		assert.Equal(t, location, rsp.Header().Get("Location"))
+	}
+
+	rqs = httptest.NewRequest(http.MethodGet, "/api/user/urls/oeapEa/stats", nil)
+	rsp = httptest.NewRecorder()
+	router.ServeHTTP(rsp, withUser(rqs, "owner"))
+	assert.Equal(t, http.StatusOK, rsp.Code)
+
+	var stats ClickStatsInfo
+	assert.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &stats))
+	assert.Equal(t, 11, stats.Clicks)
+	assert.Len(t, stats.Variants, 2)
+	for _, variant := range stats.Variants {
+		if variant.URL == location {
+			assert.Equal(t, 11, variant.Clicks)
+		} else {
+			assert.Equal(t, 0, variant.Clicks)
+		}
+	}
+}
+
+func TestPasswordProtectedLink(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.PasswordAttempts = 2
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	shortURL, err := urlService.ProcessLongURL(context.Background(), "https://www.foo.com", service.LinkOptions{Password: "secret"})
+	assert.NoError(t, err)
+
+	record, err := urlStorage.TryGetURL(context.Background(), shortURL)
+	assert.NoError(t, err)
+	assert.NotContains(t, record.PasswordHash, "secret")
+
+	router := chi.NewRouter()
+	router.Get("/{URL}", handler.ProcessGet)
+	router.Post("/{URL}", handler.ProcessGet)
+
+	rqs := httptest.NewRequest(http.MethodGet, "/"+shortURL, nil)
+	rqs.Header.Set("Accept", "text/html")
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, rqs)
+	assert.Equal(t, http.StatusUnauthorized, rsp.Code)
+	assert.Contains(t, rsp.Body.String(), `<form method="post">`)
+	assert.NotContains(t, rsp.Body.String(), "www.foo.com")
+
+	tests := []struct {
+		name     string
+		method   string
+		password string
+		status   int
+	}{
+		{name: "header", method: http.MethodGet, password: "secret", status: http.StatusTemporaryRedirect},
+		{name: "form", method: http.MethodPost, password: "secret", status: http.StatusSeeOther},
+		{name: "wrong header", method: http.MethodGet, password: "guess", status: http.StatusUnauthorized},
+		{name: "wrong form", method: http.MethodPost, password: "guess", status: http.StatusUnauthorized},
+		{name: "rate limited", method: http.MethodGet, password: "secret", status: http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rqs *http.Request
+			if test.method == http.MethodPost {
+				rqs = httptest.NewRequest(http.MethodPost, "/"+shortURL, strings.NewReader("password="+test.password))
+				rqs.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				rqs = httptest.NewRequest(http.MethodGet, "/"+shortURL, nil)
+				rqs.Header.Set("X-Link-Password", test.password)
+			}
+
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			assert.Equal(t, test.status, rsp.Code)
+			if test.status == http.StatusTemporaryRedirect || test.status == http.StatusSeeOther {
+				assert.Equal(t, "https://www.foo.com", rsp.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestPasswordOnShortenedURL(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	plain, err := urlService.ProcessLongURL(context.Background(), "https://www.foo.com", service.LinkOptions{})
+	require.NoError(t, err)
+
+	router := chi.NewRouter()
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+	router.Get("/{URL}", handler.ProcessGet)
+
+	rqs := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://www.foo.com","password":"secret"}`))
+	rqs.Header.Set("Content-Type", "application/json")
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, rqs)
+	require.Equal(t, http.StatusCreated, rsp.Code)
+
+	var info ShortURLInfo
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &info))
+	protected := strings.TrimPrefix(info.Result, "http://localhost:8080/")
+	assert.NotEqual(t, plain, protected)
+
+	visit := func(shortURL string) int {
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/"+shortURL, nil))
+		return rsp.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, visit(protected))
+	assert.Equal(t, http.StatusTemporaryRedirect, visit(plain))
+}
+
+func TestMaxClicks(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlStorage.StoreURL(context.Background(), storage.URLRecord{ShortURL: "oeapEa", LongURL: "https://www.foo.com", MaxClicks: 2})
+
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Get("/{URL}", handler.ProcessGet)
+
+	for _, status := range []int{http.StatusTemporaryRedirect, http.StatusTemporaryRedirect, http.StatusGone, http.StatusGone} {
+		rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, rqs)
+		assert.Equal(t, status, rsp.Code)
+	}
+
+	rqs := httptest.NewRequest(http.MethodGet, "/oeapEa+", nil)
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, rqs)
+	assert.Equal(t, http.StatusGone, rsp.Code)
+}
+
+func TestLinkOptionsGetOwnCode(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	handler := NewURLHandler(service.NewURLService(urlStorage, &cfg), &cfg)
+
+	router := chi.NewRouter()
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+	router.Get("/{URL}", handler.ProcessGet)
+
+	shorten := func(userID, body string) string {
+		rqs := withUser(httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body)), userID)
+		rqs.Header.Set("Content-Type", "application/json")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, rqs)
+		require.Equal(t, http.StatusCreated, rsp.Code)
+
+		var info ShortURLInfo
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &info))
+		return strings.TrimPrefix(info.Result, "http://localhost:8080/")
+	}
+
+	visit := func(shortURL string) int {
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, "/"+shortURL, nil))
+		return rsp.Code
+	}
+
+	notAfter := time.Now().Add(time.Hour).Format(time.RFC3339)
+	oneTime := shorten("alice", `{"url":"https://www.foo.com","max_clicks":1}`)
+	limited := shorten("bob", `{"url":"https://www.foo.com","max_clicks":3,"not_after":"`+notAfter+`"}`)
+	assert.NotEqual(t, oneTime, limited)
+
+	for _, shortURL := range []string{oneTime, limited} {
+		record, err := urlStorage.TryGetURL(context.Background(), shortURL)
+		require.NoError(t, err)
+		assert.Equal(t, "https://www.foo.com", record.LongURL)
+	}
+
+	bobs, err := urlStorage.TryGetURL(context.Background(), limited)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", bobs.UserID)
+	assert.Equal(t, 3, bobs.MaxClicks)
+	assert.False(t, bobs.NotAfter.IsZero())
+
+	// the clicks of one link do not count against the other
+	assert.Equal(t, http.StatusTemporaryRedirect, visit(oneTime))
+	assert.Equal(t, http.StatusGone, visit(oneTime))
+	assert.Equal(t, http.StatusTemporaryRedirect, visit(limited))
+
+	// plain shortenings keep the code derived from the long URL
+	plain := shorten("carol", `{"url":"https://www.foo.com"}`)
+	assert.NotEqual(t, oneTime, plain)
+	assert.NotEqual(t, limited, plain)
+
+	// so do redirect codes and passthrough, which change visits too
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "redirect code", body: `{"url":"https://www.foo.com","redirect_code":301}`, status: http.StatusMovedPermanently},
+		{name: "passthrough", body: `{"url":"https://www.foo.com","passthrough":true}`, status: http.StatusTemporaryRedirect},
+		{name: "passthrough conflict", body: `{"url":"https://www.foo.com","passthrough":true,"passthrough_conflict":"target"}`, status: http.StatusTemporaryRedirect},
+	}
+	for _, test := range tests {
+		shortURL := shorten("dave", test.body)
+		assert.NotEqual(t, plain, shortURL, test.name)
+		assert.Equal(t, test.status, visit(shortURL), test.name)
+
+		record, err := urlStorage.TryGetURL(context.Background(), shortURL)
+		require.NoError(t, err)
+		assert.Equal(t, "dave", record.UserID, test.name)
+	}
+
+	// the shared code keeps serving plain visits
+	assert.Equal(t, http.StatusTemporaryRedirect, visit(plain))
+}
+
+func TestActivationWindow(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		record      storage.URLRecord
+		comingSoon  string
+		status      int
+		location    string
+		bodyContent string
+	}{
+		{
+			name:        "coming soon page",
+			record:      storage.URLRecord{NotBefore: now.Add(time.Hour)},
+			status:      http.StatusNotFound,
+			bodyContent: "is not active yet",
+		},
+		{
+			name:       "configured fallback",
+			record:     storage.URLRecord{NotBefore: now.Add(time.Hour)},
+			comingSoon: "https://www.foo.com/soon",
+			status:     http.StatusFound,
+			location:   "https://www.foo.com/soon",
+		},
+		{
+			name:       "link fallback",
+			record:     storage.URLRecord{NotBefore: now.Add(time.Hour), FallbackURL: "https://www.foo.com/teaser"},
+			comingSoon: "https://www.foo.com/soon",
+			status:     http.StatusFound,
+			location:   "https://www.foo.com/teaser",
+		},
+		{
+			name:     "active",
+			record:   storage.URLRecord{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)},
+			status:   http.StatusTemporaryRedirect,
+			location: "https://www.foo.com",
+		},
+		{
+			name:   "expired",
+			record: storage.URLRecord{NotAfter: now.Add(-time.Hour)},
+			status: http.StatusGone,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testutils.LoadTestConfig()
+			cfg.ComingSoonURL = test.comingSoon
+
+			record := test.record
+			record.ShortURL = "oeapEa"
+			record.LongURL = "https://www.foo.com"
+			urlStorage := mocks.NewStorageMock()
+			urlStorage.StoreURL(context.Background(), record)
+
+			handler := NewURLHandler(service.NewURLService(urlStorage, &cfg), &cfg)
+			router := chi.NewRouter()
+			router.Get("/{URL}", handler.ProcessGet)
+
+			rqs := httptest.NewRequest(http.MethodGet, "/oeapEa", nil)
+			rsp := httptest.NewRecorder()
+			router.ServeHTTP(rsp, rqs)
+
+			assert.Equal(t, test.status, rsp.Code)
+			assert.Equal(t, test.location, rsp.Header().Get("Location"))
+			assert.Contains(t, rsp.Body.String(), test.bodyContent)
+		})
+	}
+}
+
+func TestLinkMetadata(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlStorage.StoreURL(context.Background(), storage.URLRecord{ShortURL: "oeapEa", LongURL: "https://www.foo.com", UserID: "owner", Title: "Foo"})
+	urlStorage.StoreURL(context.Background(), storage.URLRecord{ShortURL: "v3_WMnKl", LongURL: "https://www.bar.com", UserID: "owner"})
+
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Patch("/api/user/urls/{URL}", handler.ProcessPatchMetadata)
+	router.Get("/api/user/urls", handler.ProcessGetSummary)
+
+	patch := func(userID, data string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(http.MethodPatch, "/api/user/urls/oeapEa", bytes.NewBufferString(data))
+		rqs.Header.Set("Content-Type", "application/json")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp
+	}
+
+	assert.Equal(t, http.StatusForbidden, patch("stranger", `{"note":"mine"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch("owner", `{"tags":["no spaces"]}`).Code)
+
+	rsp := patch("owner", `{"note":"spring campaign","tags":["Promo","spring","promo"]}`)
+	assert.Equal(t, http.StatusOK, rsp.Code)
+
+	var item URLSummaryItem
+	assert.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &item))
+	assert.Equal(t, "Foo", item.Title)
+	assert.Equal(t, "spring campaign", item.Note)
+	assert.Equal(t, []string{"promo", "spring"}, item.Tags)
+
+	rqs := httptest.NewRequest(http.MethodGet, "/api/user/urls?tag=PROMO", nil)
+	rsp = httptest.NewRecorder()
+	router.ServeHTTP(rsp, withUser(rqs, "owner"))
+	assert.Equal(t, http.StatusOK, rsp.Code)
+
+	var summary []URLSummaryItem
+	assert.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &summary))
+	assert.Len(t, summary, 1)
+	assert.Equal(t, "https://www.foo.com", summary[0].LongURL)
+}
+
+func TestAPIKeys(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Post("/api/user/keys", handler.ProcessPostAPIKey)
+	router.Get("/api/user/keys", handler.ProcessGetAPIKeys)
+	router.Delete("/api/user/keys/{id}", handler.ProcessDeleteAPIKey)
+
+	create := func(data string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(http.MethodPost, "/api/user/keys", bytes.NewBufferString(data))
+		rqs.Header.Set("Content-Type", "application/json")
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, "owner"))
+		return rsp
+	}
+
+	assert.Equal(t, http.StatusBadRequest, create(`{"name":"ci","scopes":["superuser"]}`).Code)
+	assert.Equal(t, http.StatusForbidden, create(`{"name":"ci","scopes":["admin"]}`).Code)
+
+	rsp := create(`{"name":"ci","scopes":["shorten","read"]}`)
+	assert.Equal(t, http.StatusCreated, rsp.Code)
+
+	var created APIKeyInfo
+	assert.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.Key, "usk_"))
+	assert.Equal(t, []string{"read", "shorten"}, created.Scopes)
+
+	userID, scopes, err := urlService.VerifyAPIKey(context.Background(), created.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, "owner", userID)
+	assert.Equal(t, []string{"read", "shorten"}, scopes)
+
+	rqs := httptest.NewRequest(http.MethodGet, "/api/user/keys", nil)
+	rsp = httptest.NewRecorder()
+	router.ServeHTTP(rsp, withUser(rqs, "owner"))
+	assert.Equal(t, http.StatusOK, rsp.Code)
+	assert.NotContains(t, rsp.Body.String(), created.Key)
+	assert.Contains(t, rsp.Body.String(), `"last_used"`)
+
+	rqs = httptest.NewRequest(http.MethodDelete, "/api/user/keys/"+created.ID, nil)
+	rsp = httptest.NewRecorder()
+	router.ServeHTTP(rsp, withUser(rqs, "stranger"))
+	assert.Equal(t, http.StatusNotFound, rsp.Code)
+
+	rqs = httptest.NewRequest(http.MethodDelete, "/api/user/keys/"+created.ID, nil)
+	rsp = httptest.NewRecorder()
+	router.ServeHTTP(rsp, withUser(rqs, "owner"))
+	assert.Equal(t, http.StatusNoContent, rsp.Code)
+
+	_, _, err = urlService.VerifyAPIKey(context.Background(), created.Key)
+	assert.ErrorIs(t, err, &service.UnauthorizedError{})
+}
+
 func TestPostStringHandler(t *testing.T) {
 	cfg := testutils.LoadTestConfig()
 	storage := mocks.NewStorageMock()
@@ -210,10 +1242,23 @@ func TestPostObjectHandler(t *testing.T) {
 				rsp:  "incorrect content type\n",
 			},
 		},
+		{
+			name:        "forbidden scheme",
+			rqsData:     `{"url":"javascript:alert(1)"}`,
+			contentType: "application/json",
+			want: want{
+				code: 422,
+				rsp:  "URL 'javascript:alert(1)' rejected: scheme 'javascript' is not allowed\n",
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
+			urlPolicy, err := policy.NewPolicy(&cfg)
+			assert.NoError(t, err)
+
 			urlService := service.NewURLService(storage, &cfg)
+			urlService.SetPolicy(urlPolicy)
 			handler := NewURLHandler(urlService, &cfg)
 
 			router := chi.NewRouter()
@@ -235,6 +1280,69 @@ func TestPostObjectHandler(t *testing.T) {
 	}
 }
 
+// commitTracker fails the test when the title of a link is stored before
+// the batch creating the link was committed.
+type commitTracker struct {
+	*mocks.Mock
+	t         *testing.T
+	fetched   chan struct{}
+	committed bool
+}
+
+func (tracker *commitTracker) EndTransaction(ctx context.Context) error {
+	select {
+	case <-tracker.fetched:
+		tracker.t.Error("metadata fetched before the batch was committed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	tracker.committed = true
+	return nil
+}
+
+func TestBatchMetadataFetch(t *testing.T) {
+	fetched := make(chan struct{}, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, rqs *http.Request) {
+		fetched <- struct{}{}
+		rsp.Header().Set("Content-Type", "text/html")
+		rsp.Write([]byte("<title>Fetched</title>"))
+	}))
+	defer server.Close()
+
+	cfg := testutils.LoadTestConfig()
+	cfg.BlockPrivateIPs = false
+	cfg.MetadataFetchWorkers = 1
+	cfg.MetadataFetchQueue = 4
+	cfg.MetadataFetchTimeout = time.Second
+	cfg.MetadataFetchMaxBytes = 1024
+
+	tracker := &commitTracker{Mock: mocks.NewStorageMock(), t: t, fetched: fetched}
+	fetcher := metafetch.NewFetcher(tracker, &cfg)
+	fetcher.RunAsync()
+
+	urlService := service.NewURLService(tracker, &cfg)
+	urlService.SetFetcher(fetcher)
+	handler := NewURLHandler(urlService, &cfg)
+
+	body := `[{"correlation_id":"id1","original_url":"` + server.URL + `/one"}]`
+	rqs := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader(body))
+	rqs.Header.Set("Content-Type", "application/json")
+	rsp := httptest.NewRecorder()
+	handler.ProcessPostURLBatch(rsp, rqs)
+	require.Equal(t, http.StatusCreated, rsp.Code)
+	assert.True(t, tracker.committed)
+
+	fetcher.Finalize()
+
+	var items []ShortURLBatchItem
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &items))
+	require.Len(t, items, 1)
+
+	record, err := tracker.TryGetURL(context.Background(), strings.TrimPrefix(items[0].URL, "http://localhost:8080/"))
+	require.NoError(t, err)
+	assert.Equal(t, "Fetched", record.Title)
+}
+
 func TestPostBatchHandler(t *testing.T) {
 	cfg := testutils.LoadTestConfig()
 	storage := mocks.NewStorageMock()
@@ -316,3 +1424,708 @@ func TestPostBatchHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestLogin(t *testing.T) {
+	stub := testutils.NewOIDCProvider()
+	defer stub.Close()
+
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	cfg.OIDCIssuer = stub.URL
+	cfg.OIDCClientID = stub.ClientID
+	cfg.OIDCClientSecret = stub.ClientSecret
+
+	urlStorage, err := storage.NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer urlStorage.Finalize()
+
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+	sessions := middleware.NewSessions(&cfg)
+	logger := zap.NewNop().Sugar()
+
+	router := chi.NewRouter()
+	router.Get("/login", handler.ProcessLogin)
+	router.Get("/callback", middleware.Authorize(handler.ProcessCallback, logger, sessions))
+	router.Post("/logout", handler.ProcessLogout)
+	router.Post("/api/shorten", middleware.Authorize(handler.ProcessPostURLObject, logger, sessions))
+	router.Get("/api/user/urls", middleware.Authorize(handler.ProcessGetSummary, logger, sessions))
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	cfg.OIDCRedirectURL = server.URL + "/callback"
+	handler.SetLogin(oidc.NewProvider(&cfg), sessions)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+
+	shorten := func(longURL string) {
+		rsp, err := client.Post(server.URL+"/api/shorten", "application/json", strings.NewReader(`{"url":"`+longURL+`"}`))
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, http.StatusCreated, rsp.StatusCode)
+	}
+
+	login := func() string {
+		rsp, err := client.Get(server.URL + "/login?next=/api/user/urls")
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+
+		assert.Equal(t, "/api/user/urls", rsp.Request.URL.Path)
+
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	logout := func() {
+		rsp, err := client.Post(server.URL+"/logout", "", nil)
+		require.NoError(t, err)
+		rsp.Body.Close()
+	}
+
+	// the first login turns the anonymous user into the account
+	shorten("https://first.example.com")
+	summary := login()
+	assert.Contains(t, summary, "https://first.example.com")
+
+	logout()
+	rsp, err := client.Get(server.URL + "/api/user/urls")
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+
+	// links created anonymously later are merged into the account
+	shorten("https://second.example.com")
+	summary = login()
+	assert.Contains(t, summary, "https://first.example.com")
+	assert.Contains(t, summary, "https://second.example.com")
+
+	// a login with another identity does not take the links of the account
+	stub.Subject = "bob"
+	assert.Empty(t, login())
+
+	t.Run("state mismatch", func(t *testing.T) {
+		rqs := httptest.NewRequest(http.MethodGet, "/callback?code=stolen&state=forged", nil)
+		rqs.AddCookie(&http.Cookie{Name: loginCookie, Value: "state=expected&nonce=n&verifier=v"})
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, rqs)
+		assert.Equal(t, http.StatusBadRequest, rsp.Code)
+	})
+}
+
+func TestTeams(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+	router.Get("/api/user/urls", handler.ProcessGetSummary)
+	router.Delete("/api/user/urls", handler.ProcessDeleteUrls)
+	router.Patch("/api/user/urls/{URL}", handler.ProcessPatchMetadata)
+	router.Post("/api/user/teams", handler.ProcessPostTeam)
+	router.Get("/api/user/teams", handler.ProcessGetTeams)
+	router.Get("/api/user/teams/{id}/members", handler.ProcessGetMembers)
+	router.Put("/api/user/teams/{id}/members/{userID}", handler.ProcessPutMember)
+	router.Delete("/api/user/teams/{id}/members/{userID}", handler.ProcessDeleteMember)
+
+	call := func(userID, method, target, body string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			rqs.Header.Set("Content-Type", "application/json")
+		}
+
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp
+	}
+
+	rsp := call("alice", http.MethodPost, "/api/user/teams", `{"name":"growth"}`)
+	require.Equal(t, http.StatusCreated, rsp.Code)
+
+	var team TeamInfo
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &team))
+	assert.Equal(t, service.RoleOwner, team.Role)
+	members := "/api/user/teams/" + team.ID + "/members/"
+
+	assert.Equal(t, http.StatusOK, call("alice", http.MethodPut, members+"bob", `{"role":"editor"}`).Code)
+	assert.Equal(t, http.StatusOK, call("alice", http.MethodPut, members+"carol", `{"role":"viewer"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, call("alice", http.MethodPut, members+"carol", `{"role":"admin"}`).Code)
+	assert.Equal(t, http.StatusForbidden, call("bob", http.MethodPut, members+"dave", `{"role":"owner"}`).Code)
+	assert.Equal(t, http.StatusNotFound, call("dave", http.MethodGet, members, "").Code)
+
+	shorten := func(userID, longURL string) (int, string) {
+		rsp := call(userID, http.MethodPost, "/api/shorten", `{"url":"`+longURL+`","team":"`+team.ID+`"}`)
+
+		var info ShortURLInfo
+		json.Unmarshal(rsp.Body.Bytes(), &info)
+		return rsp.Code, strings.TrimPrefix(info.Result, "http://localhost:8080/")
+	}
+
+	code, aliceURL := shorten("alice", "https://alice.example.com")
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = shorten("bob", "https://bob.example.com")
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = shorten("carol", "https://carol.example.com")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// a URL someone else shortened gets a team link of its own
+	rsp = call("erin", http.MethodPost, "/api/shorten", `{"url":"https://shared.example.com"}`)
+	require.Equal(t, http.StatusCreated, rsp.Code)
+	var erinInfo ShortURLInfo
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &erinInfo))
+	erinURL := strings.TrimPrefix(erinInfo.Result, "http://localhost:8080/")
+
+	code, teamURL := shorten("alice", "https://shared.example.com")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, erinURL, teamURL)
+	assert.Equal(t, http.StatusOK, call("bob", http.MethodPatch, "/api/user/urls/"+teamURL, `{"title":"team"}`).Code)
+	assert.Equal(t, http.StatusForbidden, call("bob", http.MethodPatch, "/api/user/urls/"+erinURL, `{"title":"team"}`).Code)
+
+	summary := call("carol", http.MethodGet, "/api/user/urls", "").Body.String()
+	assert.Contains(t, summary, "https://alice.example.com")
+	assert.Contains(t, summary, "https://bob.example.com")
+	assert.Equal(t, http.StatusNoContent, call("dave", http.MethodGet, "/api/user/urls", "").Code)
+
+	assert.Equal(t, http.StatusForbidden, call("carol", http.MethodPatch, "/api/user/urls/"+aliceURL, `{"title":"mine"}`).Code)
+	assert.Equal(t, http.StatusOK, call("bob", http.MethodPatch, "/api/user/urls/"+aliceURL, `{"title":"edited"}`).Code)
+
+	call("carol", http.MethodDelete, "/api/user/urls", `["`+aliceURL+`"]`)
+	record, err := urlStorage.TryGetURL(context.Background(), aliceURL)
+	require.NoError(t, err)
+	assert.False(t, record.Deleted)
+
+	call("bob", http.MethodDelete, "/api/user/urls", `["`+aliceURL+`"]`)
+	record, err = urlStorage.TryGetURL(context.Background(), aliceURL)
+	require.NoError(t, err)
+	assert.True(t, record.Deleted)
+	assert.Equal(t, "edited", record.Title)
+
+	// the last owner can not leave, other members can
+	assert.Equal(t, http.StatusBadRequest, call("alice", http.MethodDelete, members+"alice", "").Code)
+	assert.Equal(t, http.StatusBadRequest, call("alice", http.MethodPut, members+"alice", `{"role":"editor"}`).Code)
+	assert.Equal(t, http.StatusNoContent, call("carol", http.MethodDelete, members+"carol", "").Code)
+	assert.Equal(t, http.StatusNoContent, call("carol", http.MethodGet, "/api/user/urls", "").Code)
+
+	rsp = call("bob", http.MethodGet, "/api/user/teams", "")
+	assert.Equal(t, http.StatusOK, rsp.Code)
+	assert.JSONEq(t, `[{"id":"`+team.ID+`","name":"growth","role":"editor","created_at":"`+team.CreatedAt.Format(time.RFC3339Nano)+`"}]`, rsp.Body.String())
+}
+
+func TestAdmin(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.AdminUserIDs = "root, operator"
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Get("/{URL}", handler.ProcessGet)
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+	router.Get("/api/admin/urls", handler.ProcessAdminSearch)
+	router.Get("/api/admin/urls/{URL}", handler.ProcessAdminGetURL)
+	router.Post("/api/admin/urls/{URL}/disable", handler.ProcessAdminDisableURL)
+	router.Post("/api/admin/urls/{URL}/enable", handler.ProcessAdminEnableURL)
+	router.Put("/api/admin/urls/{URL}/owner", handler.ProcessAdminPutOwner)
+	router.Get("/api/admin/users/{userID}/urls", handler.ProcessAdminGetUserURLs)
+	router.Post("/api/admin/users/{userID}/disable", handler.ProcessAdminDisableUser)
+	router.Get("/api/user/urls", handler.ProcessGetSummary)
+
+	call := func(userID, method, target, body string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			rqs.Header.Set("Content-Type", "application/json")
+		}
+
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp
+	}
+
+	shorten := func(userID, longURL string) string {
+		rsp := call(userID, http.MethodPost, "/api/shorten", `{"url":"`+longURL+`"}`)
+		require.Equal(t, http.StatusCreated, rsp.Code)
+
+		var info ShortURLInfo
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &info))
+		return strings.TrimPrefix(info.Result, "http://localhost:8080/")
+	}
+
+	spamURL := shorten("alice", "https://spam.example.com")
+	shorten("alice", "https://phishing.example.com")
+	shorten("bob", "https://bob.example.com")
+
+	urls := func(rsp *httptest.ResponseRecorder) []AdminURLItem {
+		require.Equal(t, http.StatusOK, rsp.Code)
+
+		var items []AdminURLItem
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &items))
+		return items
+	}
+
+	t.Run("operators only", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, call("alice", http.MethodGet, "/api/admin/urls?q=spam", "").Code)
+		assert.Equal(t, http.StatusForbidden, call("alice", http.MethodPost, "/api/admin/users/bob/disable", "").Code)
+		assert.Equal(t, http.StatusBadRequest, call("root", http.MethodGet, "/api/admin/urls", "").Code)
+	})
+
+	t.Run("search", func(t *testing.T) {
+		items := urls(call("operator", http.MethodGet, "/api/admin/urls?q=example.com&limit=2", ""))
+		assert.Len(t, items, 2)
+
+		items = urls(call("root", http.MethodGet, "/api/admin/urls?q="+spamURL, ""))
+		require.NotEmpty(t, items)
+		assert.Equal(t, spamURL, items[0].Code)
+		assert.Equal(t, "alice", items[0].UserID)
+	})
+
+	t.Run("disable and enable", func(t *testing.T) {
+		rsp := call("root", http.MethodPost, "/api/admin/urls/"+spamURL+"/disable", `{"reason":"spam"}`)
+		require.Equal(t, http.StatusOK, rsp.Code)
+		assert.Contains(t, rsp.Body.String(), `"disabled_reason":"spam"`)
+		assert.Equal(t, http.StatusGone, call("alice", http.MethodGet, "/"+spamURL, "").Code)
+
+		require.Equal(t, http.StatusOK, call("root", http.MethodPost, "/api/admin/urls/"+spamURL+"/enable", "").Code)
+		assert.Equal(t, http.StatusTemporaryRedirect, call("alice", http.MethodGet, "/"+spamURL, "").Code)
+		assert.Equal(t, http.StatusNotFound, call("root", http.MethodPost, "/api/admin/urls/missing/disable", "").Code)
+	})
+
+	t.Run("transfer", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, call("root", http.MethodPut, "/api/admin/urls/"+spamURL+"/owner", `{"user_id":""}`).Code)
+
+		rsp := call("root", http.MethodPut, "/api/admin/urls/"+spamURL+"/owner", `{"user_id":"bob"}`)
+		require.Equal(t, http.StatusOK, rsp.Code)
+		assert.Len(t, urls(call("root", http.MethodGet, "/api/admin/users/bob/urls", "")), 2)
+		assert.Len(t, urls(call("root", http.MethodGet, "/api/admin/users/alice/urls", "")), 1)
+	})
+
+	t.Run("disable user", func(t *testing.T) {
+		rsp := call("root", http.MethodPost, "/api/admin/users/bob/disable", `{"reason":"abuse"}`)
+		require.Equal(t, http.StatusOK, rsp.Code)
+		assert.JSONEq(t, `{"disabled":2}`, rsp.Body.String())
+
+		for _, item := range urls(call("root", http.MethodGet, "/api/admin/users/bob/urls", "")) {
+			assert.True(t, item.Disabled)
+			assert.Equal(t, "abuse", item.DisabledReason)
+		}
+		assert.Equal(t, http.StatusGone, call("alice", http.MethodGet, "/"+spamURL, "").Code)
+
+		// the owner sees why the links are down
+		rsp = call("bob", http.MethodGet, "/api/user/urls", "")
+		require.Equal(t, http.StatusOK, rsp.Code)
+		var summary []URLSummaryItem
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &summary))
+		require.Len(t, summary, 2)
+		for _, item := range summary {
+			assert.True(t, item.Disabled)
+			assert.Equal(t, "abuse", item.DisabledReason)
+		}
+
+		rsp = call("root", http.MethodPost, "/api/admin/users/bob/disable", "")
+		assert.JSONEq(t, `{"disabled":0}`, rsp.Body.String())
+	})
+}
+
+func TestQuotas(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.AdminUserIDs = "root"
+	cfg.MaxActiveLinks = 3
+	cfg.MaxDailyLinks = 4
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+	router.Post("/api/shorten/batch", handler.ProcessPostURLBatch)
+	router.Delete("/api/user/urls", handler.ProcessDeleteUrls)
+	router.Get("/api/admin/users/{userID}/quota", handler.ProcessAdminGetQuota)
+	router.Put("/api/admin/users/{userID}/quota", handler.ProcessAdminPutQuota)
+	router.Delete("/api/admin/users/{userID}/quota", handler.ProcessAdminDeleteQuota)
+
+	call := func(userID, method, target, body string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			rqs.Header.Set("Content-Type", "application/json")
+		}
+
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp
+	}
+
+	shorten := func(userID string, n int) (*httptest.ResponseRecorder, string) {
+		rsp := call(userID, http.MethodPost, "/api/shorten", fmt.Sprintf(`{"url":"https://%s.example.com/%d"}`, userID, n))
+
+		var info ShortURLInfo
+		json.Unmarshal(rsp.Body.Bytes(), &info)
+		return rsp, strings.TrimPrefix(info.Result, "http://localhost:8080/")
+	}
+
+	remove := func(userID, shortURL string) {
+		require.Equal(t, http.StatusAccepted, call(userID, http.MethodDelete, "/api/user/urls", `["`+shortURL+`"]`).Code)
+	}
+
+	t.Run("active and daily limits", func(t *testing.T) {
+		created := make([]string, 0)
+		for n := 1; n <= 3; n++ {
+			rsp, shortURL := shorten("alice", n)
+			require.Equal(t, http.StatusCreated, rsp.Code)
+			created = append(created, shortURL)
+		}
+
+		rsp, _ := shorten("alice", 4)
+		assert.Equal(t, http.StatusForbidden, rsp.Code)
+		assert.Contains(t, rsp.Body.String(), "at most 3 links")
+
+		// shortening a stored URL again costs no quota
+		rsp, _ = shorten("alice", 1)
+		assert.NotEqual(t, http.StatusForbidden, rsp.Code)
+
+		remove("alice", created[0])
+		rsp, _ = shorten("alice", 4)
+		require.Equal(t, http.StatusCreated, rsp.Code)
+
+		remove("alice", created[1])
+		rsp, _ = shorten("alice", 5)
+		assert.Equal(t, http.StatusTooManyRequests, rsp.Code)
+		assert.Contains(t, rsp.Body.String(), "at most 4 links per day")
+		assert.NotEmpty(t, rsp.Header().Get("Retry-After"))
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		batch := func(urls ...int) *httptest.ResponseRecorder {
+			items := make([]string, 0, len(urls))
+			for i, n := range urls {
+				items = append(items, fmt.Sprintf(`{"correlation_id":"%d","original_url":"https://bob.example.com/%d"}`, i, n))
+			}
+
+			return call("bob", http.MethodPost, "/api/shorten/batch", "["+strings.Join(items, ",")+"]")
+		}
+
+		assert.Equal(t, http.StatusForbidden, batch(0, 1, 2, 3).Code)
+		assert.Equal(t, http.StatusCreated, batch(0, 1).Code)
+
+		// stored and repeated URLs are no new links
+		assert.Equal(t, http.StatusConflict, batch(0, 1).Code)
+		assert.Equal(t, http.StatusForbidden, batch(2, 3).Code)
+		assert.Equal(t, http.StatusConflict, batch(2, 2).Code)
+		assert.Equal(t, http.StatusForbidden, batch(3).Code)
+	})
+
+	t.Run("operator override", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, call("alice", http.MethodGet, "/api/admin/users/alice/quota", "").Code)
+		assert.Equal(t, http.StatusBadRequest, call("root", http.MethodPut, "/api/admin/users/alice/quota", `{"max_daily":-1}`).Code)
+
+		rsp := call("root", http.MethodPut, "/api/admin/users/alice/quota", `{"max_daily":0}`)
+		require.Equal(t, http.StatusOK, rsp.Code)
+		assert.JSONEq(t, `{"max_active":3,"max_daily":0,"custom":true,"active":2,"daily":4}`, rsp.Body.String())
+
+		rsp, _ = shorten("alice", 5)
+		require.Equal(t, http.StatusCreated, rsp.Code)
+
+		rsp = call("root", http.MethodGet, "/api/admin/users/alice/quota", "")
+		assert.JSONEq(t, `{"max_active":3,"max_daily":0,"custom":true,"active":3,"daily":5}`, rsp.Body.String())
+
+		assert.Equal(t, http.StatusNoContent, call("root", http.MethodDelete, "/api/admin/users/alice/quota", "").Code)
+		assert.Equal(t, http.StatusNotFound, call("root", http.MethodDelete, "/api/admin/users/alice/quota", "").Code)
+
+		rsp = call("root", http.MethodGet, "/api/admin/users/alice/quota", "")
+		assert.JSONEq(t, `{"max_active":3,"max_daily":4,"custom":false,"active":3,"daily":5}`, rsp.Body.String())
+	})
+}
+
+func TestConcurrentQuota(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	cfg.MaxActiveLinks = 3
+	urlStorage, err := storage.NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer urlStorage.Finalize()
+
+	urlService := service.NewURLService(urlStorage, &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for n := 0; n < cap(codes); n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			body := fmt.Sprintf(`{"url":"https://carol.example.com/%d"}`, n)
+			if n%2 == 1 {
+				body = fmt.Sprintf(`{"url":"https://carol.example.com/%d","max_clicks":5}`, n)
+			}
+
+			rqs := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+			rqs.Header.Set("Content-Type", "application/json")
+			rsp := httptest.NewRecorder()
+			handler.ProcessPostURLObject(rsp, withUser(rqs, "carol"))
+			codes <- rsp.Code
+		}(n)
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusForbidden, code)
+		}
+	}
+	assert.Equal(t, 3, created)
+
+	usage, err := urlStorage.GetUsage(context.Background(), "carol", time.Now().Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 3, usage.Active)
+}
+
+func TestAnonymousQuota(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.MaxActiveLinks = 5
+	cfg.MaxDailyLinks = 2
+	urlService := service.NewURLService(mocks.NewStorageMock(), &cfg)
+	handler := NewURLHandler(urlService, &cfg)
+
+	sessions := middleware.NewSessions(&cfg)
+	shorten := middleware.Authorize(handler.ProcessPostURLObject, zap.NewNop().Sugar(), sessions)
+
+	// without a cookie every request gets a new user, the client address
+	// is what the links count against
+	call := func(remoteAddr string, n int) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(fmt.Sprintf(`{"url":"https://anonymous.example.com/%d"}`, n)))
+		rqs.Header.Set("Content-Type", "application/json")
+		rqs.RemoteAddr = remoteAddr
+
+		rsp := httptest.NewRecorder()
+		shorten(rsp, rqs)
+		return rsp
+	}
+
+	assert.Equal(t, http.StatusCreated, call("203.0.113.1:1000", 1).Code)
+	assert.Equal(t, http.StatusCreated, call("203.0.113.1:1001", 2).Code)
+
+	// a stored URL costs nothing
+	assert.Equal(t, http.StatusConflict, call("203.0.113.1:1002", 1).Code)
+
+	rsp := call("203.0.113.1:1003", 3)
+	assert.Equal(t, http.StatusTooManyRequests, rsp.Code)
+	assert.Contains(t, rsp.Body.String(), "at most 2 links per day without a session")
+	assert.NotEmpty(t, rsp.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusCreated, call("203.0.113.2:1000", 3).Code)
+}
+
+// delayedDelete keeps deletions until apply is called, like the database
+// storage that deletes in the background.
+type delayedDelete struct {
+	*mocks.Mock
+	pending []func()
+}
+
+func (store *delayedDelete) MarkAsDeleted(ctx context.Context, shortURLs []string, onDeleted func(shortURLs []string)) {
+	ctx = context.WithoutCancel(ctx)
+	store.pending = append(store.pending, func() {
+		store.Mock.MarkAsDeleted(ctx, shortURLs, onDeleted)
+	})
+}
+
+func (store *delayedDelete) apply() {
+	for _, markAsDeleted := range store.pending {
+		markAsDeleted()
+	}
+	store.pending = nil
+}
+
+func TestAuditDelayedDelete(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := &delayedDelete{Mock: mocks.NewStorageMock()}
+	userCtx := context.WithValue(context.Background(), storage.UserIDKey{Name: "userID"}, "user1")
+	require.NoError(t, urlStorage.StoreURL(userCtx, storage.URLRecord{ShortURL: "abc", LongURL: "https://audit.example.com"}))
+	urlService := service.NewURLService(urlStorage, &cfg)
+
+	sink, err := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	defer sink.Finalize()
+	urlService.SetAudit(sink)
+	handler := NewURLHandler(urlService, &cfg)
+
+	remove := func() {
+		rqs := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(`["abc"]`))
+		rqs.Header.Set("Content-Type", "application/json")
+		ctx, cancel := context.WithCancel(audit.WithClientIP(rqs.Context(), "10.0.0.7"))
+		rsp := httptest.NewRecorder()
+		handler.ProcessDeleteUrls(rsp, withUser(rqs.WithContext(ctx), "user1"))
+		cancel()
+		require.Equal(t, http.StatusAccepted, rsp.Code)
+	}
+
+	remove()
+	events, err := sink.Query(context.Background(), audit.Filter{ShortURL: "abc"})
+	require.NoError(t, err)
+	assert.Empty(t, events, "delete recorded before it was applied")
+
+	// the link is still live, deleting it again queues a second deletion
+	remove()
+	urlStorage.apply()
+
+	events, err = sink.Query(context.Background(), audit.Filter{ShortURL: "abc"})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, audit.ActionDelete, events[0].Action)
+	assert.Equal(t, "user1", events[0].ActorID)
+	assert.Equal(t, "10.0.0.7", events[0].ClientIP)
+}
+
+// failingStore refuses to store one long URL.
+type failingStore struct {
+	*mocks.Mock
+	longURL string
+}
+
+func (store *failingStore) StoreURL(ctx context.Context, record storage.URLRecord) error {
+	if record.LongURL == store.longURL {
+		return errors.New("storage failure")
+	}
+
+	return store.Mock.StoreURL(ctx, record)
+}
+
+func TestAuditFailedBatch(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := &failingStore{Mock: mocks.NewStorageMock(), longURL: "https://broken.example.com"}
+	urlService := service.NewURLService(urlStorage, &cfg)
+
+	sink, err := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	defer sink.Finalize()
+	urlService.SetAudit(sink)
+	handler := NewURLHandler(urlService, &cfg)
+
+	batch := func(urls ...string) int {
+		items := make([]string, 0, len(urls))
+		for i, longURL := range urls {
+			items = append(items, fmt.Sprintf(`{"correlation_id":"%d","original_url":"%s"}`, i, longURL))
+		}
+
+		rqs := httptest.NewRequest(http.MethodPost, "/api/shorten/batch", strings.NewReader("["+strings.Join(items, ",")+"]"))
+		rqs.Header.Set("Content-Type", "application/json")
+		rsp := httptest.NewRecorder()
+		handler.ProcessPostURLBatch(rsp, withUser(rqs, "user1"))
+		return rsp.Code
+	}
+
+	// the batch is not committed, its first link does not exist
+	assert.Equal(t, http.StatusInternalServerError, batch("https://first.example.com", "https://broken.example.com"))
+	events, err := sink.Query(context.Background(), audit.Filter{})
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	assert.Equal(t, http.StatusCreated, batch("https://first.example.com", "https://second.example.com"))
+	events, err = sink.Query(context.Background(), audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for _, event := range events {
+		assert.Equal(t, audit.ActionCreate, event.Action)
+		assert.Equal(t, "user1", event.ActorID)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.AdminUserIDs = "root"
+	urlStorage := mocks.NewStorageMock()
+	urlService := service.NewURLService(urlStorage, &cfg)
+
+	sink, err := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	defer sink.Finalize()
+	urlService.SetAudit(sink)
+	handler := NewURLHandler(urlService, &cfg)
+
+	router := chi.NewRouter()
+	router.Post("/api/shorten", handler.ProcessPostURLObject)
+	router.Patch("/api/user/urls/{URL}", handler.ProcessPatchMetadata)
+	router.Delete("/api/user/urls", handler.ProcessDeleteUrls)
+	router.Post("/api/admin/urls/{URL}/disable", handler.ProcessAdminDisableURL)
+	router.Post("/api/admin/urls/{URL}/enable", handler.ProcessAdminEnableURL)
+	router.Put("/api/admin/urls/{URL}/owner", handler.ProcessAdminPutOwner)
+	router.Get("/api/admin/audit", handler.ProcessAdminGetAudit)
+
+	call := func(userID, method, target, body string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(method, target, strings.NewReader(body))
+		if body != "" {
+			rqs.Header.Set("Content-Type", "application/json")
+		}
+		rqs = rqs.WithContext(audit.WithClientIP(rqs.Context(), "10.0.0.7"))
+
+		rsp := httptest.NewRecorder()
+		router.ServeHTTP(rsp, withUser(rqs, userID))
+		return rsp
+	}
+
+	rsp := call("alice", http.MethodPost, "/api/shorten", `{"url":"https://audit.example.com"}`)
+	require.Equal(t, http.StatusCreated, rsp.Code)
+	var info ShortURLInfo
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &info))
+	code := strings.TrimPrefix(info.Result, "http://localhost:8080/")
+
+	require.Equal(t, http.StatusOK, call("alice", http.MethodPatch, "/api/user/urls/"+code, `{"title":"Audit"}`).Code)
+	require.Equal(t, http.StatusForbidden, call("mallory", http.MethodPatch, "/api/user/urls/"+code, `{"title":"Mine"}`).Code)
+	require.Equal(t, http.StatusOK, call("root", http.MethodPost, "/api/admin/urls/"+code+"/disable", `{"reason":"spam"}`).Code)
+	require.Equal(t, http.StatusOK, call("root", http.MethodPost, "/api/admin/urls/"+code+"/enable", "").Code)
+	require.Equal(t, http.StatusOK, call("root", http.MethodPut, "/api/admin/urls/"+code+"/owner", `{"user_id":"bob"}`).Code)
+	require.Equal(t, http.StatusAccepted, call("bob", http.MethodDelete, "/api/user/urls", `["`+code+`"]`).Code)
+
+	query := func(params string) []audit.Event {
+		rsp := call("root", http.MethodGet, "/api/admin/audit?"+params, "")
+		require.Equal(t, http.StatusOK, rsp.Code)
+
+		var events []audit.Event
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &events))
+		return events
+	}
+
+	actions := func(events []audit.Event) []string {
+		result := make([]string, 0, len(events))
+		for _, event := range events {
+			result = append(result, event.Action)
+		}
+		return result
+	}
+
+	events := query("code=" + code)
+	assert.Equal(t, []string{
+		audit.ActionDelete, audit.ActionTransfer, audit.ActionRestore, audit.ActionDisable, audit.ActionEdit, audit.ActionCreate,
+	}, actions(events))
+
+	create := events[len(events)-1]
+	assert.Equal(t, "alice", create.ActorID)
+	assert.Equal(t, "10.0.0.7", create.ClientIP)
+	assert.Equal(t, "https://audit.example.com", create.After["long_url"])
+
+	edit := events[len(events)-2]
+	assert.Equal(t, map[string]any{"title": ""}, edit.Before)
+	assert.Equal(t, map[string]any{"title": "Audit"}, edit.After)
+
+	transfer := events[1]
+	assert.Equal(t, "root", transfer.ActorID)
+	assert.Equal(t, map[string]any{"user_id": "alice"}, transfer.Before)
+	assert.Equal(t, map[string]any{"user_id": "bob"}, transfer.After)
+
+	assert.Equal(t, []string{audit.ActionDelete}, actions(query("user=bob")))
+	assert.Len(t, query("user=root"), 3)
+	assert.Len(t, query("limit=2"), 2)
+	assert.Empty(t, query("to="+create.Time.Format(time.RFC3339Nano)))
+	assert.Len(t, query("from="+create.Time.Format(time.RFC3339Nano)), 6)
+
+	assert.Equal(t, http.StatusBadRequest, call("root", http.MethodGet, "/api/admin/audit?from=yesterday", "").Code)
+	assert.Equal(t, http.StatusForbidden, call("alice", http.MethodGet, "/api/admin/audit?code="+code, "").Code)
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rvkarpov/url_shortener/internal/service"
+)
+
+func (handler *URLHandler) ProcessPatchMetadata(rsp http.ResponseWriter, rqs *http.Request) {
+	if rqs.Header.Get("Content-Type") != "application/json" {
+		http.Error(rsp, "incorrect content type", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(rqs.Body)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var info MetadataInfo
+	if err = json.Unmarshal(buf.Bytes(), &info); err != nil {
+		http.Error(rsp, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	shortURL := chi.URLParam(rqs, "URL")
+	log.Printf("New PATCH request with metadata for short URL: %s", shortURL)
+
+	record, err := handler.urlService.UpdateMetadata(rqs.Context(), shortURL, service.MetadataUpdate{
+		Title: info.Title,
+		Note:  info.Note,
+		Tags:  info.Tags,
+		Team:  info.Team,
+	})
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	out, err := json.Marshal(handler.newURLSummaryItem(record))
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(out)
+}
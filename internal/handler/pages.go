@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var pages = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+type previewPage struct {
+	ShortURL  string
+	LongURL   string
+	Title     string
+	ImageURL  string
+	CreatedAt time.Time
+}
+
+type passwordPage struct {
+	ShortURL string
+	Error    string
+}
+
+type comingSoonPage struct {
+	ShortURL  string
+	Title     string
+	NotBefore time.Time
+}
+
+func renderPage(rsp http.ResponseWriter, status int, name string, data any) {
+	var buf bytes.Buffer
+	if err := pages.ExecuteTemplate(&buf, name, data); err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rsp.WriteHeader(status)
+	rsp.Write(buf.Bytes())
+}
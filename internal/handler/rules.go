@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rvkarpov/url_shortener/internal/rules"
+)
+
+func (handler *URLHandler) ProcessGetRules(rsp http.ResponseWriter, rqs *http.Request) {
+	redirectRules, err := handler.urlService.GetRules(rqs.Context(), chi.URLParam(rqs, "URL"))
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	if redirectRules == nil {
+		redirectRules = []rules.Rule{}
+	}
+
+	out, err := json.Marshal(redirectRules)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(out)
+}
+
+func (handler *URLHandler) ProcessPutRules(rsp http.ResponseWriter, rqs *http.Request) {
+	if rqs.Header.Get("Content-Type") != "application/json" {
+		http.Error(rsp, "incorrect content type", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(rqs.Body)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var redirectRules []rules.Rule
+	if err = json.Unmarshal(buf.Bytes(), &redirectRules); err != nil {
+		http.Error(rsp, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	shortURL := chi.URLParam(rqs, "URL")
+	log.Printf("New PUT request with rules for short URL: %s", shortURL)
+
+	if err := handler.urlService.SetRules(rqs.Context(), shortURL, redirectRules); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (handler *URLHandler) ProcessGetUser(rsp http.ResponseWriter, rqs *http.Request) {
+	userID, account, err := handler.urlService.CurrentUser(rqs.Context())
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	info := UserInfo{UserID: userID}
+	if account != nil {
+		info.Email = account.Email
+	}
+
+	writeJSON(rsp, http.StatusOK, info)
+}
+
+func (handler *URLHandler) ProcessPostTeam(rsp http.ResponseWriter, rqs *http.Request) {
+	var request TeamRequest
+	if !readJSON(rsp, rqs, &request) {
+		return
+	}
+
+	membership, err := handler.urlService.CreateTeam(rqs.Context(), request.Name)
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	log.Printf("Created team: %s", membership.Team.ID)
+	writeJSON(rsp, http.StatusCreated, newTeamInfo(membership))
+}
+
+func (handler *URLHandler) ProcessGetTeams(rsp http.ResponseWriter, rqs *http.Request) {
+	memberships, err := handler.urlService.GetTeams(rqs.Context())
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	infos := make([]TeamInfo, 0, len(memberships))
+	for _, membership := range memberships {
+		infos = append(infos, newTeamInfo(&membership))
+	}
+
+	writeJSON(rsp, http.StatusOK, infos)
+}
+
+func (handler *URLHandler) ProcessGetMembers(rsp http.ResponseWriter, rqs *http.Request) {
+	members, err := handler.urlService.GetMembers(rqs.Context(), chi.URLParam(rqs, "id"))
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	infos := make([]MemberInfo, 0, len(members))
+	for _, member := range members {
+		infos = append(infos, MemberInfo{UserID: member.UserID, Role: member.Role})
+	}
+
+	writeJSON(rsp, http.StatusOK, infos)
+}
+
+func (handler *URLHandler) ProcessPutMember(rsp http.ResponseWriter, rqs *http.Request) {
+	var request MemberRequest
+	if !readJSON(rsp, rqs, &request) {
+		return
+	}
+
+	teamID, userID := chi.URLParam(rqs, "id"), chi.URLParam(rqs, "userID")
+	log.Printf("New PUT request for member %s of team %s", userID, teamID)
+
+	if err := handler.urlService.SetMember(rqs.Context(), teamID, userID, request.Role); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, MemberInfo{UserID: userID, Role: request.Role})
+}
+
+func (handler *URLHandler) ProcessDeleteMember(rsp http.ResponseWriter, rqs *http.Request) {
+	teamID, userID := chi.URLParam(rqs, "id"), chi.URLParam(rqs, "userID")
+	log.Printf("New DELETE request for member %s of team %s", userID, teamID)
+
+	if err := handler.urlService.RemoveMember(rqs.Context(), teamID, userID); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
+
+// readJSON decodes the JSON body of the request into out, it answers the
+// request itself and returns false if that fails.
+func readJSON(rsp http.ResponseWriter, rqs *http.Request, out any) bool {
+	if rqs.Header.Get("Content-Type") != "application/json" {
+		http.Error(rsp, "incorrect content type", http.StatusBadRequest)
+		return false
+	}
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rqs.Body); err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), out); err != nil {
+		http.Error(rsp, "invalid json", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(rsp http.ResponseWriter, status int, value any) {
+	out, err := json.Marshal(value)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(status)
+	rsp.Write(out)
+}
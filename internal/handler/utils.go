@@ -1,7 +1,92 @@
 package handler
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/service"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// LinkParams are the optional link attributes accepted by the JSON creation endpoints.
+type LinkParams struct {
+	Title        string   `json:"title,omitempty"`
+	Note         string   `json:"note,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	RedirectCode int      `json:"redirect_code,omitempty"`
+
+	Passthrough         bool   `json:"passthrough,omitempty"`
+	PassthroughConflict string `json:"passthrough_conflict,omitempty"`
+
+	UTMTemplate string `json:"utm_template,omitempty"`
+
+	Password string `json:"password,omitempty"`
+
+	MaxClicks int `json:"max_clicks,omitempty"`
+
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	FallbackURL string     `json:"fallback_url,omitempty"`
+
+	Team string `json:"team,omitempty"`
+
+	OwnCode bool `json:"own_code,omitempty"`
+}
+
+func (params *LinkParams) options() (service.LinkOptions, error) {
+	if params.RedirectCode != 0 && !config.IsRedirectCode(params.RedirectCode) {
+		return service.LinkOptions{}, fmt.Errorf("unsupported redirect code %d", params.RedirectCode)
+	}
+
+	if params.PassthroughConflict != "" && !config.IsPassthroughConflict(params.PassthroughConflict) {
+		return service.LinkOptions{}, fmt.Errorf("unsupported passthrough conflict rule '%s'", params.PassthroughConflict)
+	}
+
+	if params.MaxClicks < 0 {
+		return service.LinkOptions{}, fmt.Errorf("max_clicks must not be negative")
+	}
+
+	if params.NotBefore != nil && params.NotAfter != nil && !params.NotAfter.After(*params.NotBefore) {
+		return service.LinkOptions{}, fmt.Errorf("not_after must be later than not_before")
+	}
+
+	opts := service.LinkOptions{
+		Title:        params.Title,
+		Note:         params.Note,
+		Tags:         params.Tags,
+		RedirectCode: params.RedirectCode,
+
+		Passthrough:         params.Passthrough,
+		PassthroughConflict: params.PassthroughConflict,
+
+		UTMTemplate: params.UTMTemplate,
+
+		Password: params.Password,
+
+		MaxClicks: params.MaxClicks,
+
+		FallbackURL: params.FallbackURL,
+
+		TeamID: params.Team,
+
+		OwnCode: params.OwnCode,
+	}
+
+	if params.NotBefore != nil {
+		opts.NotBefore = *params.NotBefore
+	}
+
+	if params.NotAfter != nil {
+		opts.NotAfter = *params.NotAfter
+	}
+
+	return opts, nil
+}
+
 type OriginURLInfo struct {
 	URL string `json:"url"`
+	LinkParams
 }
 
 type ShortURLInfo struct {
@@ -11,9 +96,176 @@ type ShortURLInfo struct {
 type OriginURLBatchItem struct {
 	ID  string `json:"correlation_id"`
 	URL string `json:"original_url"`
+	LinkParams
 }
 
 type ShortURLBatchItem struct {
 	ID  string `json:"correlation_id"`
 	URL string `json:"short_url"`
 }
+
+type URLSummaryItem struct {
+	ShortURL    string     `json:"short_url"`
+	LongURL     string     `json:"original_url"`
+	Title       string     `json:"title,omitempty"`
+	ImageURL    string     `json:"image_url,omitempty"`
+	Note        string     `json:"note,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Team        string     `json:"team,omitempty"`
+	LastStatus  int        `json:"last_status,omitempty"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+	Broken      bool       `json:"broken,omitempty"`
+	UTMTemplate string     `json:"utm_template,omitempty"`
+	MaxClicks   int        `json:"max_clicks,omitempty"`
+	ClickCount  int        `json:"click_count,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+
+	Disabled       bool   `json:"disabled,omitempty"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+}
+
+type UTMTemplateInfo struct {
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params"`
+}
+
+// MetadataInfo updates the link attributes present in the request.
+type MetadataInfo struct {
+	Title *string   `json:"title"`
+	Note  *string   `json:"note"`
+	Tags  *[]string `json:"tags"`
+	Team  *string   `json:"team"`
+}
+
+type VariantsInfo struct {
+	Variants []storage.Variant `json:"variants"`
+	Sticky   bool              `json:"sticky"`
+}
+
+type VariantStatsItem struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	Clicks int    `json:"clicks"`
+}
+
+type ClickStatsInfo struct {
+	Clicks   int                `json:"clicks"`
+	Variants []VariantStatsItem `json:"variants,omitempty"`
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// APIKeyInfo describes an API key, Key is only filled in when it is created.
+type APIKeyInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	Revoked   bool       `json:"revoked,omitempty"`
+	Key       string     `json:"key,omitempty"`
+}
+
+func newAPIKeyInfo(key *storage.APIKey) APIKeyInfo {
+	info := APIKeyInfo{
+		ID:        key.ID,
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		Revoked:   key.Revoked,
+	}
+
+	if !key.LastUsed.IsZero() {
+		lastUsed := key.LastUsed
+		info.LastUsed = &lastUsed
+	}
+
+	return info
+}
+
+type TeamRequest struct {
+	Name string `json:"name"`
+}
+
+// TeamInfo describes a team of the user, Role is the role of the user in it.
+type TeamInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newTeamInfo(membership *service.Membership) TeamInfo {
+	return TeamInfo{
+		ID:        membership.Team.ID,
+		Name:      membership.Team.Name,
+		Role:      membership.Role,
+		CreatedAt: membership.Team.CreatedAt,
+	}
+}
+
+type MemberInfo struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type MemberRequest struct {
+	Role string `json:"role"`
+}
+
+// UserInfo identifies the user of the session, Email is set for accounts.
+type UserInfo struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email,omitempty"`
+}
+
+// AdminURLItem describes any link for operators.
+type AdminURLItem struct {
+	ShortURL       string    `json:"short_url"`
+	Code           string    `json:"code"`
+	LongURL        string    `json:"original_url"`
+	UserID         string    `json:"user_id"`
+	Team           string    `json:"team,omitempty"`
+	Deleted        bool      `json:"deleted,omitempty"`
+	Blocked        bool      `json:"blocked,omitempty"`
+	Disabled       bool      `json:"disabled,omitempty"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type DisableRequest struct {
+	Reason string `json:"reason"`
+}
+
+type DisableUserInfo struct {
+	Disabled int `json:"disabled"`
+}
+
+type OwnerRequest struct {
+	UserID string `json:"user_id"`
+}
+
+type InternalStatsInfo struct {
+	URLs  int `json:"urls"`
+	Users int `json:"users"`
+}
+
+// QuotaRequest overrides the link quotas of a user, a missing limit keeps the configured one.
+type QuotaRequest struct {
+	MaxActive *int `json:"max_active"`
+	MaxDaily  *int `json:"max_daily"`
+}
+
+// QuotaInfo shows the link quotas of a user, 0 means unlimited, next to the
+// links the user has and created within 24 hours.
+type QuotaInfo struct {
+	MaxActive int  `json:"max_active"`
+	MaxDaily  int  `json:"max_daily"`
+	Custom    bool `json:"custom"`
+	Active    int  `json:"active"`
+	Daily     int  `json:"daily"`
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (handler *URLHandler) ProcessGetUTMTemplates(rsp http.ResponseWriter, rqs *http.Request) {
+	templates, err := handler.urlService.GetUTMTemplates(rqs.Context())
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	result := make([]UTMTemplateInfo, 0, len(templates))
+	for _, template := range templates {
+		result = append(result, UTMTemplateInfo{Name: template.Name, Params: template.Params})
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(out)
+}
+
+func (handler *URLHandler) ProcessPutUTMTemplate(rsp http.ResponseWriter, rqs *http.Request) {
+	if rqs.Header.Get("Content-Type") != "application/json" {
+		http.Error(rsp, "incorrect content type", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(rqs.Body)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var params map[string]string
+	if err = json.Unmarshal(buf.Bytes(), &params); err != nil {
+		http.Error(rsp, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	name := chi.URLParam(rqs, "name")
+	log.Printf("New PUT request with UTM template: %s", name)
+
+	if err := handler.urlService.StoreUTMTemplate(rqs.Context(), name, params); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	out, err := json.Marshal(UTMTemplateInfo{Name: name, Params: params})
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(out)
+}
+
+func (handler *URLHandler) ProcessDeleteUTMTemplate(rsp http.ResponseWriter, rqs *http.Request) {
+	name := chi.URLParam(rqs, "name")
+	log.Printf("New DELETE request with UTM template: %s", name)
+
+	if err := handler.urlService.DeleteUTMTemplate(rqs.Context(), name); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
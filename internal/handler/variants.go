@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+const stickyVariantMaxAge = 30 * 24 * time.Hour
+
+func stickyVariantCookie(shortURL string) string {
+	return "ab_" + shortURL
+}
+
+// stickyVariant returns the variant index remembered for the visitor or -1.
+func stickyVariant(rqs *http.Request, record *storage.URLRecord) int {
+	if !record.StickyVariants {
+		return -1
+	}
+
+	cookie, err := rqs.Cookie(stickyVariantCookie(record.ShortURL))
+	if err != nil {
+		return -1
+	}
+
+	variant, err := strconv.Atoi(cookie.Value)
+	if err != nil {
+		return -1
+	}
+
+	return variant
+}
+
+func setStickyVariant(rsp http.ResponseWriter, record *storage.URLRecord, variant int) {
+	http.SetCookie(rsp, &http.Cookie{
+		Name:     stickyVariantCookie(record.ShortURL),
+		Value:    strconv.Itoa(variant),
+		Path:     "/" + record.ShortURL,
+		MaxAge:   int(stickyVariantMaxAge.Seconds()),
+		HttpOnly: true,
+	})
+}
+
+func (handler *URLHandler) ProcessPutVariants(rsp http.ResponseWriter, rqs *http.Request) {
+	if rqs.Header.Get("Content-Type") != "application/json" {
+		http.Error(rsp, "incorrect content type", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(rqs.Body)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var info VariantsInfo
+	if err = json.Unmarshal(buf.Bytes(), &info); err != nil {
+		http.Error(rsp, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	shortURL := chi.URLParam(rqs, "URL")
+	log.Printf("New PUT request with variants for short URL: %s", shortURL)
+
+	if err := handler.urlService.SetVariants(rqs.Context(), shortURL, info.Variants, info.Sticky); err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	rsp.WriteHeader(http.StatusNoContent)
+}
+
+func (handler *URLHandler) ProcessGetStats(rsp http.ResponseWriter, rqs *http.Request) {
+	record, stats, err := handler.urlService.GetClickStats(rqs.Context(), chi.URLParam(rqs, "URL"))
+	if err != nil {
+		http.Error(rsp, err.Error(), errorStatus(err))
+		return
+	}
+
+	var info ClickStatsInfo
+	for _, clicks := range stats {
+		info.Clicks += clicks
+	}
+
+	for _, variant := range record.Variants {
+		info.Variants = append(info.Variants, VariantStatsItem{
+			URL:    variant.URL,
+			Weight: variant.Weight,
+			Clicks: stats[variant.URL],
+		})
+	}
+
+	out, err := json.Marshal(info)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rsp.Header().Add("Content-Type", "application/json")
+	rsp.WriteHeader(http.StatusOK)
+	rsp.Write(out)
+}
@@ -0,0 +1,200 @@
+package healthcheck
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/policy"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// hostLimiter spaces out requests to the same host by at least interval.
+type hostLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     map[string]time.Time
+}
+
+func (limiter *hostLimiter) wait(ctx context.Context, host string) error {
+	limiter.mu.Lock()
+	now := time.Now()
+	slot := limiter.next[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	limiter.next[host] = slot.Add(limiter.interval)
+	limiter.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prune forgets the hosts whose next slot has passed, they may be requested
+// right away anyway.
+func (limiter *hostLimiter) prune(now time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	for host, slot := range limiter.next {
+		if !slot.After(now) {
+			delete(limiter.next, host)
+		}
+	}
+}
+
+// Checker periodically requests stored target URLs and records their last
+// status code. A status of 0 means the target could not be reached.
+type Checker struct {
+	urlStorage storage.URLStorage
+	client     *http.Client
+	interval   time.Duration
+	slots      chan struct{}
+	limiter    *hostLimiter
+	stopChan   chan struct{}
+}
+
+func (checker *Checker) RunAsync() {
+	ticker := time.NewTicker(checker.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			checker.CheckAll(context.Background())
+		case <-checker.stopChan:
+			return
+		}
+	}
+}
+
+func (checker *Checker) Finalize() {
+	close(checker.stopChan)
+}
+
+// CheckAll checks the links of each host in turn, hosts in parallel. Waiting
+// for the turn of a host takes no request slot, so links to one host do not
+// hold up the others.
+func (checker *Checker) CheckAll(ctx context.Context) {
+	records, err := checker.urlStorage.ListURLs(ctx)
+	if err != nil {
+		log.Printf("Failed to list URLs for health check: %v", err)
+		return
+	}
+
+	checker.limiter.prune(time.Now())
+
+	byHost := make(map[string][]storage.URLRecord)
+	for _, record := range records {
+		if record.Deleted {
+			continue
+		}
+
+		host := ""
+		if parsedURL, err := url.Parse(record.LongURL); err == nil {
+			host = strings.ToLower(parsedURL.Host)
+		}
+		byHost[host] = append(byHost[host], record)
+	}
+
+	var wg sync.WaitGroup
+	for _, hostRecords := range byHost {
+		wg.Add(1)
+		go func(hostRecords []storage.URLRecord) {
+			defer wg.Done()
+
+			for _, record := range hostRecords {
+				status, err := checker.check(ctx, record.LongURL)
+				if err != nil {
+					log.Printf("Health check of %s failed: %v", record.LongURL, err)
+				}
+
+				if err := checker.urlStorage.SetHealth(ctx, record.ShortURL, status, time.Now()); err != nil {
+					log.Printf("Failed to store health status of %s: %v", record.ShortURL, err)
+				}
+			}
+		}(hostRecords)
+	}
+
+	wg.Wait()
+}
+
+func (checker *Checker) check(ctx context.Context, longURL string) (int, error) {
+	parsedURL, err := url.Parse(longURL)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checker.limiter.wait(ctx, strings.ToLower(parsedURL.Host)); err != nil {
+		return 0, err
+	}
+
+	status, err := checker.request(ctx, http.MethodHead, longURL)
+	if err != nil {
+		return 0, err
+	}
+
+	// some servers do not implement HEAD, fall back to GET for them
+	if status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+		if err := checker.limiter.wait(ctx, strings.ToLower(parsedURL.Host)); err != nil {
+			return 0, err
+		}
+
+		return checker.request(ctx, http.MethodGet, longURL)
+	}
+
+	return status, nil
+}
+
+// request takes one of the request slots, which bound the simultaneous requests.
+func (checker *Checker) request(ctx context.Context, method, longURL string) (int, error) {
+	rqs, err := http.NewRequestWithContext(ctx, method, longURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case checker.slots <- struct{}{}:
+		defer func() { <-checker.slots }()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	rsp, err := checker.client.Do(rqs)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(rsp.Body, 64*1024))
+	return rsp.StatusCode, nil
+}
+
+func NewChecker(urlStorage storage.URLStorage, cfg *config.Config) *Checker {
+	concurrency := cfg.HealthCheckConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	return &Checker{
+		urlStorage: urlStorage,
+		client:     policy.NewClient(cfg.HealthCheckTimeout, cfg.BlockPrivateIPs),
+		interval:   cfg.HealthCheckInterval,
+		slots:      make(chan struct{}, concurrency),
+		limiter:    &hostLimiter{interval: cfg.HealthCheckHostInterval, next: make(map[string]time.Time)},
+		stopChan:   make(chan struct{}),
+	}
+}
@@ -0,0 +1,148 @@
+package healthcheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/mocks"
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAll(t *testing.T) {
+	okServer := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.WriteHeader(http.StatusOK)
+	}))
+	defer okServer.Close()
+
+	headlessServer := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, rqs *http.Request) {
+		if rqs.Method == http.MethodHead {
+			rsp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rsp.WriteHeader(http.StatusNoContent)
+	}))
+	defer headlessServer.Close()
+
+	missingServer := httptest.NewServer(http.NotFoundHandler())
+	defer missingServer.Close()
+
+	downServer := httptest.NewServer(http.NotFoundHandler())
+	downServer.Close()
+
+	storage := mocks.NewStorageMock()
+	storage.AddTestData("ok", okServer.URL)
+	storage.AddTestData("headless", headlessServer.URL+"/page")
+	storage.AddTestData("missing", missingServer.URL+"/gone")
+	storage.AddTestData("down", downServer.URL)
+
+	cfg := testutils.LoadTestConfig()
+	cfg.BlockPrivateIPs = false // the test servers listen on loopback
+	cfg.HealthCheckConcurrency = 2
+	cfg.HealthCheckTimeout = time.Second
+	checker := NewChecker(storage, &cfg)
+	checker.CheckAll(context.Background())
+
+	tests := []struct {
+		shortURL string
+		status   int
+		broken   bool
+	}{
+		{shortURL: "ok", status: http.StatusOK, broken: false},
+		{shortURL: "headless", status: http.StatusNoContent, broken: false},
+		{shortURL: "missing", status: http.StatusNotFound, broken: true},
+		{shortURL: "down", status: 0, broken: true},
+	}
+	for _, test := range tests {
+		t.Run(test.shortURL, func(t *testing.T) {
+			record, err := storage.TryGetURL(context.Background(), test.shortURL)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.status, record.LastStatus)
+			assert.False(t, record.LastChecked.IsZero())
+			assert.Equal(t, test.broken, record.Broken())
+		})
+	}
+}
+
+func TestCheckPrivateTarget(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, rqs *http.Request) {
+		requested = true
+		rsp.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	storage := mocks.NewStorageMock()
+	storage.AddTestData("private", server.URL)
+
+	cfg := testutils.LoadTestConfig()
+	cfg.HealthCheckTimeout = time.Second
+	checker := NewChecker(storage, &cfg)
+	checker.CheckAll(context.Background())
+
+	assert.False(t, requested, "health check reached a private network")
+
+	record, err := storage.TryGetURL(context.Background(), "private")
+	require.NoError(t, err)
+	assert.True(t, record.Broken())
+}
+
+func TestHostLimiter(t *testing.T) {
+	limiter := &hostLimiter{interval: 50 * time.Millisecond, next: make(map[string]time.Time)}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.wait(context.Background(), "foo.com"))
+	}
+	require.NoError(t, limiter.wait(context.Background(), "bar.com"))
+
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestCheckAllSlowHost(t *testing.T) {
+	slowServer := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.WriteHeader(http.StatusOK)
+	}))
+	defer slowServer.Close()
+
+	start := time.Now()
+	var otherChecked time.Duration
+	otherServer := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, rqs *http.Request) {
+		otherChecked = time.Since(start)
+		rsp.WriteHeader(http.StatusOK)
+	}))
+	defer otherServer.Close()
+
+	storage := mocks.NewStorageMock()
+	for _, shortURL := range []string{"slow1", "slow2", "slow3"} {
+		storage.AddTestData(shortURL, slowServer.URL+"/"+shortURL)
+	}
+	storage.AddTestData("other", otherServer.URL)
+
+	cfg := testutils.LoadTestConfig()
+	cfg.BlockPrivateIPs = false // the test servers listen on loopback
+	cfg.HealthCheckConcurrency = 1
+	cfg.HealthCheckTimeout = time.Second
+	cfg.HealthCheckHostInterval = 200 * time.Millisecond
+	checker := NewChecker(storage, &cfg)
+	checker.CheckAll(context.Background())
+
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Less(t, otherChecked, 200*time.Millisecond, "other host waited for the slow one")
+}
+
+func TestHostLimiterPrune(t *testing.T) {
+	limiter := &hostLimiter{interval: time.Hour, next: make(map[string]time.Time)}
+
+	require.NoError(t, limiter.wait(context.Background(), "foo.com"))
+	limiter.next["bar.com"] = time.Now().Add(-time.Minute)
+
+	limiter.prune(time.Now())
+	assert.Contains(t, limiter.next, "foo.com")
+	assert.NotContains(t, limiter.next, "bar.com")
+}
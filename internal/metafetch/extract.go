@@ -0,0 +1,74 @@
+package metafetch
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Metadata is what a target page says about itself.
+type Metadata struct {
+	Title   string
+	OGTitle string
+	OGImage string
+}
+
+// DisplayTitle prefers the Open Graph title, pages often pad <title> with the site name.
+func (metadata *Metadata) DisplayTitle() string {
+	if metadata.OGTitle != "" {
+		return metadata.OGTitle
+	}
+
+	return metadata.Title
+}
+
+// Extract reads <title> and the og:title and og:image meta tags from the
+// document head, it stops at <body> since they are not allowed past it.
+func Extract(r io.Reader) Metadata {
+	var metadata Metadata
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return metadata
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = metadata.Title == ""
+			case "meta":
+				readMeta(&metadata, token.Attr)
+			case "body":
+				return metadata
+			}
+		case html.EndTagToken:
+			inTitle = false
+		case html.TextToken:
+			if inTitle {
+				metadata.Title = strings.Join(strings.Fields(string(tokenizer.Text())), " ")
+			}
+		}
+	}
+}
+
+func readMeta(metadata *Metadata, attrs []html.Attribute) {
+	var property, content string
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "property", "name":
+			property = strings.ToLower(attr.Val)
+		case "content":
+			content = strings.TrimSpace(attr.Val)
+		}
+	}
+
+	switch {
+	case property == "og:title" && metadata.OGTitle == "":
+		metadata.OGTitle = content
+	case property == "og:image" && metadata.OGImage == "":
+		metadata.OGImage = content
+	}
+}
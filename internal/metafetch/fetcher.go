@@ -0,0 +1,125 @@
+package metafetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/policy"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+type job struct {
+	shortURL string
+	longURL  string
+}
+
+// Fetcher loads the target pages of new links in the background and stores
+// their title and preview image with the link.
+type Fetcher struct {
+	urlStorage storage.URLStorage
+	client     *http.Client
+	maxBytes   int64
+	workers    int
+	queue      chan job
+	wg         sync.WaitGroup
+}
+
+func (fetcher *Fetcher) RunAsync() {
+	for i := 0; i < fetcher.workers; i++ {
+		fetcher.wg.Add(1)
+		go func() {
+			defer fetcher.wg.Done()
+			for job := range fetcher.queue {
+				fetcher.Fetch(context.Background(), job.shortURL, job.longURL)
+			}
+		}()
+	}
+}
+
+// Finalize stops accepting links and waits for the queued ones.
+func (fetcher *Fetcher) Finalize() {
+	close(fetcher.queue)
+	fetcher.wg.Wait()
+}
+
+// Enqueue schedules fetching of the link target, links are dropped while the queue is full.
+func (fetcher *Fetcher) Enqueue(shortURL, longURL string) {
+	select {
+	case fetcher.queue <- job{shortURL: shortURL, longURL: longURL}:
+	default:
+		log.Printf("Metadata fetch queue is full, skipping %s", shortURL)
+	}
+}
+
+func (fetcher *Fetcher) Fetch(ctx context.Context, shortURL, longURL string) {
+	metadata, err := fetcher.load(ctx, longURL)
+	if err != nil {
+		log.Printf("Failed to fetch metadata of %s: %v", longURL, err)
+		return
+	}
+
+	if metadata.DisplayTitle() == "" && metadata.OGImage == "" {
+		return
+	}
+
+	if err := fetcher.urlStorage.SetPageMetadata(ctx, shortURL, metadata.DisplayTitle(), metadata.OGImage); err != nil {
+		log.Printf("Failed to store metadata of %s: %v", shortURL, err)
+	}
+}
+
+func (fetcher *Fetcher) load(ctx context.Context, longURL string) (*Metadata, error) {
+	rqs, err := http.NewRequestWithContext(ctx, http.MethodGet, longURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	rqs.Header.Set("Accept", "text/html")
+
+	rsp, err := fetcher.client.Do(rqs)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", rsp.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rsp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unexpected content type '%s'", mediaType)
+	}
+
+	metadata := Extract(io.LimitReader(rsp.Body, fetcher.maxBytes))
+
+	// the image may be given relative to the page
+	if metadata.OGImage != "" {
+		if image, err := rsp.Request.URL.Parse(metadata.OGImage); err == nil && (image.Scheme == "http" || image.Scheme == "https") {
+			metadata.OGImage = image.String()
+		} else {
+			metadata.OGImage = ""
+		}
+	}
+
+	return &metadata, nil
+}
+
+func NewFetcher(urlStorage storage.URLStorage, cfg *config.Config) *Fetcher {
+	workers := cfg.MetadataFetchWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	return &Fetcher{
+		urlStorage: urlStorage,
+		client:     policy.NewClient(cfg.MetadataFetchTimeout, cfg.BlockPrivateIPs),
+		maxBytes:   cfg.MetadataFetchMaxBytes,
+		workers:    workers,
+		queue:      make(chan job, cfg.MetadataFetchQueue),
+	}
+}
@@ -0,0 +1,117 @@
+package metafetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/mocks"
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     string
+		expected Metadata
+	}{
+		{
+			name:     "title",
+			page:     "<html><head><title>\n  Foo &amp; Bar\n</title></head><body></body></html>",
+			expected: Metadata{Title: "Foo & Bar"},
+		},
+		{
+			name: "open graph",
+			page: `<head><title>Foo | Site</title>
+				<meta property="og:title" content="Foo">
+				<meta property="og:image" content="/img/foo.png"/></head>`,
+			expected: Metadata{Title: "Foo | Site", OGTitle: "Foo", OGImage: "/img/foo.png"},
+		},
+		{
+			name:     "body is ignored",
+			page:     "<head></head><body><title>Not a title</title></body>",
+			expected: Metadata{},
+		},
+		{
+			name:     "svg title is not the page title",
+			page:     "<head><title>Foo</title></head><svg><title>Icon</title></svg>",
+			expected: Metadata{Title: "Foo"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, Extract(strings.NewReader(test.page)))
+		})
+	}
+}
+
+func TestFetcher(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article", func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rsp.Write([]byte(`<html><head><title>Article | Blog</title>
+			<meta property="og:title" content="Article">
+			<meta property="og:image" content="/cover.jpg"></head></html>`))
+	})
+	mux.HandleFunc("/huge", func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.Header().Set("Content-Type", "text/html")
+		rsp.Write([]byte("<html><head><!--" + strings.Repeat("x", 4096) + "--><title>Too far</title></head></html>"))
+	})
+	mux.HandleFunc("/image", func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.Header().Set("Content-Type", "image/png")
+		rsp.Write([]byte("<title>Not a page</title>"))
+	})
+	mux.HandleFunc("/slow", func(rsp http.ResponseWriter, rqs *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		rsp.Header().Set("Content-Type", "text/html")
+		rsp.Write([]byte("<title>Slow</title>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	urlStorage := mocks.NewStorageMock()
+	urlStorage.AddTestData("article", server.URL+"/article")
+	urlStorage.AddTestData("huge", server.URL+"/huge")
+	urlStorage.AddTestData("image", server.URL+"/image")
+	urlStorage.AddTestData("slow", server.URL+"/slow")
+
+	cfg := testutils.LoadTestConfig()
+	cfg.BlockPrivateIPs = false // the test server listens on loopback
+	cfg.MetadataFetchWorkers = 2
+	cfg.MetadataFetchQueue = 8
+	cfg.MetadataFetchTimeout = 100 * time.Millisecond
+	cfg.MetadataFetchMaxBytes = 1024
+
+	fetcher := NewFetcher(urlStorage, &cfg)
+	fetcher.RunAsync()
+	for _, shortURL := range []string{"article", "huge", "image", "slow"} {
+		record, err := urlStorage.TryGetURL(context.Background(), shortURL)
+		require.NoError(t, err)
+		fetcher.Enqueue(shortURL, record.LongURL)
+	}
+	fetcher.Finalize()
+
+	tests := []struct {
+		shortURL string
+		title    string
+		imageURL string
+	}{
+		{shortURL: "article", title: "Article", imageURL: server.URL + "/cover.jpg"},
+		{shortURL: "huge"},
+		{shortURL: "image"},
+		{shortURL: "slow"},
+	}
+	for _, test := range tests {
+		t.Run(test.shortURL, func(t *testing.T) {
+			record, err := urlStorage.TryGetURL(context.Background(), test.shortURL)
+			require.NoError(t, err)
+			assert.Equal(t, test.title, record.Title)
+			assert.Equal(t, test.imageURL, record.ImageURL)
+		})
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/config"
 	"github.com/rvkarpov/url_shortener/internal/storage"
+	"github.com/rvkarpov/url_shortener/internal/urlutils"
 	"go.uber.org/zap"
 )
 
@@ -16,52 +22,286 @@ type Claims struct {
 	UserID string
 }
 
-func Authorize(h http.HandlerFunc, logger *zap.SugaredLogger, secretKey string) http.HandlerFunc {
+// Sessions issues and verifies the signed session tokens. Tokens carry the
+// id of their signing key in the "kid" header, so any configured key is
+// accepted while only the first one signs.
+type Sessions struct {
+	apiKeys APIKeyVerifier
+
+	keys       map[string][]byte
+	activeKey  string
+	issuer     string
+	ttl        time.Duration
+	renewAfter time.Duration
+
+	invalidPolicy string
+	previousKeys  [][]byte
+	legacyUntil   time.Time
+
+	trustedProxies config.TrustedProxies
+
+	cookiePath     string
+	cookieSecure   bool
+	cookieHTTPOnly bool
+	cookieSameSite http.SameSite
+}
+
+func NewSessions(cfg *config.Config) *Sessions {
+	keys := make(map[string][]byte, len(cfg.SigningKeys))
+	for _, key := range cfg.SigningKeys {
+		keys[key.ID] = []byte(key.Secret)
+	}
+
+	previousKeys := make([][]byte, 0, len(cfg.PreviousSigningKeys))
+	for _, key := range cfg.PreviousSigningKeys {
+		previousKeys = append(previousKeys, []byte(key.Secret))
+	}
+
+	return &Sessions{
+		keys:       keys,
+		activeKey:  cfg.SigningKeys[0].ID,
+		issuer:     cfg.SessionIssuer,
+		ttl:        cfg.SessionTTL,
+		renewAfter: cfg.SessionRenewAfter,
+
+		invalidPolicy: cfg.InvalidSessionPolicy,
+		previousKeys:  previousKeys,
+		legacyUntil:   cfg.LegacySessionsUntil,
+
+		trustedProxies: cfg.TrustedProxies,
+
+		cookiePath:     cfg.CookiePath,
+		cookieSecure:   cfg.CookieSecure,
+		cookieHTTPOnly: cfg.CookieHTTPOnly,
+		cookieSameSite: sameSite(cfg.CookieSameSite),
+	}
+}
+
+func sameSite(mode string) http.SameSite {
+	switch mode {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// APIKeyVerifier resolves an API key to its user and scopes.
+type APIKeyVerifier interface {
+	VerifyAPIKey(ctx context.Context, key string) (string, []string, error)
+}
+
+// SetAPIKeys enables authorization with "Authorization: Bearer <key>".
+func (sessions *Sessions) SetAPIKeys(verifier APIKeyVerifier) {
+	sessions.apiKeys = verifier
+}
+
+type scopesKey struct{}
+
+// clientIPKey holds the client address Authorize resolved.
+type clientIPKey struct{}
+
+// clientIP returns the client address set by Authorize, the peer address
+// of requests that did not pass it.
+func clientIP(rqs *http.Request) string {
+	if ip, ok := rqs.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return urlutils.ClientIP(rqs, nil)
+}
+
+// isNewSession reports whether the request came without a valid session.
+func isNewSession(rqs *http.Request) bool {
+	_, isNew := storage.NewSessionIP(rqs.Context())
+	return isNew
+}
+
+// RequireScope rejects requests made with an API key that lacks scope,
+// cookie sessions are not limited by scopes.
+func RequireScope(h http.HandlerFunc, scope string) http.HandlerFunc {
 	return func(rsp http.ResponseWriter, rqs *http.Request) {
-		cookie, err := rqs.Cookie("session")
-		if err != nil {
-			userID := uuid.New().String()
-			setCookie(userID, secretKey, rsp, logger)
+		scopes, byKey := rqs.Context().Value(scopesKey{}).([]string)
+		if byKey && !slices.Contains(scopes, scope) {
+			http.Error(rsp, fmt.Sprintf("API key lacks the '%s' scope", scope), http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(rsp, rqs)
+	}
+}
+
+// RequireSession rejects requests made with an API key.
+func RequireSession(h http.HandlerFunc) http.HandlerFunc {
+	return func(rsp http.ResponseWriter, rqs *http.Request) {
+		if _, byKey := rqs.Context().Value(scopesKey{}).([]string); byKey {
+			http.Error(rsp, "not available for API keys", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(rsp, rqs)
+	}
+}
+
+func Authorize(h http.HandlerFunc, logger *zap.SugaredLogger, sessions *Sessions) http.HandlerFunc {
+	return func(rsp http.ResponseWriter, rqs *http.Request) {
+		// rate limits and the audit log record where requests come from
+		ip := urlutils.ClientIP(rqs, sessions.trustedProxies)
+		rqs = rqs.WithContext(audit.WithClientIP(context.WithValue(rqs.Context(), clientIPKey{}, ip), ip))
+
+		if key, found := strings.CutPrefix(rqs.Header.Get("Authorization"), "Bearer "); found {
+			if sessions.apiKeys == nil {
+				http.Error(rsp, "API keys are not supported", http.StatusUnauthorized)
+				return
+			}
+
+			userID, scopes, err := sessions.apiKeys.VerifyAPIKey(rqs.Context(), strings.TrimSpace(key))
+			if err != nil {
+				http.Error(rsp, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			logger.Infof("Authenticated user by API key: %s", userID)
 			ctx := context.WithValue(rqs.Context(), storage.UserIDKey{Name: "userID"}, userID)
+			ctx = context.WithValue(ctx, scopesKey{}, scopes)
 			h.ServeHTTP(rsp, rqs.WithContext(ctx))
 			return
 		}
 
-		claims, err := parseJWT(cookie.Value, secretKey)
+		newUser := func() {
+			userID := uuid.New().String()
+			if err := sessions.Issue(userID, rsp); err != nil {
+				http.Error(rsp, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			logger.Infof("New user ID created: %s", userID)
+			ctx := context.WithValue(rqs.Context(), storage.UserIDKey{Name: "userID"}, userID)
+			ctx = storage.WithNewSession(ctx, ip)
+			h.ServeHTTP(rsp, rqs.WithContext(ctx))
+		}
+
+		cookie, err := rqs.Cookie("session")
 		if err != nil {
-			http.Error(rsp, err.Error(), http.StatusUnauthorized)
+			newUser()
 			return
 		}
 
+		claims, err := sessions.parseJWT(cookie.Value)
+		if err != nil {
+			switch sessions.invalidPolicy {
+			case "reject":
+				http.Error(rsp, err.Error(), http.StatusUnauthorized)
+				return
+			case "previous":
+				if claims = sessions.recover(cookie.Value); claims != nil {
+					logger.Infof("Session of %s moved to the current signing key", claims.UserID)
+					break
+				}
+				fallthrough
+			default:
+				logger.Infof("Replacing invalid session: %v", err)
+				newUser()
+				return
+			}
+		}
+
+		// sliding expiration: sessions in use are reissued before they run out
+		if sessions.needsRenewal(claims) {
+			if err := sessions.Issue(claims.UserID, rsp); err != nil {
+				logger.Errorf("Failed to renew session of %s: %v", claims.UserID, err)
+			}
+		}
+
 		logger.Infof("Authenticated user: %s", claims.UserID)
 		ctx := context.WithValue(rqs.Context(), storage.UserIDKey{Name: "userID"}, claims.UserID)
 		h.ServeHTTP(rsp, rqs.WithContext(ctx))
 	}
 }
 
-func setCookie(userID string, secretKey string, rsp http.ResponseWriter, logger *zap.SugaredLogger) {
-	tokenString, err := createJWT(userID, secretKey)
+// Issue sets a fresh session cookie for the user.
+func (sessions *Sessions) Issue(userID string, rsp http.ResponseWriter) error {
+	tokenString, err := sessions.createJWT(userID, time.Now())
 	if err != nil {
-		http.Error(rsp, "Internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	http.SetCookie(rsp, &http.Cookie{
-		Name:   "session",
-		Value:  tokenString,
-		MaxAge: 3600,
+		Name:     "session",
+		Value:    tokenString,
+		Path:     sessions.cookiePath,
+		MaxAge:   int(sessions.ttl.Seconds()),
+		Secure:   sessions.cookieSecure,
+		HttpOnly: sessions.cookieHTTPOnly,
+		SameSite: sessions.cookieSameSite,
+	})
+
+	return nil
+}
+
+// Clear removes the session cookie, the next request starts a new anonymous session.
+func (sessions *Sessions) Clear(rsp http.ResponseWriter) {
+	http.SetCookie(rsp, &http.Cookie{
+		Name:     "session",
+		Path:     sessions.cookiePath,
+		MaxAge:   -1,
+		Secure:   sessions.cookieSecure,
+		HttpOnly: sessions.cookieHTTPOnly,
+		SameSite: sessions.cookieSameSite,
 	})
+}
 
-	logger.Infof("New user ID created: %s", userID)
+// needsRenewal is also true for recovered sessions, recover drops their issue time.
+func (sessions *Sessions) needsRenewal(claims *Claims) bool {
+	return claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) >= sessions.renewAfter
 }
 
-func createJWT(userID string, secretKey string) (string, error) {
+// recover verifies a session with the retired keys regardless of its kid.
+// Sessions issued before expiry was introduced have no claims besides the
+// user ID, they are accepted until the legacy window closes as they would
+// never run out. Returns nil if no key fits.
+func (sessions *Sessions) recover(tokenString string) *Claims {
+	now := time.Now()
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation(), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	for _, key := range sessions.previousKeys {
+		claims := &Claims{}
+		_, err := parser.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
+			return key, nil
+		})
+		if err != nil || claims.UserID == "" || !claims.VerifyExpiresAt(now, false) {
+			continue
+		}
+
+		if claims.ExpiresAt == nil && !now.Before(sessions.legacyUntil) {
+			continue
+		}
+
+		if claims.Issuer != "" && claims.Issuer != sessions.issuer {
+			continue
+		}
+
+		claims.IssuedAt = nil
+		return claims
+	}
+
+	return nil
+}
+
+func (sessions *Sessions) createJWT(userID string, issuedAt time.Time) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		RegisteredClaims: jwt.RegisteredClaims{},
-		UserID:           userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    sessions.issuer,
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(sessions.ttl)),
+		},
+		UserID: userID,
 	})
+	token.Header["kid"] = sessions.activeKey
 
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := token.SignedString(sessions.keys[sessions.activeKey])
 	if err != nil {
 		return "", err
 	}
@@ -69,14 +309,20 @@ func createJWT(userID string, secretKey string) (string, error) {
 	return tokenString, nil
 }
 
-func parseJWT(tokenString string, secretKey string) (*Claims, error) {
+func (sessions *Sessions) parseJWT(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 		}
 
-		return []byte(secretKey), nil
+		kid, _ := t.Header["kid"].(string)
+		key, ok := sessions.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key '%s'", kid)
+		}
+
+		return key, nil
 	})
 
 	if err != nil {
@@ -87,5 +333,14 @@ func parseJWT(tokenString string, secretKey string) (*Claims, error) {
 		return nil, fmt.Errorf("token is invalid")
 	}
 
+	// jwt/v4 accepts tokens without these claims
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("token has no expiration time")
+	}
+
+	if !claims.VerifyIssuer(sessions.issuer, true) {
+		return nil, fmt.Errorf("unexpected token issuer '%s'", claims.Issuer)
+	}
+
 	return claims, nil
 }
@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func echoUser(rsp http.ResponseWriter, rqs *http.Request) {
+	userID, _ := storage.GetUserID(rqs.Context())
+	rsp.Write([]byte(userID))
+}
+
+func sessionCookie(rsp *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rsp.Result().Cookies() {
+		if cookie.Name == "session" {
+			return cookie
+		}
+	}
+
+	return nil
+}
+
+func TestAuthorize(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.InvalidSessionPolicy = "reject"
+	sessions := NewSessions(&cfg)
+
+	rotatedCfg := cfg
+	rotatedCfg.SigningKeys = config.SigningKeys{{ID: "next", Secret: "next_secret_key"}, cfg.SigningKeys[0]}
+	rotated := NewSessions(&rotatedCfg)
+
+	otherCfg := testutils.LoadTestConfig()
+	otherCfg.SigningKeys = config.SigningKeys{{ID: "other", Secret: "other_secret_key"}}
+	other := NewSessions(&otherCfg)
+
+	otherIssuerCfg := testutils.LoadTestConfig()
+	otherIssuerCfg.SessionIssuer = "someone_else"
+	otherIssuer := NewSessions(&otherIssuerCfg)
+
+	create := func(sessions *Sessions, issuedAt time.Time) string {
+		token, err := sessions.createJWT("user1", issuedAt)
+		require.NoError(t, err)
+		return token
+	}
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "user1"}).SignedString([]byte("test_secret_key"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		handler *Sessions
+		token   string
+		status  int
+		renewed bool
+	}{
+		{name: "fresh", handler: sessions, token: create(sessions, time.Now()), status: http.StatusOK},
+		{name: "renewed", handler: sessions, token: create(sessions, time.Now().Add(-2*time.Hour)), status: http.StatusOK, renewed: true},
+		{name: "expired", handler: sessions, token: create(sessions, time.Now().Add(-25*time.Hour)), status: http.StatusUnauthorized},
+		{name: "rotated out key", handler: rotated, token: create(sessions, time.Now()), status: http.StatusOK},
+		{name: "unknown key", handler: sessions, token: create(other, time.Now()), status: http.StatusUnauthorized},
+		{name: "wrong issuer", handler: sessions, token: create(otherIssuer, time.Now()), status: http.StatusUnauthorized},
+		{name: "no kid and expiry", handler: sessions, token: unsigned, status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rqs := httptest.NewRequest(http.MethodGet, "/", nil)
+			rqs.AddCookie(&http.Cookie{Name: "session", Value: test.token})
+			rsp := httptest.NewRecorder()
+			Authorize(echoUser, zap.NewNop().Sugar(), test.handler)(rsp, rqs)
+
+			assert.Equal(t, test.status, rsp.Code)
+			if test.status != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, "user1", rsp.Body.String())
+			assert.Equal(t, test.renewed, sessionCookie(rsp) != nil)
+		})
+	}
+}
+
+func TestAuthorizeNewUser(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	sessions := NewSessions(&cfg)
+
+	rsp := httptest.NewRecorder()
+	Authorize(echoUser, zap.NewNop().Sugar(), sessions)(rsp, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rsp.Code)
+
+	cookie := sessionCookie(rsp)
+	require.NotNil(t, cookie)
+	assert.Equal(t, int(cfg.SessionTTL.Seconds()), cookie.MaxAge)
+
+	claims, err := sessions.parseJWT(cookie.Value)
+	require.NoError(t, err)
+	assert.Equal(t, rsp.Body.String(), claims.UserID)
+	assert.Equal(t, "url_shortener", claims.Issuer)
+}
+
+func TestAuthorizeClientIP(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	require.NoError(t, cfg.TrustedProxies.Set("10.0.0.0/8"))
+	sessions := NewSessions(&cfg)
+
+	echoIP := func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.Write([]byte(audit.ClientIP(rqs.Context())))
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.5:4000", want: "203.0.113.5"},
+		{name: "spoofed header", remoteAddr: "203.0.113.5:4000", realIP: "198.51.100.1", want: "203.0.113.5"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:4000", realIP: "198.51.100.1", want: "198.51.100.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rqs := httptest.NewRequest(http.MethodGet, "/", nil)
+			rqs.RemoteAddr = test.remoteAddr
+			if test.realIP != "" {
+				rqs.Header.Set("X-Real-IP", test.realIP)
+			}
+
+			rsp := httptest.NewRecorder()
+			Authorize(echoIP, zap.NewNop().Sugar(), sessions)(rsp, rqs)
+			assert.Equal(t, test.want, rsp.Body.String())
+		})
+	}
+}
+
+func TestInvalidSessionPolicy(t *testing.T) {
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "user1"}).SignedString([]byte("old_secret_key"))
+	require.NoError(t, err)
+
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "user1"}).SignedString([]byte("guessed_key"))
+	require.NoError(t, err)
+
+	signOld := func(claims Claims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("old_secret_key"))
+		require.NoError(t, err)
+		return token
+	}
+
+	expiring := signOld(Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: "url_shortener", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		UserID:           "user1",
+	})
+	otherIssuer := signOld(Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: "someone_else", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		UserID:           "user1",
+	})
+
+	legacyWindow := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		policy      string
+		legacyUntil time.Time
+		token       string
+		status      int
+		userID      string
+	}{
+		{name: "reject", policy: "reject", token: legacy, status: http.StatusUnauthorized},
+		{name: "renew", policy: "renew", token: legacy, status: http.StatusOK},
+		{name: "previous key", policy: "previous", legacyUntil: legacyWindow, token: legacy, status: http.StatusOK, userID: "user1"},
+		{name: "previous key mismatch", policy: "previous", legacyUntil: legacyWindow, token: forged, status: http.StatusOK},
+		{name: "legacy window closed", policy: "previous", legacyUntil: time.Now().Add(-time.Hour), token: legacy, status: http.StatusOK},
+		{name: "no legacy window", policy: "previous", token: legacy, status: http.StatusOK},
+		{name: "previous key with expiry", policy: "previous", token: expiring, status: http.StatusOK, userID: "user1"},
+		{name: "previous key other issuer", policy: "previous", legacyUntil: legacyWindow, token: otherIssuer, status: http.StatusOK},
+		{name: "garbage", policy: "previous", token: "garbage", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testutils.LoadTestConfig()
+			cfg.InvalidSessionPolicy = test.policy
+			cfg.PreviousSigningKeys = config.SigningKeys{{ID: "old", Secret: "old_secret_key"}}
+			cfg.LegacySessionsUntil = test.legacyUntil
+			sessions := NewSessions(&cfg)
+
+			rqs := httptest.NewRequest(http.MethodGet, "/", nil)
+			rqs.AddCookie(&http.Cookie{Name: "session", Value: test.token})
+			rsp := httptest.NewRecorder()
+			Authorize(echoUser, zap.NewNop().Sugar(), sessions)(rsp, rqs)
+
+			assert.Equal(t, test.status, rsp.Code)
+			if test.status != http.StatusOK {
+				return
+			}
+
+			if test.userID != "" {
+				assert.Equal(t, test.userID, rsp.Body.String())
+			} else {
+				assert.NotEqual(t, "user1", rsp.Body.String())
+			}
+
+			cookie := sessionCookie(rsp)
+			require.NotNil(t, cookie)
+			assert.True(t, cookie.HttpOnly)
+			assert.Equal(t, "/", cookie.Path)
+			assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+			claims, err := sessions.parseJWT(cookie.Value)
+			require.NoError(t, err)
+			assert.Equal(t, rsp.Body.String(), claims.UserID)
+		})
+	}
+}
+
+type stubVerifier map[string][]string
+
+func (verifier stubVerifier) VerifyAPIKey(ctx context.Context, key string) (string, []string, error) {
+	scopes, ok := verifier[key]
+	if !ok {
+		return "", nil, errors.New("unknown API key")
+	}
+
+	return "machine", scopes, nil
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	sessions := NewSessions(&cfg)
+	sessions.SetAPIKeys(stubVerifier{"reader": {"read"}, "writer": {"shorten", "read"}})
+
+	tests := []struct {
+		name    string
+		key     string
+		handler http.HandlerFunc
+		status  int
+	}{
+		{name: "scope granted", key: "reader", handler: RequireScope(echoUser, "read"), status: http.StatusOK},
+		{name: "scope missing", key: "reader", handler: RequireScope(echoUser, "shorten"), status: http.StatusForbidden},
+		{name: "unknown key", key: "stolen", handler: RequireScope(echoUser, "read"), status: http.StatusUnauthorized},
+		{name: "session only", key: "writer", handler: RequireSession(echoUser), status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rqs := httptest.NewRequest(http.MethodGet, "/", nil)
+			rqs.Header.Set("Authorization", "Bearer "+test.key)
+			rsp := httptest.NewRecorder()
+			Authorize(test.handler, zap.NewNop().Sugar(), sessions)(rsp, rqs)
+
+			assert.Equal(t, test.status, rsp.Code)
+			assert.Nil(t, sessionCookie(rsp))
+			if test.status == http.StatusOK {
+				assert.Equal(t, "machine", rsp.Body.String())
+			}
+		})
+	}
+
+	rsp := httptest.NewRecorder()
+	Authorize(RequireScope(echoUser, "delete"), zap.NewNop().Sugar(), sessions)(rsp, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rsp.Code)
+}
@@ -74,7 +74,8 @@ func Compress(h http.HandlerFunc) http.HandlerFunc {
 		//
 		encoding := rqs.Header.Get("Accept-Encoding")
 		contentType := rqs.Header.Get("Content-Type")
-		allowCompressRsp := strings.Contains(encoding, "gzip") && (contentType == "application/json" || contentType == "text/html")
+		acceptHTML := strings.Contains(rqs.Header.Get("Accept"), "text/html")
+		allowCompressRsp := strings.Contains(encoding, "gzip") && (contentType == "application/json" || contentType == "text/html" || acceptHTML)
 
 		if !allowCompressRsp {
 			h.ServeHTTP(rsp, rqs)
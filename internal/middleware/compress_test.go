@@ -8,7 +8,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
-	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5"
 	"github.com/rvkarpov/url_shortener/internal/handler"
 	"github.com/rvkarpov/url_shortener/internal/mocks"
 	"github.com/rvkarpov/url_shortener/internal/service"
@@ -111,3 +111,33 @@ func TestPostObjectHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestPreviewPage(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	storage := mocks.NewStorageMock()
+	storage.AddTestData("oeapEa", "https://www.foo.com")
+
+	urlService := service.NewURLService(storage, &cfg)
+	handler := handler.NewURLHandler(urlService, &cfg)
+	router := chi.NewRouter()
+	router.Get("/{URL}", Compress(handler.ProcessGet))
+
+	rqs := httptest.NewRequest(http.MethodGet, "/oeapEa+", nil)
+	rqs.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rqs.Header.Set("Accept-Encoding", "gzip")
+
+	rsp := httptest.NewRecorder()
+	router.ServeHTTP(rsp, rqs)
+
+	res := rsp.Result()
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+
+	gzr, err := gzip.NewReader(res.Body)
+	assert.NoError(t, err)
+	page, _ := io.ReadAll(gzr)
+	assert.Contains(t, string(page), "https://www.foo.com")
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// RateLimiter keeps a token bucket per key in memory. A bucket holds up to
+// burst tokens and regains rate tokens per minute, buckets left alone for
+// the idle time are evicted.
+type RateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	idle  time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// limitState is what a request learns about its bucket.
+type limitState struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// NewRateLimiter returns a limiter of rate requests per minute, a rate of 0
+// disables it. The idle time is raised to the time an empty bucket takes to
+// fill up, so evicting a bucket never hands out extra tokens.
+func NewRateLimiter(rate, burst int, idle time.Duration) *RateLimiter {
+	limiter := &RateLimiter{
+		rate:    float64(rate) / 60,
+		burst:   float64(max(burst, 1)),
+		idle:    idle,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+
+	if limiter.rate > 0 {
+		limiter.idle = max(limiter.idle, limiter.refill(limiter.burst))
+	}
+
+	return limiter
+}
+
+// refill returns the time the bucket needs to regain the tokens.
+func (limiter *RateLimiter) refill(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / limiter.rate * float64(time.Second)))
+}
+
+func (limiter *RateLimiter) take(key string) limitState {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	limiter.sweep(now)
+
+	b, exists := limiter.buckets[key]
+	if !exists {
+		b = &bucket{tokens: limiter.burst}
+		limiter.buckets[key] = b
+	} else {
+		b.tokens = min(limiter.burst, b.tokens+now.Sub(b.updated).Seconds()*limiter.rate)
+	}
+	b.updated = now
+
+	state := limitState{allowed: b.tokens >= 1}
+	if state.allowed {
+		b.tokens--
+	} else {
+		state.retryAfter = limiter.refill(1 - b.tokens)
+	}
+
+	state.remaining = int(b.tokens)
+	state.reset = limiter.refill(limiter.burst - b.tokens)
+	return state
+}
+
+// sweep drops the idle buckets, at most once per idle time.
+func (limiter *RateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < limiter.idle {
+		return
+	}
+	limiter.lastSweep = now
+
+	for key, b := range limiter.buckets {
+		if now.Sub(b.updated) >= limiter.idle {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func (limiter *RateLimiter) size() int {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return len(limiter.buckets)
+}
+
+// RateLimitByUser limits the requests of the user set by Authorize. Requests
+// without a user or with a session created just for them are limited by
+// client IP, otherwise dropping the cookie would give a fresh bucket.
+func RateLimitByUser(h http.HandlerFunc, limiter *RateLimiter) http.HandlerFunc {
+	return rateLimit(h, limiter, func(rqs *http.Request) string {
+		userID, err := storage.GetUserID(rqs.Context())
+		if err == nil && userID != "" && !isNewSession(rqs) {
+			return "user:" + userID
+		}
+
+		return "ip:" + clientIP(rqs)
+	})
+}
+
+// RateLimitByIP limits the requests of the client IP.
+func RateLimitByIP(h http.HandlerFunc, limiter *RateLimiter) http.HandlerFunc {
+	return rateLimit(h, limiter, func(rqs *http.Request) string {
+		return "ip:" + clientIP(rqs)
+	})
+}
+
+func rateLimit(h http.HandlerFunc, limiter *RateLimiter, key func(rqs *http.Request) string) http.HandlerFunc {
+	if limiter.rate <= 0 {
+		return h
+	}
+
+	return func(rsp http.ResponseWriter, rqs *http.Request) {
+		state := limiter.take(key(rqs))
+
+		header := rsp.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+		header.Set("RateLimit-Remaining", strconv.Itoa(state.remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(seconds(state.reset)))
+
+		if !state.allowed {
+			header.Set("Retry-After", strconv.Itoa(seconds(state.retryAfter)))
+			http.Error(rsp, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(rsp, rqs)
+	}
+}
+
+// seconds rounds the duration up to whole seconds as the headers expect.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func TestRateLimit(t *testing.T) {
+	ok := func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.WriteHeader(http.StatusOK)
+	}
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	newLimiter := func(rate, burst int, idle time.Duration) *RateLimiter {
+		limiter := NewRateLimiter(rate, burst, idle)
+		limiter.now = clock.Now
+		return limiter
+	}
+
+	byUser := func(h http.HandlerFunc, userID, peerIP string) *httptest.ResponseRecorder {
+		rqs := httptest.NewRequest(http.MethodPost, "/api/shorten", nil)
+		if userID != "" {
+			rqs = rqs.WithContext(context.WithValue(rqs.Context(), storage.UserIDKey{Name: "userID"}, userID))
+		}
+		rqs.RemoteAddr = peerIP + ":4321"
+
+		rsp := httptest.NewRecorder()
+		h(rsp, rqs)
+		return rsp
+	}
+
+	t.Run("burst then refill", func(t *testing.T) {
+		h := RateLimitByUser(ok, newLimiter(60, 3, time.Minute))
+
+		for remaining := 2; remaining >= 0; remaining-- {
+			rsp := byUser(h, "alice", "10.0.0.1")
+			require.Equal(t, http.StatusOK, rsp.Code)
+			assert.Equal(t, "3", rsp.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, strconv.Itoa(remaining), rsp.Header().Get("RateLimit-Remaining"))
+		}
+
+		rsp := byUser(h, "alice", "10.0.0.1")
+		require.Equal(t, http.StatusTooManyRequests, rsp.Code)
+		assert.Equal(t, "1", rsp.Header().Get("Retry-After"))
+		assert.Equal(t, "3", rsp.Header().Get("RateLimit-Reset"))
+		assert.Equal(t, "0", rsp.Header().Get("RateLimit-Remaining"))
+
+		// other users and the same IP without a user have their own buckets
+		assert.Equal(t, http.StatusOK, byUser(h, "bob", "10.0.0.1").Code)
+		assert.Equal(t, http.StatusOK, byUser(h, "", "10.0.0.1").Code)
+
+		clock.now = clock.now.Add(time.Second)
+		assert.Equal(t, http.StatusOK, byUser(h, "alice", "10.0.0.1").Code)
+		assert.Equal(t, http.StatusTooManyRequests, byUser(h, "alice", "10.0.0.1").Code)
+	})
+
+	t.Run("by IP", func(t *testing.T) {
+		h := RateLimitByIP(ok, newLimiter(1, 1, time.Minute))
+
+		assert.Equal(t, http.StatusOK, byUser(h, "alice", "10.0.0.1").Code)
+		rsp := byUser(h, "bob", "10.0.0.1")
+		assert.Equal(t, http.StatusTooManyRequests, rsp.Code)
+		assert.Equal(t, "60", rsp.Header().Get("Retry-After"))
+		assert.Equal(t, http.StatusOK, byUser(h, "alice", "10.0.0.2").Code)
+	})
+
+	t.Run("X-Real-IP of untrusted peers is ignored", func(t *testing.T) {
+		h := RateLimitByIP(ok, newLimiter(1, 1, time.Minute))
+
+		spoofed := func(realIP string) int {
+			rqs := httptest.NewRequest(http.MethodGet, "/abc", nil)
+			rqs.RemoteAddr = "203.0.113.5:4321"
+			rqs.Header.Set("X-Real-IP", realIP)
+
+			rsp := httptest.NewRecorder()
+			h(rsp, rqs)
+			return rsp.Code
+		}
+
+		assert.Equal(t, http.StatusOK, spoofed("10.0.0.1"))
+		assert.Equal(t, http.StatusTooManyRequests, spoofed("10.0.0.2"))
+	})
+
+	t.Run("requests without a session are limited by IP", func(t *testing.T) {
+		cfg := testutils.LoadTestConfig()
+		sessions := NewSessions(&cfg)
+		h := Authorize(RateLimitByUser(ok, newLimiter(60, 2, time.Minute)), zap.NewNop().Sugar(), sessions)
+
+		post := func(peerIP string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			rqs := httptest.NewRequest(http.MethodPost, "/api/shorten", nil)
+			rqs.RemoteAddr = peerIP + ":4321"
+			if cookie != nil {
+				rqs.AddCookie(cookie)
+			}
+
+			rsp := httptest.NewRecorder()
+			h(rsp, rqs)
+			return rsp
+		}
+
+		// every cookie-less request gets a new user, yet they share the IP bucket
+		first := post("10.0.1.1", nil)
+		require.Equal(t, http.StatusOK, first.Code)
+		assert.Equal(t, http.StatusOK, post("10.0.1.1", nil).Code)
+		assert.Equal(t, http.StatusTooManyRequests, post("10.0.1.1", nil).Code)
+
+		// a kept session has its own bucket
+		assert.Equal(t, http.StatusOK, post("10.0.1.1", sessionCookie(first)).Code)
+		assert.Equal(t, http.StatusOK, post("10.0.1.2", nil).Code)
+	})
+
+	t.Run("idle buckets are evicted", func(t *testing.T) {
+		limiter := newLimiter(60, 2, time.Minute)
+		h := RateLimitByIP(ok, limiter)
+
+		byUser(h, "", "10.0.0.1")
+		byUser(h, "", "10.0.0.2")
+		assert.Equal(t, 2, limiter.size())
+
+		clock.now = clock.now.Add(time.Minute)
+		byUser(h, "", "10.0.0.3")
+		assert.Equal(t, 1, limiter.size())
+	})
+
+	t.Run("idle time covers refill", func(t *testing.T) {
+		limiter := NewRateLimiter(1, 10, time.Second)
+		assert.Equal(t, 10*time.Minute, limiter.idle)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		h := RateLimitByUser(ok, newLimiter(0, 1, time.Minute))
+		for i := 0; i < 5; i++ {
+			rsp := byUser(h, "alice", "10.0.0.1")
+			assert.Equal(t, http.StatusOK, rsp.Code)
+			assert.Empty(t, rsp.Header().Get("RateLimit-Limit"))
+		}
+	})
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+)
+
+// TrustedSubnet answers 403 to requests whose X-Real-IP is not inside the subnet.
+func TrustedSubnet(h http.HandlerFunc, subnet config.TrustedSubnet) http.HandlerFunc {
+	return func(rsp http.ResponseWriter, rqs *http.Request) {
+		ip := net.ParseIP(strings.TrimSpace(rqs.Header.Get("X-Real-IP")))
+		if !subnet.Contains(ip) {
+			http.Error(rsp, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(rsp, rqs)
+	}
+}
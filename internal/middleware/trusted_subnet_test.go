@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/handler"
+	"github.com/rvkarpov/url_shortener/internal/mocks"
+	"github.com/rvkarpov/url_shortener/internal/service"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedSubnet(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	urlStorage := mocks.NewStorageMock()
+	urlHandler := handler.NewURLHandler(service.NewURLService(urlStorage, &cfg), &cfg)
+
+	for userID, shortURL := range map[string]string{"alice": "a", "bob": "b"} {
+		ctx := context.WithValue(context.Background(), storage.UserIDKey{Name: "userID"}, userID)
+		require.NoError(t, urlStorage.StoreURL(ctx, storage.URLRecord{ShortURL: shortURL, LongURL: "https://" + userID + ".com"}))
+	}
+	urlStorage.AddTestData("c", "https://carol.com")
+
+	tests := []struct {
+		name   string
+		subnet string
+		realIP string
+		code   int
+	}{
+		{name: "inside", subnet: "10.0.0.0/8", realIP: "10.1.2.3", code: http.StatusOK},
+		{name: "ipv6 inside", subnet: "fd00::/8", realIP: "fd00::1", code: http.StatusOK},
+		{name: "outside", subnet: "10.0.0.0/8", realIP: "192.168.1.1", code: http.StatusForbidden},
+		{name: "no header", subnet: "10.0.0.0/8", realIP: "", code: http.StatusForbidden},
+		{name: "invalid header", subnet: "10.0.0.0/8", realIP: "10.1.2.3, 10.1.2.4", code: http.StatusForbidden},
+		{name: "no subnet", subnet: "", realIP: "10.1.2.3", code: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var subnet config.TrustedSubnet
+			require.NoError(t, subnet.Set(test.subnet))
+
+			rqs := httptest.NewRequest(http.MethodGet, "/api/internal/stats", nil)
+			if test.realIP != "" {
+				rqs.Header.Set("X-Real-IP", test.realIP)
+			}
+
+			rsp := httptest.NewRecorder()
+			TrustedSubnet(urlHandler.ProcessGetInternalStats, subnet)(rsp, rqs)
+
+			require.Equal(t, test.code, rsp.Code)
+			if test.code == http.StatusOK {
+				assert.JSONEq(t, `{"urls":3,"users":2}`, rsp.Body.String())
+			}
+		})
+	}
+
+	var subnet config.TrustedSubnet
+	assert.Error(t, subnet.Set("10.0.0.1"))
+}
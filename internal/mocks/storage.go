@@ -3,7 +3,11 @@ package mocks
 import (
 	"context"
 	"errors"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/rvkarpov/url_shortener/internal/rules"
 	"github.com/rvkarpov/url_shortener/internal/storage"
 )
 
@@ -15,25 +19,52 @@ type MockStorage interface {
 // implementation temporarily coincides with storage.Storage
 
 type Mock struct {
-	urls map[string]string
+	urls         map[string]*storage.URLRecord
+	utmTemplates map[string]storage.UTMTemplate
+	clicks       []storage.Click
+	apiKeys      map[string]*storage.APIKey
+	accounts     []storage.Account
+	teams        map[string]storage.Team
+	members      map[string]storage.Member
+	quotas       map[string]storage.Quota
 }
 
-func (m *Mock) StoreURL(ctx context.Context, shortURL, longURL string) error {
-	m.urls[shortURL] = longURL
+func (m *Mock) StoreURL(ctx context.Context, record storage.URLRecord) error {
+	if userID, err := storage.GetUserID(ctx); err == nil {
+		record.UserID = userID
+	}
+
+	m.urls[record.ShortURL] = &record
 	return nil
 }
 
-func (m *Mock) TryGetLongURL(ctx context.Context, shortURL string) (string, bool, error) {
-	originalURL, exists := m.urls[shortURL]
-	deleted := false
+func (m *Mock) TryGetURL(ctx context.Context, shortURL string) (*storage.URLRecord, error) {
+	record, exists := m.urls[shortURL]
 	if !exists {
-		return "", deleted, errors.New("URL not found")
+		return nil, errors.New("URL not found")
 	}
 
-	return originalURL, deleted, nil
+	result := *record
+	return &result, nil
 }
 
-func (m *Mock) MarkAsDeleted(ctx context.Context, shortURLs []string) {
+func (m *Mock) MarkAsDeleted(ctx context.Context, shortURLs []string, onDeleted func(shortURLs []string)) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return
+	}
+
+	deleted := make([]string, 0, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		if record, exists := m.urls[shortURL]; exists && record.UserID == userID && !record.Deleted {
+			record.Deleted = true
+			deleted = append(deleted, shortURL)
+		}
+	}
+
+	if onDeleted != nil && len(deleted) > 0 {
+		onDeleted(deleted)
+	}
 }
 
 func (m *Mock) Finalize() {
@@ -47,14 +78,470 @@ func (m *Mock) EndTransaction(ctx context.Context) error {
 	return nil
 }
 
-func (m *Mock) GetSummary(ctx context.Context) string {
-	return ""
+func (m *Mock) GetUserURLs(ctx context.Context, userID, tag string) ([]storage.URLRecord, error) {
+	records := make([]storage.URLRecord, 0)
+	for _, record := range m.urls {
+		if record.UserID == userID && (tag == "" || slices.Contains(record.Tags, tag)) {
+			records = append(records, *record)
+		}
+	}
+
+	return records, nil
+}
+
+func (m *Mock) SetMetadata(ctx context.Context, shortURL, title, note string, tags []string) error {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	record.Title = title
+	record.Note = note
+	record.Tags = tags
+	return nil
+}
+
+func (m *Mock) SetPageMetadata(ctx context.Context, shortURL, title, imageURL string) error {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	if record.Title == "" {
+		record.Title = title
+	}
+	record.ImageURL = imageURL
+	return nil
+}
+
+func (m *Mock) ListURLs(ctx context.Context) ([]storage.URLRecord, error) {
+	records := make([]storage.URLRecord, 0, len(m.urls))
+	for _, record := range m.urls {
+		records = append(records, *record)
+	}
+
+	return records, nil
+}
+
+func (m *Mock) SetBlocked(ctx context.Context, shortURLs []string, blocked bool) error {
+	for _, shortURL := range shortURLs {
+		if record, exists := m.urls[shortURL]; exists {
+			record.Blocked = blocked
+		}
+	}
+
+	return nil
+}
+
+func (m *Mock) SetHealth(ctx context.Context, shortURL string, status int, checkedAt time.Time) error {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return errors.New("URL not found")
+	}
+
+	record.LastStatus = status
+	record.LastChecked = checkedAt
+	return nil
+}
+
+func (m *Mock) SearchURLs(ctx context.Context, query string, limit int) ([]storage.URLRecord, error) {
+	records := make([]storage.URLRecord, 0)
+	for _, record := range m.urls {
+		if len(records) < limit && (record.ShortURL == query || strings.Contains(record.LongURL, query)) {
+			records = append(records, *record)
+		}
+	}
+
+	return records, nil
+}
+
+func (m *Mock) CountURLs(ctx context.Context) (int, error) {
+	return len(m.urls), nil
+}
+
+func (m *Mock) CountUsers(ctx context.Context) (int, error) {
+	users := make(map[string]bool)
+	for _, record := range m.urls {
+		if record.UserID != "" {
+			users[record.UserID] = true
+		}
+	}
+
+	return len(users), nil
+}
+
+func (m *Mock) GetUsage(ctx context.Context, userID string, since time.Time) (*storage.Usage, error) {
+	usage := &storage.Usage{}
+	for _, record := range m.urls {
+		if record.UserID != userID {
+			continue
+		}
+
+		if !record.Deleted {
+			usage.Active++
+		}
+
+		if !record.CreatedAt.Before(since) {
+			usage.Created++
+			if usage.FirstCreated.IsZero() || record.CreatedAt.Before(usage.FirstCreated) {
+				usage.FirstCreated = record.CreatedAt
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+func (m *Mock) StoreURLLimited(ctx context.Context, record storage.URLRecord, limits storage.Limits) error {
+	if _, exists := m.urls[record.ShortURL]; exists {
+		return storage.NewDuplicateURLError(record.ShortURL)
+	}
+
+	userID, _ := storage.GetUserID(ctx)
+	usage, err := m.GetUsage(ctx, userID, limits.Since)
+	if err != nil {
+		return err
+	}
+
+	if limits.Exceeded(usage) {
+		return storage.NewLimitError(*usage)
+	}
+
+	return m.StoreURL(ctx, record)
+}
+
+func (m *Mock) SetQuota(ctx context.Context, quota storage.Quota) error {
+	m.quotas[quota.UserID] = quota
+	return nil
+}
+
+func (m *Mock) TryGetQuota(ctx context.Context, userID string) (*storage.Quota, error) {
+	quota, exists := m.quotas[userID]
+	if !exists {
+		return nil, storage.NewNotFoundError("quota", userID)
+	}
+
+	return &quota, nil
+}
+
+func (m *Mock) DeleteQuota(ctx context.Context, userID string) error {
+	if _, exists := m.quotas[userID]; !exists {
+		return storage.NewNotFoundError("quota", userID)
+	}
+
+	delete(m.quotas, userID)
+	return nil
+}
+
+func (m *Mock) SetDisabled(ctx context.Context, shortURLs []string, disabled bool, reason string) error {
+	for _, shortURL := range shortURLs {
+		if record, exists := m.urls[shortURL]; exists {
+			record.Disabled = disabled
+			record.DisabledReason = reason
+		}
+	}
+
+	return nil
+}
+
+func (m *Mock) SetOwner(ctx context.Context, shortURL, userID string) error {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	record.UserID = userID
+	return nil
+}
+
+func (m *Mock) StoreUTMTemplate(ctx context.Context, template storage.UTMTemplate) error {
+	m.utmTemplates[template.UserID+"/"+template.Name] = template
+	return nil
+}
+
+func (m *Mock) TryGetUTMTemplate(ctx context.Context, userID, name string) (*storage.UTMTemplate, error) {
+	template, exists := m.utmTemplates[userID+"/"+name]
+	if !exists {
+		return nil, storage.NewNotFoundError("UTM template", name)
+	}
+
+	return &template, nil
+}
+
+func (m *Mock) GetUTMTemplates(ctx context.Context, userID string) ([]storage.UTMTemplate, error) {
+	templates := make([]storage.UTMTemplate, 0)
+	for _, template := range m.utmTemplates {
+		if template.UserID == userID {
+			templates = append(templates, template)
+		}
+	}
+
+	return templates, nil
+}
+
+func (m *Mock) DeleteUTMTemplate(ctx context.Context, userID, name string) error {
+	if _, exists := m.utmTemplates[userID+"/"+name]; !exists {
+		return storage.NewNotFoundError("UTM template", name)
+	}
+
+	delete(m.utmTemplates, userID+"/"+name)
+	return nil
+}
+
+func (m *Mock) StoreAPIKey(ctx context.Context, key storage.APIKey) error {
+	m.apiKeys[key.ID] = &key
+	return nil
+}
+
+func (m *Mock) TryGetAPIKey(ctx context.Context, hash string) (*storage.APIKey, error) {
+	for _, key := range m.apiKeys {
+		if key.Hash == hash {
+			result := *key
+			return &result, nil
+		}
+	}
+
+	return nil, storage.NewNotFoundError("API key", "")
+}
+
+func (m *Mock) GetAPIKeys(ctx context.Context, userID string) ([]storage.APIKey, error) {
+	keys := make([]storage.APIKey, 0)
+	for _, key := range m.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, *key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (m *Mock) RevokeAPIKey(ctx context.Context, userID, id string) error {
+	key, exists := m.apiKeys[id]
+	if !exists || key.UserID != userID {
+		return storage.NewNotFoundError("API key", id)
+	}
+
+	key.Revoked = true
+	return nil
+}
+
+func (m *Mock) SetAPIKeyUsed(ctx context.Context, id string, usedAt time.Time) error {
+	key, exists := m.apiKeys[id]
+	if !exists {
+		return storage.NewNotFoundError("API key", id)
+	}
+
+	key.LastUsed = usedAt
+	return nil
+}
+
+func (m *Mock) SetRules(ctx context.Context, shortURL string, redirectRules []rules.Rule) error {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	record.Rules = redirectRules
+	return nil
+}
+
+func (m *Mock) ConsumeClick(ctx context.Context, shortURL string) (bool, error) {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return false, storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	if record.MaxClicks == 0 || record.Exhausted() {
+		return false, nil
+	}
+
+	record.ClickCount++
+	return true, nil
+}
+
+func (m *Mock) SetVariants(ctx context.Context, shortURL string, variants []storage.Variant, sticky bool) error {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	record.Variants = variants
+	record.StickyVariants = sticky
+	return nil
+}
+
+func (m *Mock) RecordClick(ctx context.Context, click storage.Click) error {
+	m.clicks = append(m.clicks, click)
+	return nil
+}
+
+func (m *Mock) GetClickStats(ctx context.Context, shortURL string) (map[string]int, error) {
+	stats := make(map[string]int)
+	for _, click := range m.clicks {
+		if click.ShortURL == shortURL {
+			stats[click.Variant]++
+		}
+	}
+
+	return stats, nil
+}
+
+func (m *Mock) StoreAccount(ctx context.Context, account storage.Account) error {
+	m.accounts = append(m.accounts, account)
+	return nil
+}
+
+func (m *Mock) TryGetAccount(ctx context.Context, issuer, subject string) (*storage.Account, error) {
+	for _, account := range m.accounts {
+		if account.Issuer == issuer && account.Subject == subject {
+			return &account, nil
+		}
+	}
+
+	return nil, storage.NewNotFoundError("account", subject)
+}
+
+func (m *Mock) TryGetUserAccount(ctx context.Context, userID string) (*storage.Account, error) {
+	for _, account := range m.accounts {
+		if account.UserID == userID {
+			return &account, nil
+		}
+	}
+
+	return nil, storage.NewNotFoundError("account", userID)
+}
+
+func (m *Mock) MergeUser(ctx context.Context, fromUserID, toUserID string) error {
+	for _, record := range m.urls {
+		if record.UserID == fromUserID {
+			record.UserID = toUserID
+		}
+	}
+
+	for id, template := range m.utmTemplates {
+		if template.UserID != fromUserID {
+			continue
+		}
+
+		delete(m.utmTemplates, id)
+		if _, exists := m.utmTemplates[toUserID+"/"+template.Name]; !exists {
+			template.UserID = toUserID
+			m.utmTemplates[toUserID+"/"+template.Name] = template
+		}
+	}
+
+	for _, key := range m.apiKeys {
+		if key.UserID == fromUserID {
+			key.UserID = toUserID
+		}
+	}
+
+	for id, member := range m.members {
+		if member.UserID != fromUserID {
+			continue
+		}
+
+		delete(m.members, id)
+		if _, exists := m.members[member.TeamID+"/"+toUserID]; !exists {
+			member.UserID = toUserID
+			m.members[member.TeamID+"/"+toUserID] = member
+		}
+	}
+
+	return nil
+}
+
+func (m *Mock) CreateTeam(ctx context.Context, team storage.Team, owner storage.Member) error {
+	m.teams[team.ID] = team
+	return m.SetMember(ctx, owner)
+}
+
+func (m *Mock) TryGetTeam(ctx context.Context, id string) (*storage.Team, error) {
+	team, exists := m.teams[id]
+	if !exists {
+		return nil, storage.NewNotFoundError("team", id)
+	}
+
+	return &team, nil
+}
+
+func (m *Mock) GetTeamURLs(ctx context.Context, teamID, tag string) ([]storage.URLRecord, error) {
+	records := make([]storage.URLRecord, 0)
+	for _, record := range m.urls {
+		if record.TeamID == teamID && (tag == "" || slices.Contains(record.Tags, tag)) {
+			records = append(records, *record)
+		}
+	}
+
+	return records, nil
+}
+
+func (m *Mock) SetTeam(ctx context.Context, shortURL, teamID string) error {
+	record, exists := m.urls[shortURL]
+	if !exists {
+		return storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	record.TeamID = teamID
+	return nil
+}
+
+func (m *Mock) TryGetMember(ctx context.Context, teamID, userID string) (*storage.Member, error) {
+	member, exists := m.members[teamID+"/"+userID]
+	if !exists {
+		return nil, storage.NewNotFoundError("team member", userID)
+	}
+
+	return &member, nil
+}
+
+func (m *Mock) GetMembers(ctx context.Context, teamID string) ([]storage.Member, error) {
+	members := make([]storage.Member, 0)
+	for _, member := range m.members {
+		if member.TeamID == teamID {
+			members = append(members, member)
+		}
+	}
+
+	return members, nil
+}
+
+func (m *Mock) GetMemberships(ctx context.Context, userID string) ([]storage.Member, error) {
+	members := make([]storage.Member, 0)
+	for _, member := range m.members {
+		if member.UserID == userID {
+			members = append(members, member)
+		}
+	}
+
+	return members, nil
+}
+
+func (m *Mock) SetMember(ctx context.Context, member storage.Member) error {
+	m.members[member.TeamID+"/"+member.UserID] = member
+	return nil
+}
+
+func (m *Mock) RemoveMember(ctx context.Context, teamID, userID string) error {
+	if _, exists := m.members[teamID+"/"+userID]; !exists {
+		return storage.NewNotFoundError("team member", userID)
+	}
+
+	delete(m.members, teamID+"/"+userID)
+	return nil
 }
 
 func (m *Mock) AddTestData(shortURL, longURL string) {
-	m.urls[shortURL] = longURL
+	m.urls[shortURL] = &storage.URLRecord{ShortURL: shortURL, LongURL: longURL}
 }
 
 func NewStorageMock() *Mock {
-	return &Mock{urls: make(map[string]string)}
+	return &Mock{
+		urls:         make(map[string]*storage.URLRecord),
+		utmTemplates: make(map[string]storage.UTMTemplate),
+		apiKeys:      make(map[string]*storage.APIKey),
+		teams:        make(map[string]storage.Team),
+		members:      make(map[string]storage.Member),
+		quotas:       make(map[string]storage.Quota),
+	}
 }
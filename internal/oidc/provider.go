@@ -0,0 +1,320 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+)
+
+// Identity is the user an ID token was issued for.
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string
+}
+
+// Provider runs the authorization code flow with PKCE against an OpenID
+// Connect provider. The provider configuration is discovered on first use.
+type Provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     map[string]*rsa.PublicKey
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewProvider(cfg *config.Config) *Provider {
+	scopes := strings.Split(cfg.OIDCScopes, ",")
+	for i := range scopes {
+		scopes[i] = strings.TrimSpace(scopes[i])
+	}
+
+	return &Provider{
+		issuer:       strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  cfg.OIDCRedirectURL,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewSecret returns a random value for the state, nonce and code verifier of a login.
+func NewSecret() string {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// AuthCodeURL returns the provider page the visitor is sent to for login.
+func (provider *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := provider.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.clientID},
+		"redirect_uri":          {provider.redirectURL},
+		"scope":                 {strings.Join(provider.scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return meta.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange redeems the authorization code and verifies the returned ID token.
+func (provider *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	meta, err := provider.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.redirectURL},
+		"client_id":     {provider.clientID},
+		"code_verifier": {verifier},
+	}
+
+	rqs, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	rqs.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rqs.Header.Set("Accept", "application/json")
+	if provider.clientSecret != "" {
+		rqs.SetBasicAuth(url.QueryEscape(provider.clientID), url.QueryEscape(provider.clientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+
+	status, err := provider.fetchJSON(rqs, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("token request failed with status %d: %s", status, tokens.Error)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, errors.New("provider returned no ID token")
+	}
+
+	return provider.verify(ctx, tokens.IDToken, nonce)
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce string `json:"nonce"`
+	Email string `json:"email"`
+}
+
+func (provider *Provider) verify(ctx context.Context, idToken, nonce string) (*Identity, error) {
+	claims := &idTokenClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}))
+	_, err := parser.ParseWithClaims(idToken, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return provider.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	// jwt/v4 accepts tokens without these claims
+	if claims.ExpiresAt == nil || claims.Subject == "" {
+		return nil, errors.New("ID token has no expiration time or subject")
+	}
+
+	if claims.Issuer != provider.issuer {
+		return nil, fmt.Errorf("unexpected ID token issuer '%s'", claims.Issuer)
+	}
+
+	if !claims.VerifyAudience(provider.clientID, true) {
+		return nil, errors.New("ID token is issued for another client")
+	}
+
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+
+	return &Identity{Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email}, nil
+}
+
+func (provider *Provider) discover(ctx context.Context) (*metadata, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.metadata != nil {
+		return provider.metadata, nil
+	}
+
+	rqs, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta metadata
+	status, err := provider.fetchJSON(rqs, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("provider discovery failed: %w", err)
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("provider discovery failed with status %d", status)
+	}
+
+	if meta.Issuer != provider.issuer {
+		return nil, fmt.Errorf("provider reports issuer '%s' instead of '%s'", meta.Issuer, provider.issuer)
+	}
+
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("provider configuration lacks an endpoint")
+	}
+
+	provider.metadata = &meta
+	return provider.metadata, nil
+}
+
+// key returns the signing key with the id, the key set is fetched again
+// when the id is unknown since providers rotate their keys.
+func (provider *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+
+	keys, err := provider.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key '%s'", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (provider *Provider) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	rqs, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	status, err := provider.fetchJSON(rqs, &keySet)
+	if err != nil {
+		return nil, fmt.Errorf("key set request failed: %w", err)
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("key set request failed with status %d", status)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus of key '%s': %w", jwk.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent of key '%s'", jwk.Kid)
+		}
+
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// fetchJSON decodes the response body into out for any status, providers
+// describe errors in JSON too.
+func (provider *Provider) fetchJSON(rqs *http.Request, out any) (int, error) {
+	rsp, err := provider.client.Do(rqs)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := json.Unmarshal(data, out); err != nil && rsp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("invalid response: %w", err)
+	}
+
+	return rsp.StatusCode, nil
+}
@@ -0,0 +1,96 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+)
+
+// login runs the flow up to the code the stand-in provider hands out.
+func login(t *testing.T, provider *Provider, verifier, nonce string) string {
+	target, err := provider.AuthCodeURL(context.Background(), "state", nonce, verifier)
+	require.NoError(t, err)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	rsp, err := client.Get(target)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	require.Equal(t, http.StatusFound, rsp.StatusCode)
+
+	location, err := url.Parse(rsp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "state", location.Query().Get("state"))
+
+	return location.Query().Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name     string
+		prepare  func(stub *testutils.OIDCProvider)
+		verifier string
+		wantErr  bool
+	}{
+		{name: "valid login"},
+		{name: "rotated key", prepare: func(stub *testutils.OIDCProvider) { stub.RotateKey() }},
+		{name: "nonce mismatch", prepare: func(stub *testutils.OIDCProvider) { stub.Nonce = "replayed" }, wantErr: true},
+		{name: "wrong code verifier", verifier: "guessed", wantErr: true},
+		{name: "other audience", prepare: func(stub *testutils.OIDCProvider) { stub.Audience = "other" }, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := testutils.NewOIDCProvider()
+			defer stub.Close()
+
+			cfg := testutils.LoadTestConfig()
+			cfg.OIDCIssuer = stub.URL
+			cfg.OIDCClientID = stub.ClientID
+			cfg.OIDCClientSecret = stub.ClientSecret
+			cfg.OIDCRedirectURL = "http://localhost:8080/callback"
+			provider := NewProvider(&cfg)
+
+			// the first login caches the signing key
+			_, err := provider.Exchange(context.Background(), login(t, provider, "verifier", "nonce"), "verifier", "nonce")
+			require.NoError(t, err)
+
+			if test.prepare != nil {
+				test.prepare(stub)
+			}
+
+			code := login(t, provider, "verifier", "nonce")
+			verifier := "verifier"
+			if test.verifier != "" {
+				verifier = test.verifier
+			}
+
+			identity, err := provider.Exchange(context.Background(), code, verifier, "nonce")
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, &Identity{Issuer: stub.URL, Subject: "alice", Email: "alice@example.com"}, identity)
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	stub := testutils.NewOIDCProvider()
+	defer stub.Close()
+
+	cfg := testutils.LoadTestConfig()
+	cfg.OIDCIssuer = stub.URL + "/tenant"
+	cfg.OIDCClientID = stub.ClientID
+	provider := NewProvider(&cfg)
+
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxRedirects matches the limit of the default client.
+const maxRedirects = 10
+
+// NewClient returns a client for requests to the targets of links. With
+// blockPrivate it refuses to connect into private networks, whatever name
+// resolved there, and to follow redirects pointing into them, so users
+// cannot make the server probe its own network.
+func NewClient(timeout time.Duration, blockPrivate bool) *http.Client {
+	if !blockPrivate {
+		return &http.Client{Timeout: timeout}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("address %s belongs to a private network", host)
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// a proxy would connect to the target out of reach of the dialer check
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+func checkRedirect(rqs *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	scheme := strings.ToLower(rqs.URL.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return fmt.Errorf("redirect to scheme '%s'", scheme)
+	}
+
+	if host := strings.ToLower(rqs.URL.Hostname()); isPrivateHost(host) {
+		return fmt.Errorf("redirect to host '%s' in a private network", host)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, rqs *http.Request) {
+		rsp.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	byName := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	t.Run("private addresses are refused", func(t *testing.T) {
+		client := NewClient(time.Second, true)
+
+		for _, target := range []string{server.URL, byName} {
+			_, err := client.Get(target)
+			assert.ErrorContains(t, err, "private network", target)
+		}
+	})
+
+	t.Run("redirects into private networks are refused", func(t *testing.T) {
+		client := NewClient(time.Second, true)
+
+		for _, target := range []string{"http://10.1.2.3/admin", "http://[::1]/", "http://localhost:8080/", "file:///etc/passwd"} {
+			rqs, err := http.NewRequest(http.MethodGet, target, nil)
+			require.NoError(t, err)
+			assert.Error(t, client.CheckRedirect(rqs, nil), target)
+		}
+
+		rqs, err := http.NewRequest(http.MethodGet, "https://www.foo.com/landing", nil)
+		require.NoError(t, err)
+		assert.NoError(t, client.CheckRedirect(rqs, nil))
+	})
+
+	t.Run("not blocking", func(t *testing.T) {
+		rsp, err := NewClient(time.Second, false).Get(byName)
+		require.NoError(t, err)
+		defer rsp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	})
+}
@@ -0,0 +1,21 @@
+package policy
+
+import "fmt"
+
+type ViolationError struct {
+	URL    string
+	Reason string
+}
+
+func (e *ViolationError) Error() string {
+	return fmt.Sprintf("URL '%s' rejected: %s", e.URL, e.Reason)
+}
+
+func (e *ViolationError) Is(target error) bool {
+	_, ok := target.(*ViolationError)
+	return ok
+}
+
+func NewViolationError(url, reason string) error {
+	return &ViolationError{URL: url, Reason: reason}
+}
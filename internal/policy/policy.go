@@ -0,0 +1,166 @@
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+)
+
+// Policy decides whether a long URL may be shortened: the scheme must be
+// whitelisted, the host must pass the domain allow/deny lists, must not point
+// into a private network and must not refer back to the shortener itself.
+type Policy struct {
+	schemes      map[string]struct{}
+	allowDomains []string
+	denyDomains  []string
+	blockPrivate bool
+	selfHosts    map[string]struct{}
+}
+
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	policy := &Policy{
+		schemes:      make(map[string]struct{}),
+		blockPrivate: cfg.BlockPrivateIPs,
+		selfHosts:    make(map[string]struct{}),
+	}
+
+	for _, scheme := range strings.Split(cfg.AllowedSchemes, ",") {
+		scheme = strings.ToLower(strings.TrimSpace(scheme))
+		if scheme != "" {
+			policy.schemes[scheme] = struct{}{}
+		}
+	}
+
+	if len(policy.schemes) == 0 {
+		return nil, fmt.Errorf("no allowed URL schemes configured")
+	}
+
+	if cfg.DomainListFile != "" {
+		if err := policy.loadDomainList(cfg.DomainListFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// any scheme and port of the own hosts may lead back to the shortener,
+	// a proxy in front of it could listen on each of them
+	if publishURL, err := url.Parse(cfg.PublishAddr.String()); err == nil && publishURL.Host != "" {
+		policy.selfHosts[canonicalHost(publishURL.Hostname())] = struct{}{}
+	}
+
+	if cfg.LaunchAddr.Host != "" {
+		policy.selfHosts[canonicalHost(cfg.LaunchAddr.Host)] = struct{}{}
+	}
+
+	return policy, nil
+}
+
+// loadDomainList reads a file of "allow <domain>" and "deny <domain>" lines.
+// Empty lines and lines starting with '#' are ignored.
+func (policy *Policy) loadDomainList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error reading domain list file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("domain list line %d: expected '<allow|deny> <domain>'", lineNum)
+		}
+
+		domain := strings.ToLower(strings.TrimPrefix(fields[1], "."))
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			policy.allowDomains = append(policy.allowDomains, domain)
+		case "deny":
+			policy.denyDomains = append(policy.denyDomains, domain)
+		default:
+			return fmt.Errorf("domain list line %d: unknown directive '%s'", lineNum, fields[0])
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (policy *Policy) Check(longURL string) error {
+	parsedURL, err := url.Parse(longURL)
+	if err != nil {
+		return NewViolationError(longURL, "invalid URL")
+	}
+
+	scheme := strings.ToLower(parsedURL.Scheme)
+	if _, ok := policy.schemes[scheme]; !ok {
+		return NewViolationError(longURL, fmt.Sprintf("scheme '%s' is not allowed", scheme))
+	}
+
+	host := strings.ToLower(parsedURL.Hostname())
+	if host == "" {
+		return NewViolationError(longURL, "URL has no host")
+	}
+
+	if _, ok := policy.selfHosts[canonicalHost(host)]; ok {
+		return NewViolationError(longURL, "URL points back to the shortener")
+	}
+
+	if policy.blockPrivate && isPrivateHost(host) {
+		return NewViolationError(longURL, fmt.Sprintf("host '%s' belongs to a private network", host))
+	}
+
+	if domain, ok := matchDomain(host, policy.denyDomains); ok {
+		return NewViolationError(longURL, fmt.Sprintf("domain '%s' is denied", domain))
+	}
+
+	if len(policy.allowDomains) != 0 {
+		if _, ok := matchDomain(host, policy.allowDomains); !ok {
+			return NewViolationError(longURL, fmt.Sprintf("domain '%s' is not in the allow list", host))
+		}
+	}
+
+	return nil
+}
+
+// matchDomain reports whether host equals one of the domains or is their subdomain.
+func matchDomain(host string, domains []string) (string, bool) {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain, true
+		}
+	}
+
+	return "", false
+}
+
+// isPrivateHost only inspects IP literals and localhost names, the host is not resolved.
+func isPrivateHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	return isPrivateIP(ip)
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+func canonicalHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
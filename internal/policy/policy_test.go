@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.DomainListFile = filepath.Join(t.TempDir(), "domains.txt")
+	domains := "# test list\ndeny evil.com\nallow foo.com\nallow bar.org\n"
+	require.NoError(t, os.WriteFile(cfg.DomainListFile, []byte(domains), 0644))
+
+	policy, err := NewPolicy(&cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		longURL string
+		allowed bool
+	}{
+		{name: "allowed domain", longURL: "https://www.foo.com/path", allowed: true},
+		{name: "allowed exact domain", longURL: "http://bar.org", allowed: true},
+		{name: "javascript scheme", longURL: "javascript:alert(1)", allowed: false},
+		{name: "file scheme", longURL: "file:///etc/passwd", allowed: false},
+		{name: "data scheme", longURL: "data:text/html,<b>hi</b>", allowed: false},
+		{name: "denied domain", longURL: "https://login.evil.com", allowed: false},
+		{name: "not in allow list", longURL: "https://www.baz.com", allowed: false},
+		{name: "self reference", longURL: "http://localhost:8080/6ySFbLgd", allowed: false},
+		{name: "private IP", longURL: "http://192.168.0.1/admin", allowed: false},
+		{name: "loopback IP", longURL: "http://127.0.0.1:9000", allowed: false},
+		{name: "no host", longURL: "https:///path", allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Check(test.longURL)
+			if test.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, &ViolationError{})
+			}
+		})
+	}
+}
+
+func TestCheckSelfReference(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.PublishAddr = "https://sho.rt"
+
+	policy, err := NewPolicy(&cfg)
+	require.NoError(t, err)
+
+	for _, longURL := range []string{
+		"https://sho.rt/abc",
+		"http://sho.rt/abc",
+		"https://sho.rt:8443/abc",
+		"https://SHO.RT./abc",
+	} {
+		assert.ErrorIs(t, policy.Check(longURL), &ViolationError{}, longURL)
+	}
+
+	assert.NoError(t, policy.Check("https://docs.sho.rt/abc"))
+}
@@ -0,0 +1,152 @@
+package rules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule sends visitors matching all of its non-empty conditions to Target.
+type Rule struct {
+	Device   string `json:"device,omitempty"`
+	Language string `json:"language,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Target   string `json:"target"`
+}
+
+const (
+	DeviceIOS     = "ios"
+	DeviceAndroid = "android"
+	DeviceMobile  = "mobile"
+	DeviceDesktop = "desktop"
+)
+
+func (rule *Rule) Validate() error {
+	if rule.Target == "" {
+		return fmt.Errorf("rule has no target")
+	}
+
+	if rule.Device == "" && rule.Language == "" && rule.Country == "" {
+		return fmt.Errorf("rule for '%s' has no conditions", rule.Target)
+	}
+
+	switch rule.Device {
+	case "", DeviceIOS, DeviceAndroid, DeviceMobile, DeviceDesktop:
+	default:
+		return fmt.Errorf("unknown device '%s'", rule.Device)
+	}
+
+	return nil
+}
+
+// Visitor describes a short link visit in the terms rules are written in.
+type Visitor struct {
+	Device    string
+	Languages []string
+	Country   string
+}
+
+func NewVisitor(userAgent, acceptLanguage, country string) Visitor {
+	return Visitor{
+		Device:    detectDevice(userAgent),
+		Languages: parseAcceptLanguage(acceptLanguage),
+		Country:   strings.ToUpper(country),
+	}
+}
+
+// Match returns the target of the first rule the visitor satisfies.
+func Match(rules []Rule, visitor Visitor) (string, bool) {
+	for _, rule := range rules {
+		if rule.matches(visitor) {
+			return rule.Target, true
+		}
+	}
+
+	return "", false
+}
+
+func (rule *Rule) matches(visitor Visitor) bool {
+	if rule.Device != "" && !matchDevice(rule.Device, visitor.Device) {
+		return false
+	}
+
+	if rule.Country != "" && !strings.EqualFold(rule.Country, visitor.Country) {
+		return false
+	}
+
+	if rule.Language != "" && !matchLanguage(rule.Language, visitor.Languages) {
+		return false
+	}
+
+	return true
+}
+
+func matchDevice(ruleDevice, visitorDevice string) bool {
+	if ruleDevice == DeviceMobile {
+		return visitorDevice == DeviceIOS || visitorDevice == DeviceAndroid
+	}
+
+	return ruleDevice == visitorDevice
+}
+
+// matchLanguage accepts "en" for any "en-*" tag, while "en-gb" only matches itself.
+func matchLanguage(ruleLanguage string, languages []string) bool {
+	ruleLanguage = strings.ToLower(ruleLanguage)
+	for _, language := range languages {
+		if language == ruleLanguage || strings.HasPrefix(language, ruleLanguage+"-") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func detectDevice(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(userAgent, "iphone"), strings.Contains(userAgent, "ipad"), strings.Contains(userAgent, "ipod"):
+		return DeviceIOS
+	case strings.Contains(userAgent, "android"):
+		return DeviceAndroid
+	default:
+		return DeviceDesktop
+	}
+}
+
+// parseAcceptLanguage returns the accepted language tags ordered by preference.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag     string
+		quality float64
+	}
+
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		if quality > 0 {
+			tags = append(tags, weighted{tag: tag, quality: quality})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].quality > tags[j].quality })
+
+	languages := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		languages = append(languages, tag.tag)
+	}
+
+	return languages
+}
@@ -0,0 +1,67 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{
+		{Device: "ios", Target: "https://apps.apple.com/app/foo"},
+		{Device: "android", Target: "https://play.google.com/store/apps/details?id=foo"},
+		{Language: "de", Country: "AT", Target: "https://foo.at"},
+		{Language: "de", Target: "https://foo.de"},
+	}
+
+	tests := []struct {
+		name           string
+		userAgent      string
+		acceptLanguage string
+		country        string
+		target         string
+		matched        bool
+	}{
+		{
+			name:      "iphone",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)",
+			target:    "https://apps.apple.com/app/foo",
+			matched:   true,
+		},
+		{
+			name:      "android",
+			userAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8)",
+			target:    "https://play.google.com/store/apps/details?id=foo",
+			matched:   true,
+		},
+		{
+			name:           "language and country",
+			userAgent:      "Mozilla/5.0 (X11; Linux x86_64)",
+			acceptLanguage: "de-AT,de;q=0.9,en;q=0.8",
+			country:        "at",
+			target:         "https://foo.at",
+			matched:        true,
+		},
+		{
+			name:           "secondary language",
+			userAgent:      "Mozilla/5.0 (Windows NT 10.0)",
+			acceptLanguage: "en-US,de;q=0.5",
+			country:        "US",
+			target:         "https://foo.de",
+			matched:        true,
+		},
+		{
+			name:           "fallback",
+			userAgent:      "Mozilla/5.0 (Windows NT 10.0)",
+			acceptLanguage: "en-US,de;q=0",
+			matched:        false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, matched := Match(rules, NewVisitor(test.userAgent, test.acceptLanguage, test.country))
+			assert.Equal(t, test.matched, matched)
+			assert.Equal(t, test.target, target)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// Login returns the user of the account bound to the external identity.
+// The first login turns the anonymous user of the visitor into the account,
+// later logins move the links of an anonymous visitor into it. A visitor
+// signed in to another account keeps its data.
+func (service *URLService) Login(ctx context.Context, issuer, subject, email string) (string, error) {
+	currentUserID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	anonymous, err := service.isAnonymous(ctx, currentUserID)
+	if err != nil {
+		return "", err
+	}
+
+	account, err := service.urlStorage.TryGetAccount(ctx, issuer, subject)
+	if errors.Is(err, &storage.NotFoundError{}) {
+		account = &storage.Account{
+			Issuer:    issuer,
+			Subject:   subject,
+			UserID:    currentUserID,
+			Email:     email,
+			CreatedAt: time.Now(),
+		}
+
+		if !anonymous {
+			account.UserID = uuid.New().String()
+		}
+
+		if err := service.urlStorage.StoreAccount(ctx, *account); err != nil {
+			return "", err
+		}
+
+		log.Printf("Created account %s for user %s", subject, account.UserID)
+		return account.UserID, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if anonymous && currentUserID != account.UserID {
+		if err := service.urlStorage.MergeUser(ctx, currentUserID, account.UserID); err != nil {
+			return "", err
+		}
+
+		log.Printf("Merged user %s into account %s", currentUserID, subject)
+	}
+
+	return account.UserID, nil
+}
+
+func (service *URLService) isAnonymous(ctx context.Context, userID string) (bool, error) {
+	_, err := service.urlStorage.TryGetUserAccount(ctx, userID)
+	if errors.Is(err, &storage.NotFoundError{}) {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// CurrentUser returns the user from the context and its account, the
+// account is nil for anonymous users.
+func (service *URLService) CurrentUser(ctx context.Context) (string, *storage.Account, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	account, err := service.urlStorage.TryGetUserAccount(ctx, userID)
+	if errors.Is(err, &storage.NotFoundError{}) {
+		return userID, nil, nil
+	}
+
+	return userID, account, err
+}
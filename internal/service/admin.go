@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+const (
+	defaultAdminSearchLimit = 50
+	maxAdminSearchLimit     = 500
+	maxDisableReasonLength  = 512
+)
+
+// requireAdmin returns the user from the context if it is an operator.
+func (service *URLService) requireAdmin(ctx context.Context) (string, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if !service.cfg.IsAdmin(userID) {
+		return "", NewForbiddenError("operator role is required")
+	}
+
+	return userID, nil
+}
+
+// AdminSearch finds links by short URL or by a part of the target, a
+// limit out of range is replaced by the default or the maximum.
+func (service *URLService) AdminSearch(ctx context.Context, query string, limit int) ([]storage.URLRecord, error) {
+	if _, err := service.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, NewInvalidRequestError("search query is empty")
+	}
+
+	if limit <= 0 {
+		limit = defaultAdminSearchLimit
+	}
+	limit = min(limit, maxAdminSearchLimit)
+
+	return service.urlStorage.SearchURLs(ctx, query, limit)
+}
+
+func (service *URLService) AdminGetURL(ctx context.Context, shortURL string) (*storage.URLRecord, error) {
+	if _, err := service.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	record, err := service.urlStorage.TryGetURL(ctx, shortURL)
+	if err != nil {
+		return nil, storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	return record, nil
+}
+
+// AdminSetDisabled takes the link down or brings it back, the reason is
+// shown to the owner and dropped on enabling.
+func (service *URLService) AdminSetDisabled(ctx context.Context, shortURL string, disabled bool, reason string) (*storage.URLRecord, error) {
+	adminID, err := service.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDisableReason(reason); err != nil {
+		return nil, err
+	}
+
+	record, err := service.urlStorage.TryGetURL(ctx, shortURL)
+	if err != nil {
+		return nil, storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	if !disabled {
+		reason = ""
+	}
+
+	if err := service.urlStorage.SetDisabled(ctx, []string{shortURL}, disabled, reason); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Operator %s set disabled=%t for %s: %s", adminID, disabled, shortURL, reason)
+	action := audit.ActionDisable
+	if !disabled {
+		action = audit.ActionRestore
+	}
+	service.record(ctx, action, shortURL, record.UserID,
+		map[string]any{"disabled": record.Disabled, "disabled_reason": record.DisabledReason},
+		map[string]any{"disabled": disabled, "disabled_reason": reason})
+
+	record.Disabled = disabled
+	record.DisabledReason = reason
+	return record, nil
+}
+
+// AdminTransfer makes the user the owner of the link, the team the link is
+// shared with keeps access.
+func (service *URLService) AdminTransfer(ctx context.Context, shortURL, userID string) (*storage.URLRecord, error) {
+	adminID, err := service.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if userID == "" {
+		return nil, NewInvalidRequestError("new owner is empty")
+	}
+
+	record, err := service.urlStorage.TryGetURL(ctx, shortURL)
+	if err != nil {
+		return nil, storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	if err := service.urlStorage.SetOwner(ctx, shortURL, userID); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Operator %s transferred %s from %s to %s", adminID, shortURL, record.UserID, userID)
+	service.record(ctx, audit.ActionTransfer, shortURL, record.UserID,
+		map[string]any{"user_id": record.UserID}, map[string]any{"user_id": userID})
+
+	record.UserID = userID
+	return record, nil
+}
+
+func (service *URLService) AdminGetUserURLs(ctx context.Context, userID string) ([]storage.URLRecord, error) {
+	if _, err := service.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	return service.urlStorage.GetUserURLs(ctx, userID, "")
+}
+
+// AdminDisableUser disables every live link of the user and returns how
+// many were disabled.
+func (service *URLService) AdminDisableUser(ctx context.Context, userID, reason string) (int, error) {
+	adminID, err := service.requireAdmin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkDisableReason(reason); err != nil {
+		return 0, err
+	}
+
+	records, err := service.urlStorage.GetUserURLs(ctx, userID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	shortURLs := make([]string, 0, len(records))
+	for _, record := range records {
+		if !record.Deleted && !record.Disabled {
+			shortURLs = append(shortURLs, record.ShortURL)
+		}
+	}
+
+	if err := service.urlStorage.SetDisabled(ctx, shortURLs, true, reason); err != nil {
+		return 0, err
+	}
+
+	for _, shortURL := range shortURLs {
+		service.record(ctx, audit.ActionDisable, shortURL, userID,
+			map[string]any{"disabled": false}, map[string]any{"disabled": true, "disabled_reason": reason})
+	}
+
+	log.Printf("Operator %s disabled %d links of %s: %s", adminID, len(shortURLs), userID, reason)
+	return len(shortURLs), nil
+}
+
+func checkDisableReason(reason string) error {
+	if utf8.RuneCountInString(reason) > maxDisableReasonLength {
+		return NewInvalidRequestError(fmt.Sprintf("reason is longer than %d characters", maxDisableReasonLength))
+	}
+
+	return nil
+}
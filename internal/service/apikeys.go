@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// Scopes limit what an API key may be used for.
+const (
+	ScopeShorten = "shorten"
+	ScopeRead    = "read"
+	ScopeDelete  = "delete"
+
+	// ScopeAdmin is only granted to keys of operators and never by default
+	ScopeAdmin = "admin"
+)
+
+var allScopes = []string{ScopeShorten, ScopeRead, ScopeDelete}
+
+const (
+	apiKeyPrefix        = "usk_"
+	maxAPIKeyNameLength = 64
+
+	// apiKeyUsedResolution keeps busy keys from being written on every request
+	apiKeyUsedResolution = time.Minute
+)
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey returns the new key, it is only available here since just its hash is stored.
+// A key without scopes gets all of them.
+func (service *URLService) CreateAPIKey(ctx context.Context, name string, scopes []string) (string, *storage.APIKey, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(name) > maxAPIKeyNameLength {
+		return "", nil, NewInvalidRequestError(fmt.Sprintf("key name is longer than %d characters", maxAPIKeyNameLength))
+	}
+
+	if len(scopes) == 0 {
+		scopes = allScopes
+	}
+
+	for _, scope := range scopes {
+		if scope == ScopeAdmin && !service.cfg.IsAdmin(userID) {
+			return "", nil, NewForbiddenError("only operators may create admin keys")
+		}
+
+		if !slices.Contains(allScopes, scope) && scope != ScopeAdmin {
+			return "", nil, NewInvalidRequestError(fmt.Sprintf("unknown scope '%s'", scope))
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	scopes = slices.Clone(scopes)
+	slices.Sort(scopes)
+
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	key := storage.APIKey{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      name,
+		Hash:      hashAPIKey(token),
+		Scopes:    slices.Compact(scopes),
+		CreatedAt: time.Now(),
+	}
+
+	if err := service.urlStorage.StoreAPIKey(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	return token, &key, nil
+}
+
+func (service *URLService) GetAPIKeys(ctx context.Context) ([]storage.APIKey, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.urlStorage.GetAPIKeys(ctx, userID)
+}
+
+func (service *URLService) RevokeAPIKey(ctx context.Context, id string) error {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	return service.urlStorage.RevokeAPIKey(ctx, userID, id)
+}
+
+// VerifyAPIKey resolves an API key to its user and scopes.
+func (service *URLService) VerifyAPIKey(ctx context.Context, token string) (string, []string, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return "", nil, NewUnauthorizedError("malformed API key")
+	}
+
+	key, err := service.urlStorage.TryGetAPIKey(ctx, hashAPIKey(token))
+	if err != nil {
+		if errors.Is(err, &storage.NotFoundError{}) {
+			return "", nil, NewUnauthorizedError("unknown API key")
+		}
+		return "", nil, err
+	}
+
+	if key.Revoked {
+		return "", nil, NewUnauthorizedError("API key has been revoked")
+	}
+
+	now := time.Now()
+	if now.Sub(key.LastUsed) >= apiKeyUsedResolution {
+		if err := service.urlStorage.SetAPIKeyUsed(ctx, key.ID, now); err != nil {
+			log.Printf("Failed to update last use of API key %s: %v", key.ID, err)
+		}
+	}
+
+	return key.UserID, key.Scopes, nil
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// SetAudit enables the audit log of link changes and operator actions.
+func (service *URLService) SetAudit(sink audit.Sink) {
+	service.audit = sink
+}
+
+// record appends an event done by the user of the context to the audit log,
+// a failure to write it is logged and does not undo the action. Events of a
+// batch are written once it is committed.
+func (service *URLService) record(ctx context.Context, action, shortURL, userID string, before, after map[string]any) {
+	if service.audit == nil {
+		return
+	}
+
+	actorID, _ := storage.GetUserID(ctx)
+	event := audit.Event{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		ActorID:  actorID,
+		ClientIP: audit.ClientIP(ctx),
+		ShortURL: shortURL,
+		UserID:   userID,
+		Before:   before,
+		After:    after,
+	}
+
+	if pending, ok := ctx.Value(batchKey{}).(*pendingBatch); ok {
+		pending.events = append(pending.events, event)
+		return
+	}
+
+	service.writeEvent(ctx, event)
+}
+
+func (service *URLService) writeEvent(ctx context.Context, event audit.Event) {
+	if err := service.audit.Record(ctx, event); err != nil {
+		log.Printf("Failed to record %s of %s in the audit log: %v", event.Action, event.ShortURL, err)
+	}
+}
+
+func (service *URLService) AdminQueryAudit(ctx context.Context, filter audit.Filter) ([]audit.Event, error) {
+	if _, err := service.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if service.audit == nil {
+		return []audit.Event{}, nil
+	}
+
+	return service.audit.Query(ctx, filter)
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+type InvalidRequestError struct {
+	Reason string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return fmt.Sprintf("invalid request: %s", e.Reason)
+}
+
+func (e *InvalidRequestError) Is(target error) bool {
+	_, ok := target.(*InvalidRequestError)
+	return ok
+}
+
+func NewInvalidRequestError(reason string) error {
+	return &InvalidRequestError{Reason: reason}
+}
+
+type ForbiddenError struct {
+	Reason string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("forbidden: %s", e.Reason)
+}
+
+func (e *ForbiddenError) Is(target error) bool {
+	_, ok := target.(*ForbiddenError)
+	return ok
+}
+
+func NewForbiddenError(reason string) error {
+	return &ForbiddenError{Reason: reason}
+}
+
+type WrongPasswordError struct{}
+
+func (e *WrongPasswordError) Error() string {
+	return "wrong link password"
+}
+
+func (e *WrongPasswordError) Is(target error) bool {
+	_, ok := target.(*WrongPasswordError)
+	return ok
+}
+
+func NewWrongPasswordError() error {
+	return &WrongPasswordError{}
+}
+
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *TooManyAttemptsError) Is(target error) bool {
+	_, ok := target.(*TooManyAttemptsError)
+	return ok
+}
+
+func NewTooManyAttemptsError(retryAfter time.Duration) error {
+	return &TooManyAttemptsError{RetryAfter: retryAfter}
+}
+
+type UnauthorizedError struct {
+	Reason string
+}
+
+func (e *UnauthorizedError) Error() string {
+	return fmt.Sprintf("unauthorized: %s", e.Reason)
+}
+
+func (e *UnauthorizedError) Is(target error) bool {
+	_, ok := target.(*UnauthorizedError)
+	return ok
+}
+
+func NewUnauthorizedError(reason string) error {
+	return &UnauthorizedError{Reason: reason}
+}
+
+// QuotaExceededError rejects a link the user has no quota left for,
+// RetryAfter is set when the quota frees up by itself.
+type QuotaExceededError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("quota exceeded: %s, retry in %s", e.Reason, e.RetryAfter.Round(time.Second))
+	}
+
+	return fmt.Sprintf("quota exceeded: %s", e.Reason)
+}
+
+func (e *QuotaExceededError) Is(target error) bool {
+	_, ok := target.(*QuotaExceededError)
+	return ok
+}
+
+func NewQuotaExceededError(reason string, retryAfter time.Duration) error {
+	return &QuotaExceededError{Reason: reason, RetryAfter: retryAfter}
+}
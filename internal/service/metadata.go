@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+const (
+	maxTagsPerLink = 20
+	maxNoteLength  = 4096
+)
+
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}_.:-]{1,64}$`)
+
+// MetadataUpdate changes the link attributes that are not nil, an empty
+// Team stops sharing the link.
+type MetadataUpdate struct {
+	Title *string
+	Note  *string
+	Tags  *[]string
+	Team  *string
+}
+
+// normalizeTags lowercases the tags and drops duplicates, the result is sorted.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxTagsPerLink {
+		return nil, NewInvalidRequestError(fmt.Sprintf("at most %d tags are allowed", maxTagsPerLink))
+	}
+
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, NewInvalidRequestError(fmt.Sprintf("invalid tag '%s'", tag))
+		}
+
+		normalized = append(normalized, tag)
+	}
+
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+func checkNote(note string) error {
+	if utf8.RuneCountInString(note) > maxNoteLength {
+		return NewInvalidRequestError(fmt.Sprintf("note is longer than %d characters", maxNoteLength))
+	}
+
+	return nil
+}
+
+func (service *URLService) UpdateMetadata(ctx context.Context, shortURL string, update MetadataUpdate) (*storage.URLRecord, error) {
+	record, err := service.accessRecord(ctx, shortURL, RoleEditor)
+	if err != nil {
+		return nil, err
+	}
+
+	before, after := make(map[string]any), make(map[string]any)
+	moved := update.Team != nil && *update.Team != record.TeamID
+	if moved && *update.Team != "" {
+		if _, err := service.requireRole(ctx, *update.Team, RoleEditor); err != nil {
+			return nil, err
+		}
+	}
+
+	if update.Title != nil {
+		before["title"], after["title"] = record.Title, *update.Title
+		record.Title = *update.Title
+	}
+
+	if update.Note != nil {
+		if err := checkNote(*update.Note); err != nil {
+			return nil, err
+		}
+		before["note"], after["note"] = record.Note, *update.Note
+		record.Note = *update.Note
+	}
+
+	if update.Tags != nil {
+		before["tags"] = record.Tags
+		if record.Tags, err = normalizeTags(*update.Tags); err != nil {
+			return nil, err
+		}
+		after["tags"] = record.Tags
+	}
+
+	if err := service.urlStorage.SetMetadata(ctx, shortURL, record.Title, record.Note, record.Tags); err != nil {
+		return nil, err
+	}
+
+	if moved {
+		if err := service.urlStorage.SetTeam(ctx, shortURL, *update.Team); err != nil {
+			return nil, err
+		}
+		before["team"], after["team"] = record.TeamID, *update.Team
+		record.TeamID = *update.Team
+	}
+
+	service.record(ctx, audit.ActionEdit, shortURL, record.UserID, before, after)
+	return record, nil
+}
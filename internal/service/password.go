@@ -0,0 +1,101 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// attemptLimiter allows at most limit failed attempts per key within window.
+type attemptLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, failures: make(map[string][]time.Time)}
+}
+
+// recent drops the failures that left the window and returns the rest.
+func (limiter *attemptLimiter) recent(key string, now time.Time) []time.Time {
+	failures := limiter.failures[key]
+	for len(failures) > 0 && now.Sub(failures[0]) >= limiter.window {
+		failures = failures[1:]
+	}
+
+	if len(failures) == 0 {
+		delete(limiter.failures, key)
+	} else {
+		limiter.failures[key] = failures
+	}
+
+	return failures
+}
+
+func (limiter *attemptLimiter) check(key string) error {
+	if limiter.limit <= 0 {
+		return nil
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	failures := limiter.recent(key, now)
+	if len(failures) >= limiter.limit {
+		return NewTooManyAttemptsError(failures[0].Add(limiter.window).Sub(now))
+	}
+
+	return nil
+}
+
+func (limiter *attemptLimiter) fail(key string) {
+	if limiter.limit <= 0 {
+		return
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	limiter.failures[key] = append(limiter.recent(key, now), now)
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", NewInvalidRequestError(err.Error())
+	}
+
+	return string(hash), err
+}
+
+// CheckPassword verifies the password of a protected link, failed attempts
+// are limited per link to slow down guessing.
+func (service *URLService) CheckPassword(record *storage.URLRecord, password string) error {
+	if record.PasswordHash == "" {
+		return nil
+	}
+
+	if err := service.passwordAttempts.check(record.ShortURL); err != nil {
+		return err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(password)) != nil {
+		service.passwordAttempts.fail(record.ShortURL)
+		return NewWrongPasswordError()
+	}
+
+	return nil
+}
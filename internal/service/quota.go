@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+	"github.com/rvkarpov/url_shortener/internal/urlutils"
+)
+
+// quotaWindow is the period the daily link quota counts creations over.
+const quotaWindow = 24 * time.Hour
+
+// Quota is what limits the link creation of a user, a limit of 0 means
+// unlimited. Custom is set when an operator overrode the configured limits.
+type Quota struct {
+	MaxActive int
+	MaxDaily  int
+	Custom    bool
+}
+
+// QuotaStatus is the quota of a user together with what is used of it.
+type QuotaStatus struct {
+	Quota
+	Usage storage.Usage
+}
+
+func (service *URLService) quota(ctx context.Context, userID string) (*Quota, error) {
+	quota := &Quota{MaxActive: service.cfg.MaxActiveLinks, MaxDaily: service.cfg.MaxDailyLinks}
+
+	override, err := service.urlStorage.TryGetQuota(ctx, userID)
+	if errors.Is(err, &storage.NotFoundError{}) {
+		return quota, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	quota.Custom = true
+	if override.MaxActive >= 0 {
+		quota.MaxActive = override.MaxActive
+	}
+	if override.MaxDaily >= 0 {
+		quota.MaxDaily = override.MaxDaily
+	}
+
+	return quota, nil
+}
+
+// CheckQuota reports whether the user of the context may create count more
+// links, without a user there is nothing to count against. The quota is
+// enforced again as each link is stored.
+func (service *URLService) CheckQuota(ctx context.Context, count int) error {
+	now := time.Now()
+	if clientIP, anonymous := storage.NewSessionIP(ctx); anonymous {
+		limit := service.anonymousLimit()
+		if limit == 0 {
+			return nil
+		}
+
+		if retryAfter, ok := service.anonymousLinks.room(clientIP, limit, count, now); !ok {
+			return anonymousQuotaError(limit, count, retryAfter)
+		}
+
+		return nil
+	}
+
+	userID, err := storage.GetUserID(ctx)
+	if err != nil || userID == "" {
+		return nil
+	}
+
+	quota, err := service.quota(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if quota.MaxActive == 0 && quota.MaxDaily == 0 {
+		return nil
+	}
+
+	usage, err := service.urlStorage.GetUsage(ctx, userID, now.Add(-quotaWindow))
+	if err != nil {
+		return err
+	}
+
+	return quotaError(quota, usage, count, now)
+}
+
+// CheckBatchQuota checks the quota for the links of a batch that would be
+// new, links stored before and repeated ones do not count.
+func (service *URLService) CheckBatchQuota(ctx context.Context, longURLs []string, batchOpts []LinkOptions) error {
+	count := 0
+	seen := make(map[string]bool)
+	for i, longURL := range longURLs {
+		if batchOpts[i].ownCode() {
+			count++
+			continue
+		}
+
+		shortURL := urlutils.GenerateShortURL(longURL, service.cfg.ShortURLLen)
+		if seen[shortURL] {
+			continue
+		}
+		seen[shortURL] = true
+
+		if _, err := service.urlStorage.TryGetURL(ctx, shortURL); err != nil {
+			count++
+		}
+	}
+
+	return service.CheckQuota(ctx, count)
+}
+
+// quotaError returns the error for creating count more links, nil if they
+// fit the quota.
+func quotaError(quota *Quota, usage *storage.Usage, count int, now time.Time) error {
+	if quota.MaxActive > 0 && usage.Active+count > quota.MaxActive {
+		return NewQuotaExceededError(fmt.Sprintf("at most %d links, delete some to create new ones", quota.MaxActive), 0)
+	}
+
+	if quota.MaxDaily > 0 && usage.Created+count > quota.MaxDaily {
+		reason := fmt.Sprintf("at most %d links per day", quota.MaxDaily)
+		if count > quota.MaxDaily || usage.Created == 0 {
+			return NewQuotaExceededError(reason, 0)
+		}
+
+		return NewQuotaExceededError(reason, max(usage.FirstCreated.Add(quotaWindow).Sub(now), time.Second))
+	}
+
+	return nil
+}
+
+func anonymousQuotaError(limit, count int, retryAfter time.Duration) error {
+	reason := fmt.Sprintf("at most %d links per day without a session", limit)
+	if count > limit {
+		return NewQuotaExceededError(reason, 0)
+	}
+
+	return NewQuotaExceededError(reason, retryAfter)
+}
+
+// anonymousLimit is what requests without a session may create per client
+// address within the quota window, the lower configured quota or 0.
+func (service *URLService) anonymousLimit() int {
+	if service.cfg.MaxActiveLinks == 0 || service.cfg.MaxDailyLinks == 0 {
+		return max(service.cfg.MaxActiveLinks, service.cfg.MaxDailyLinks)
+	}
+
+	return min(service.cfg.MaxActiveLinks, service.cfg.MaxDailyLinks)
+}
+
+// storeURL stores a new link within the quota of its user. Counting and
+// storing happen at once in storage, so concurrent creations cannot pass
+// the quota together. Requests without a session have a user that was only
+// created for them, their links count against the client address instead.
+func (service *URLService) storeURL(ctx context.Context, record storage.URLRecord) error {
+	now := time.Now()
+	if clientIP, anonymous := storage.NewSessionIP(ctx); anonymous {
+		limit := service.anonymousLimit()
+		if limit == 0 {
+			return service.urlStorage.StoreURL(ctx, record)
+		}
+
+		if retryAfter, ok := service.anonymousLinks.reserve(clientIP, limit, now); !ok {
+			// stored links cost nothing, report them as for everyone else
+			if _, err := service.urlStorage.TryGetURL(ctx, record.ShortURL); err == nil {
+				return storage.NewDuplicateURLError(record.ShortURL)
+			}
+
+			return anonymousQuotaError(limit, 1, retryAfter)
+		}
+
+		err := service.urlStorage.StoreURL(ctx, record)
+		if err != nil {
+			service.anonymousLinks.release(clientIP, now)
+		}
+
+		return err
+	}
+
+	userID, err := storage.GetUserID(ctx)
+	if err != nil || userID == "" {
+		return service.urlStorage.StoreURL(ctx, record)
+	}
+
+	quota, err := service.quota(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if quota.MaxActive == 0 && quota.MaxDaily == 0 {
+		return service.urlStorage.StoreURL(ctx, record)
+	}
+
+	err = service.urlStorage.StoreURLLimited(ctx, record, storage.Limits{
+		MaxActive: quota.MaxActive,
+		MaxDaily:  quota.MaxDaily,
+		Since:     now.Add(-quotaWindow),
+	})
+
+	var limitErr *storage.LimitError
+	if errors.As(err, &limitErr) {
+		return quotaError(quota, &limitErr.Usage, 1, now)
+	}
+
+	return err
+}
+
+// addressLinks counts the links created per client address over the quota
+// window, entries of addresses that created nothing within it are swept.
+type addressLinks struct {
+	mu        sync.Mutex
+	created   map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newAddressLinks() *addressLinks {
+	return &addressLinks{created: make(map[string][]time.Time)}
+}
+
+// room reports whether the address may create count more links, if not it
+// returns when the oldest counted link leaves the window.
+func (links *addressLinks) room(clientIP string, limit, count int, now time.Time) (time.Duration, bool) {
+	links.mu.Lock()
+	defer links.mu.Unlock()
+
+	created := links.recent(clientIP, now)
+	if len(created)+count <= limit {
+		return 0, true
+	}
+
+	if len(created) == 0 {
+		return 0, false
+	}
+
+	return max(created[0].Add(quotaWindow).Sub(now), time.Second), false
+}
+
+// reserve counts a link of the address if it has room for it.
+func (links *addressLinks) reserve(clientIP string, limit int, now time.Time) (time.Duration, bool) {
+	links.mu.Lock()
+	defer links.mu.Unlock()
+
+	links.sweep(now)
+
+	created := links.recent(clientIP, now)
+	if len(created) >= limit {
+		return max(created[0].Add(quotaWindow).Sub(now), time.Second), false
+	}
+
+	links.created[clientIP] = append(created, now)
+	return 0, true
+}
+
+// release drops a reservation whose link was not stored.
+func (links *addressLinks) release(clientIP string, at time.Time) {
+	links.mu.Lock()
+	defer links.mu.Unlock()
+
+	created := links.created[clientIP]
+	for i := len(created) - 1; i >= 0; i-- {
+		if created[i].Equal(at) {
+			links.created[clientIP] = append(created[:i], created[i+1:]...)
+			return
+		}
+	}
+}
+
+// recent drops the links of the address that left the window, it is called
+// with the lock held.
+func (links *addressLinks) recent(clientIP string, now time.Time) []time.Time {
+	created := links.created[clientIP]
+	start := 0
+	for start < len(created) && !created[start].After(now.Add(-quotaWindow)) {
+		start++
+	}
+
+	if start == len(created) {
+		delete(links.created, clientIP)
+		return nil
+	}
+
+	links.created[clientIP] = created[start:]
+	return created[start:]
+}
+
+// sweep forgets the addresses without links in the window, at most once per
+// window. It is called with the lock held.
+func (links *addressLinks) sweep(now time.Time) {
+	if now.Sub(links.lastSweep) < quotaWindow {
+		return
+	}
+	links.lastSweep = now
+
+	for clientIP := range links.created {
+		links.recent(clientIP, now)
+	}
+}
+
+// quotaValues returns the quota override of the user for the audit log, nil
+// if the user has none.
+func (service *URLService) quotaValues(ctx context.Context, userID string) map[string]any {
+	override, err := service.urlStorage.TryGetQuota(ctx, userID)
+	if err != nil {
+		return nil
+	}
+
+	return map[string]any{"max_active": override.MaxActive, "max_daily": override.MaxDaily}
+}
+
+func (service *URLService) AdminGetQuota(ctx context.Context, userID string) (*QuotaStatus, error) {
+	if _, err := service.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	quota, err := service.quota(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := service.urlStorage.GetUsage(ctx, userID, time.Now().Add(-quotaWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	return &QuotaStatus{Quota: *quota, Usage: *usage}, nil
+}
+
+// AdminSetQuota overrides the limits of the user, a nil limit keeps the
+// configured one.
+func (service *URLService) AdminSetQuota(ctx context.Context, userID string, maxActive, maxDaily *int) (*QuotaStatus, error) {
+	adminID, err := service.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	override := storage.Quota{UserID: userID, MaxActive: -1, MaxDaily: -1}
+	if maxActive != nil {
+		if *maxActive < 0 {
+			return nil, NewInvalidRequestError("max_active must not be negative")
+		}
+		override.MaxActive = *maxActive
+	}
+	if maxDaily != nil {
+		if *maxDaily < 0 {
+			return nil, NewInvalidRequestError("max_daily must not be negative")
+		}
+		override.MaxDaily = *maxDaily
+	}
+
+	before := service.quotaValues(ctx, userID)
+	if err := service.urlStorage.SetQuota(ctx, override); err != nil {
+		return nil, err
+	}
+
+	service.record(ctx, audit.ActionQuota, "", userID, before,
+		map[string]any{"max_active": override.MaxActive, "max_daily": override.MaxDaily})
+
+	log.Printf("Operator %s set quota of %s: active %d, daily %d", adminID, userID, override.MaxActive, override.MaxDaily)
+	return service.AdminGetQuota(ctx, userID)
+}
+
+func (service *URLService) AdminDeleteQuota(ctx context.Context, userID string) error {
+	adminID, err := service.requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	before := service.quotaValues(ctx, userID)
+	if err := service.urlStorage.DeleteQuota(ctx, userID); err != nil {
+		return err
+	}
+
+	service.record(ctx, audit.ActionQuota, "", userID, before, nil)
+
+	log.Printf("Operator %s reset quota of %s", adminID, userID)
+	return nil
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/geoip"
+	"github.com/rvkarpov/url_shortener/internal/rules"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+const maxRulesPerLink = 50
+
+// SetGeoIP enables country conditions of redirect rules.
+func (service *URLService) SetGeoIP(geoDB *geoip.DB) {
+	service.geoDB = geoDB
+}
+
+// accessRecord returns the link if the user from the context created it or
+// has at least the role in the team the link is shared with.
+func (service *URLService) accessRecord(ctx context.Context, shortURL, role string) (*storage.URLRecord, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := service.urlStorage.TryGetURL(ctx, shortURL)
+	if err != nil {
+		return nil, storage.NewNotFoundError("short URL", shortURL)
+	}
+
+	if record.UserID == userID {
+		return record, nil
+	}
+
+	if record.TeamID != "" {
+		member, err := service.urlStorage.TryGetMember(ctx, record.TeamID, userID)
+		if err == nil && roleRanks[member.Role] >= roleRanks[role] {
+			return record, nil
+		}
+	}
+
+	return nil, NewForbiddenError(fmt.Sprintf("short URL '%s' belongs to another user", shortURL))
+}
+
+func (service *URLService) GetRules(ctx context.Context, shortURL string) ([]rules.Rule, error) {
+	record, err := service.accessRecord(ctx, shortURL, RoleViewer)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Rules, nil
+}
+
+func (service *URLService) SetRules(ctx context.Context, shortURL string, redirectRules []rules.Rule) error {
+	record, err := service.accessRecord(ctx, shortURL, RoleEditor)
+	if err != nil {
+		return err
+	}
+
+	// the code is handed to everyone shortening the URL, rules would
+	// redirect their visitors too
+	if len(redirectRules) > 0 && sharedCode(record) {
+		return NewInvalidRequestError(fmt.Sprintf(
+			"short URL '%s' is shared by everyone shortening its URL, create a link with \"own_code\" for rules", shortURL))
+	}
+
+	if len(redirectRules) > maxRulesPerLink {
+		return NewInvalidRequestError(fmt.Sprintf("at most %d rules are allowed", maxRulesPerLink))
+	}
+
+	for _, rule := range redirectRules {
+		if err := rule.Validate(); err != nil {
+			return NewInvalidRequestError(err.Error())
+		}
+
+		if err := service.CheckLongURL(rule.Target); err != nil {
+			return err
+		}
+	}
+
+	if err := service.urlStorage.SetRules(ctx, shortURL, redirectRules); err != nil {
+		return err
+	}
+
+	service.record(ctx, audit.ActionEdit, shortURL, record.UserID,
+		map[string]any{"rules": record.Rules}, map[string]any{"rules": redirectRules})
+	return nil
+}
+
+// Visit describes a redirect request in the terms targets are selected by.
+type Visit struct {
+	UserAgent      string
+	AcceptLanguage string
+	ClientIP       string
+
+	// StickyVariant is the variant index served on an earlier visit, -1 if none.
+	StickyVariant int
+}
+
+// SelectTarget picks the target of the first rule matching the visitor,
+// then one of the weighted variants, and falls back to the link long URL.
+// The returned index is the served variant or -1.
+func (service *URLService) SelectTarget(record *storage.URLRecord, visit Visit) (string, int) {
+	if len(record.Rules) != 0 {
+		country := ""
+		if service.geoDB != nil {
+			country, _ = service.geoDB.Lookup(visit.ClientIP)
+		}
+
+		visitor := rules.NewVisitor(visit.UserAgent, visit.AcceptLanguage, country)
+		if target, ok := rules.Match(record.Rules, visitor); ok {
+			return target, -1
+		}
+	}
+
+	if variant := pickVariant(record.Variants, visit.StickyVariant); variant >= 0 {
+		return record.Variants[variant].URL, variant
+	}
+
+	return record.LongURL, -1
+}
@@ -2,43 +2,458 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/blocklist"
 	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/geoip"
+	"github.com/rvkarpov/url_shortener/internal/metafetch"
+	"github.com/rvkarpov/url_shortener/internal/policy"
 	"github.com/rvkarpov/url_shortener/internal/storage"
 	"github.com/rvkarpov/url_shortener/internal/urlutils"
 )
 
+// LinkOptions are the optional link attributes set by the owner on creation.
+type LinkOptions struct {
+	Title        string
+	Note         string
+	Tags         []string
+	RedirectCode int
+
+	Passthrough         bool
+	PassthroughConflict string
+
+	UTMTemplate string
+
+	Password string
+
+	MaxClicks int
+
+	NotBefore   time.Time
+	NotAfter    time.Time
+	FallbackURL string
+
+	// TeamID shares the new link with a team the user is an editor of
+	TeamID string
+
+	// OwnCode asks for a random short URL, links with rules or variants need one
+	OwnCode bool
+}
+
+// ownCode reports whether the options change how visits of the link are
+// served or who may edit it. Such links get a random short URL, the one
+// derived from the long URL is shared by everyone shortening it.
+func (opts *LinkOptions) ownCode() bool {
+	return opts.OwnCode || opts.TeamID != "" || opts.RedirectCode != 0 || opts.Passthrough || opts.PassthroughConflict != "" ||
+		opts.Password != "" || opts.MaxClicks != 0 ||
+		!opts.NotBefore.IsZero() || !opts.NotAfter.IsZero() || opts.FallbackURL != ""
+}
+
+// sharedCode reports whether the short URL of the link is the one derived
+// from its long URL, which everyone shortening the URL gets back.
+func sharedCode(record *storage.URLRecord) bool {
+	return record.ShortURL == urlutils.GenerateShortURL(record.LongURL, uint(len(record.ShortURL)))
+}
+
+// ownCodeAttempts bounds the retries on random short URL collisions.
+const ownCodeAttempts = 3
+
 type URLService struct {
 	urlStorage storage.URLStorage
 	cfg        *config.Config
+	policy     *policy.Policy
+	blocklist  *blocklist.Blocklist
+	geoDB      *geoip.DB
+
+	passwordAttempts *attemptLimiter
+	anonymousLinks   *addressLinks
+	fetcher          *metafetch.Fetcher
+	audit            audit.Sink
 }
 
 func NewURLService(urlStorage storage.URLStorage, cfg *config.Config) *URLService {
-	return &URLService{urlStorage: urlStorage, cfg: cfg}
+	return &URLService{
+		urlStorage:       urlStorage,
+		cfg:              cfg,
+		passwordAttempts: newAttemptLimiter(cfg.PasswordAttempts, cfg.PasswordAttemptWindow),
+		anonymousLinks:   newAddressLinks(),
+	}
 }
 
-func (service *URLService) BeginBatchProcessing(ctx context.Context) error {
-	return service.urlStorage.BeginTransaction(ctx)
+// SetPolicy enables target URL checks, a nil policy accepts any URL.
+func (service *URLService) SetPolicy(policy *policy.Policy) {
+	service.policy = policy
+}
+
+// SetFetcher enables fetching titles of links created without one.
+func (service *URLService) SetFetcher(fetcher *metafetch.Fetcher) {
+	service.fetcher = fetcher
+}
+
+// SetBlocklist enables refusing and flagging blocklisted URLs.
+func (service *URLService) SetBlocklist(blocklist *blocklist.Blocklist) {
+	service.blocklist = blocklist
+}
+
+func (service *URLService) CheckLongURL(longURL string) error {
+	if service.policy != nil {
+		if err := service.policy.Check(longURL); err != nil {
+			return err
+		}
+	}
+
+	if service.blocklist != nil {
+		if rule, blocked := service.blocklist.Match(longURL); blocked {
+			return policy.NewViolationError(longURL, fmt.Sprintf("URL is blocklisted (%s)", rule))
+		}
+	}
+
+	return nil
+}
+
+// RefreshBlockedFlags re-evaluates the blocklist against all stored URLs
+// and updates their blocked flags accordingly.
+func (service *URLService) RefreshBlockedFlags(ctx context.Context) error {
+	if service.blocklist == nil {
+		return nil
+	}
+
+	records, err := service.urlStorage.ListURLs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var blocked, unblocked []string
+	for _, record := range records {
+		_, match := service.blocklist.Match(record.LongURL)
+		if match && !record.Blocked {
+			blocked = append(blocked, record.ShortURL)
+		} else if !match && record.Blocked {
+			unblocked = append(unblocked, record.ShortURL)
+		}
+	}
+
+	if err := service.urlStorage.SetBlocked(ctx, blocked, true); err != nil {
+		return err
+	}
+
+	return service.urlStorage.SetBlocked(ctx, unblocked, false)
+}
+
+// batchKey holds the metadata fetches and audit events of a batch, they
+// wait for its commit as its links do not exist before.
+type batchKey struct{}
+
+type pendingBatch struct {
+	fetches []pendingFetch
+	events  []audit.Event
+}
+
+type pendingFetch struct {
+	shortURL string
+	longURL  string
+}
+
+// BeginBatchProcessing starts the transaction of a batch, the returned
+// context must be passed on to the links of the batch.
+func (service *URLService) BeginBatchProcessing(ctx context.Context) (context.Context, error) {
+	if err := service.urlStorage.BeginTransaction(ctx); err != nil {
+		return ctx, err
+	}
+
+	return context.WithValue(ctx, batchKey{}, &pendingBatch{}), nil
 }
 
 func (service *URLService) EndBatchProcessing(ctx context.Context) error {
-	return service.urlStorage.EndTransaction(ctx)
+	if err := service.urlStorage.EndTransaction(ctx); err != nil {
+		return err
+	}
+
+	pending, ok := ctx.Value(batchKey{}).(*pendingBatch)
+	if !ok {
+		return nil
+	}
+
+	for _, event := range pending.events {
+		service.writeEvent(ctx, event)
+	}
+
+	if service.fetcher != nil {
+		for _, fetch := range pending.fetches {
+			service.fetcher.Enqueue(fetch.shortURL, fetch.longURL)
+		}
+	}
+
+	return nil
+}
+
+// fetchMetadata schedules fetching of the title of a new link, links of a
+// batch are only scheduled once it is committed.
+func (service *URLService) fetchMetadata(ctx context.Context, shortURL, longURL string) {
+	if service.fetcher == nil {
+		return
+	}
+
+	if pending, ok := ctx.Value(batchKey{}).(*pendingBatch); ok {
+		pending.fetches = append(pending.fetches, pendingFetch{shortURL: shortURL, longURL: longURL})
+		return
+	}
+
+	service.fetcher.Enqueue(shortURL, longURL)
 }
 
-func (service *URLService) ProcessLongURL(ctx context.Context, longURL string) (string, error) {
-	shortURL := urlutils.GenerateShortURL(longURL, service.cfg.ShortURLLen)
-	err := service.urlStorage.StoreURL(ctx, shortURL, longURL)
-	return shortURL, err
+// PrepareLongURL returns the URL that is going to be stored for longURL:
+// the referenced UTM template is merged in and the result passes the URL checks.
+func (service *URLService) PrepareLongURL(ctx context.Context, longURL string, opts LinkOptions) (string, error) {
+	if err := checkNote(opts.Note); err != nil {
+		return "", err
+	}
+
+	if _, err := normalizeTags(opts.Tags); err != nil {
+		return "", err
+	}
+
+	if opts.TeamID != "" {
+		if _, err := service.requireRole(ctx, opts.TeamID, RoleEditor); err != nil {
+			return "", err
+		}
+	}
+
+	if opts.UTMTemplate != "" {
+		var err error
+		longURL, err = service.applyUTMTemplate(ctx, longURL, opts.UTMTemplate)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := service.CheckLongURL(longURL); err != nil {
+		return "", err
+	}
+
+	if opts.FallbackURL != "" {
+		if err := service.CheckLongURL(opts.FallbackURL); err != nil {
+			return "", err
+		}
+	}
+
+	return longURL, nil
 }
 
-func (service *URLService) ProcessShortURL(ctx context.Context, shortURL string) (string, bool, error) {
-	return service.urlStorage.TryGetLongURL(ctx, shortURL)
+func (service *URLService) ProcessLongURL(ctx context.Context, longURL string, opts LinkOptions) (string, error) {
+	longURL, err := service.PrepareLongURL(ctx, longURL, opts)
+	if err != nil {
+		return "", err
+	}
+
+	passwordHash, err := hashPassword(opts.Password)
+	if err != nil {
+		return "", err
+	}
+
+	tags, err := normalizeTags(opts.Tags)
+	if err != nil {
+		return "", err
+	}
+
+	record := storage.URLRecord{
+		LongURL:   longURL,
+		CreatedAt: time.Now(),
+		Title:     opts.Title,
+		Note:      opts.Note,
+		Tags:      tags,
+
+		RedirectCode:        opts.RedirectCode,
+		Passthrough:         opts.Passthrough,
+		PassthroughConflict: opts.PassthroughConflict,
+		UTMTemplate:         opts.UTMTemplate,
+		PasswordHash:        passwordHash,
+		MaxClicks:           opts.MaxClicks,
+		NotBefore:           opts.NotBefore,
+		NotAfter:            opts.NotAfter,
+		FallbackURL:         opts.FallbackURL,
+		TeamID:              opts.TeamID,
+	}
+
+	var shortURL string
+	if opts.ownCode() {
+		shortURL, err = service.storeOwnCode(ctx, record)
+	} else {
+		shortURL, err = service.storeSharedCode(ctx, record)
+	}
+	if err != nil {
+		return shortURL, err
+	}
+
+	userID, _ := storage.GetUserID(ctx)
+	service.record(ctx, audit.ActionCreate, shortURL, userID, nil, map[string]any{
+		"long_url": longURL,
+		"title":    opts.Title,
+		"team":     opts.TeamID,
+	})
+
+	if opts.Title == "" {
+		service.fetchMetadata(ctx, shortURL, longURL)
+	}
+
+	return shortURL, nil
+}
+
+// storeSharedCode stores the link under the short URL derived from the long
+// URL, shortening a stored URL again reports the duplicate and costs no quota.
+func (service *URLService) storeSharedCode(ctx context.Context, record storage.URLRecord) (string, error) {
+	record.ShortURL = urlutils.GenerateShortURL(record.LongURL, service.cfg.ShortURLLen)
+
+	return record.ShortURL, service.storeURL(ctx, record)
 }
 
-func (service *URLService) GetSummary(ctx context.Context) string {
-	return service.urlStorage.GetSummary(ctx)
+// storeOwnCode stores the link under a random short URL.
+func (service *URLService) storeOwnCode(ctx context.Context, record storage.URLRecord) (string, error) {
+	for attempt := 1; ; attempt++ {
+		shortURL, err := urlutils.GenerateRandomShortURL(service.cfg.ShortURLLen)
+		if err != nil {
+			return "", err
+		}
+
+		record.ShortURL = shortURL
+		err = service.storeURL(ctx, record)
+		if !errors.Is(err, &storage.DuplicateURLError{}) || attempt == ownCodeAttempts {
+			return shortURL, err
+		}
+	}
 }
 
+// IsBlocked reports whether the blocklist lists the target. Links are only
+// flagged for their long URL, targets picked by rules, variants and
+// fallbacks are checked on every visit.
+func (service *URLService) IsBlocked(target string) bool {
+	if service.blocklist == nil {
+		return false
+	}
+
+	_, blocked := service.blocklist.Match(target)
+	return blocked
+}
+
+func (service *URLService) ProcessShortURL(ctx context.Context, shortURL string) (*storage.URLRecord, error) {
+	record, err := service.urlStorage.TryGetURL(ctx, shortURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if service.blocklist != nil && !record.Blocked {
+		_, record.Blocked = service.blocklist.Match(record.LongURL)
+	}
+
+	return record, nil
+}
+
+// ConsumeClick counts a redirect of the link against its click limit and
+// reports false once the limit is used up.
+func (service *URLService) ConsumeClick(ctx context.Context, record *storage.URLRecord) (bool, error) {
+	if record.MaxClicks == 0 {
+		return true, nil
+	}
+
+	return service.urlStorage.ConsumeClick(ctx, record.ShortURL)
+}
+
+// GetSummary returns the links of the user followed by those shared with
+// the teams of the user, only those with the tag if it is not empty.
+func (service *URLService) GetSummary(ctx context.Context, tag string) ([]storage.URLRecord, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tag = strings.ToLower(tag)
+	records, err := service.urlStorage.GetUserURLs(ctx, userID, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := service.urlStorage.GetMemberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, membership := range memberships {
+		teamRecords, err := service.urlStorage.GetTeamURLs(ctx, membership.TeamID, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range teamRecords {
+			// links of the user are listed already
+			if record.UserID != userID {
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// MarkAsDeleted deletes the links of the user and the team links the user
+// is an editor of, other links are skipped.
 func (service *URLService) MarkAsDeleted(ctx context.Context, shortURLs []string) {
-	service.urlStorage.MarkAsDeleted(ctx, shortURLs)
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return
+	}
+
+	// without teams or audit the storage finds the links of the user itself
+	memberships, err := service.urlStorage.GetMemberships(ctx, userID)
+	if (err != nil || len(memberships) == 0) && service.audit == nil {
+		service.urlStorage.MarkAsDeleted(ctx, shortURLs, nil)
+		return
+	}
+
+	// storages delete on behalf of the creator of a link
+	byCreator := make(map[string][]string)
+	for _, shortURL := range shortURLs {
+		record, err := service.accessRecord(ctx, shortURL, RoleEditor)
+		if err != nil {
+			continue
+		}
+
+		byCreator[record.UserID] = append(byCreator[record.UserID], shortURL)
+	}
+
+	// deletions may be applied after the request is done, the events are
+	// recorded then and keep its actor and client address
+	auditCtx := context.WithoutCancel(ctx)
+	for creatorID, creatorURLs := range byCreator {
+		creatorCtx := context.WithValue(ctx, storage.UserIDKey{Name: "userID"}, creatorID)
+		service.urlStorage.MarkAsDeleted(creatorCtx, creatorURLs, func(deleted []string) {
+			for _, shortURL := range deleted {
+				service.record(auditCtx, audit.ActionDelete, shortURL, creatorID,
+					map[string]any{"deleted": false}, map[string]any{"deleted": true})
+			}
+		})
+	}
+}
+
+// Stats are the totals shown to the trusted subnet.
+type Stats struct {
+	URLs  int
+	Users int
+}
+
+func (service *URLService) GetStats(ctx context.Context) (*Stats, error) {
+	urls, err := service.urlStorage.CountURLs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := service.urlStorage.CountUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stats{URLs: urls, Users: users}, nil
 }
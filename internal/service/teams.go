@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+// Roles of team members, each one may do everything the previous ones may:
+// viewers see the team links, editors create, change and delete them and
+// owners manage the members.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+const maxTeamNameLength = 64
+
+// Membership is a team of the user together with the role the user has in it.
+type Membership struct {
+	Team storage.Team
+	Role string
+}
+
+func (service *URLService) CreateTeam(ctx context.Context, name string) (*Membership, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxTeamNameLength {
+		return nil, NewInvalidRequestError(fmt.Sprintf("team name must have 1 to %d characters", maxTeamNameLength))
+	}
+
+	team := storage.Team{ID: uuid.New().String(), Name: name, CreatedAt: time.Now()}
+	owner := storage.Member{TeamID: team.ID, UserID: userID, Role: RoleOwner}
+	if err := service.urlStorage.CreateTeam(ctx, team, owner); err != nil {
+		return nil, err
+	}
+
+	return &Membership{Team: team, Role: RoleOwner}, nil
+}
+
+func (service *URLService) GetTeams(ctx context.Context) ([]Membership, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := service.urlStorage.GetMemberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := make([]Membership, 0, len(members))
+	for _, member := range members {
+		team, err := service.urlStorage.TryGetTeam(ctx, member.TeamID)
+		if err != nil {
+			return nil, err
+		}
+
+		memberships = append(memberships, Membership{Team: *team, Role: member.Role})
+	}
+
+	return memberships, nil
+}
+
+func (service *URLService) GetMembers(ctx context.Context, teamID string) ([]storage.Member, error) {
+	if _, err := service.requireRole(ctx, teamID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	return service.urlStorage.GetMembers(ctx, teamID)
+}
+
+// SetMember adds the user to the team or changes the role of a member.
+func (service *URLService) SetMember(ctx context.Context, teamID, userID, role string) error {
+	if _, exists := roleRanks[role]; !exists {
+		return NewInvalidRequestError(fmt.Sprintf("unknown role '%s'", role))
+	}
+
+	if _, err := service.requireRole(ctx, teamID, RoleOwner); err != nil {
+		return err
+	}
+
+	if role != RoleOwner {
+		if err := service.keepOwner(ctx, teamID, userID); err != nil {
+			return err
+		}
+	}
+
+	return service.urlStorage.SetMember(ctx, storage.Member{TeamID: teamID, UserID: userID, Role: role})
+}
+
+// RemoveMember lets owners remove anybody and other members leave the team.
+func (service *URLService) RemoveMember(ctx context.Context, teamID, userID string) error {
+	currentUserID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	role := RoleOwner
+	if userID == currentUserID {
+		role = RoleViewer
+	}
+
+	if _, err := service.requireRole(ctx, teamID, role); err != nil {
+		return err
+	}
+
+	if err := service.keepOwner(ctx, teamID, userID); err != nil {
+		return err
+	}
+
+	return service.urlStorage.RemoveMember(ctx, teamID, userID)
+}
+
+// keepOwner refuses to take the owner role from the last owner of the team.
+func (service *URLService) keepOwner(ctx context.Context, teamID, userID string) error {
+	members, err := service.urlStorage.GetMembers(ctx, teamID)
+	if err != nil {
+		return err
+	}
+
+	owners, isOwner := 0, false
+	for _, member := range members {
+		if member.Role == RoleOwner {
+			owners++
+			isOwner = isOwner || member.UserID == userID
+		}
+	}
+
+	if isOwner && owners == 1 {
+		return NewInvalidRequestError("team must keep at least one owner")
+	}
+
+	return nil
+}
+
+// requireRole returns the user from the context if it has at least the role
+// in the team. Teams the user is not a member of are reported as not found.
+func (service *URLService) requireRole(ctx context.Context, teamID, role string) (string, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	member, err := service.urlStorage.TryGetMember(ctx, teamID, userID)
+	if err != nil {
+		if errors.Is(err, &storage.NotFoundError{}) {
+			return "", storage.NewNotFoundError("team", teamID)
+		}
+		return "", err
+	}
+
+	if roleRanks[member.Role] < roleRanks[role] {
+		return "", NewForbiddenError(fmt.Sprintf("%s role in team '%s' is required", role, teamID))
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/rvkarpov/url_shortener/internal/storage"
+	"github.com/rvkarpov/url_shortener/internal/urlutils"
+)
+
+var utmTemplateName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func (service *URLService) StoreUTMTemplate(ctx context.Context, name string, params map[string]string) error {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !utmTemplateName.MatchString(name) {
+		return NewInvalidRequestError(fmt.Sprintf("invalid template name '%s'", name))
+	}
+
+	if len(params) == 0 {
+		return NewInvalidRequestError("template has no parameters")
+	}
+
+	for key, value := range params {
+		if !strings.HasPrefix(key, "utm_") || len(key) == len("utm_") {
+			return NewInvalidRequestError(fmt.Sprintf("parameter '%s' is not a utm_* parameter", key))
+		}
+
+		if value == "" {
+			return NewInvalidRequestError(fmt.Sprintf("parameter '%s' has no value", key))
+		}
+	}
+
+	return service.urlStorage.StoreUTMTemplate(ctx, storage.UTMTemplate{UserID: userID, Name: name, Params: params})
+}
+
+func (service *URLService) GetUTMTemplates(ctx context.Context) ([]storage.UTMTemplate, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.urlStorage.GetUTMTemplates(ctx, userID)
+}
+
+func (service *URLService) DeleteUTMTemplate(ctx context.Context, name string) error {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	return service.urlStorage.DeleteUTMTemplate(ctx, userID, name)
+}
+
+// applyUTMTemplate merges the template parameters into longURL, replacing
+// utm_* parameters the URL already has.
+func (service *URLService) applyUTMTemplate(ctx context.Context, longURL, name string) (string, error) {
+	userID, err := storage.GetUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	template, err := service.urlStorage.TryGetUTMTemplate(ctx, userID, name)
+	if err != nil {
+		if errors.Is(err, &storage.NotFoundError{}) {
+			return "", NewInvalidRequestError(err.Error())
+		}
+		return "", err
+	}
+
+	params := make(url.Values, len(template.Params))
+	for key, value := range template.Params {
+		params.Set(key, value)
+	}
+
+	return urlutils.MergeURL(longURL, "", params, true)
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/audit"
+	"github.com/rvkarpov/url_shortener/internal/storage"
+)
+
+const maxVariantsPerLink = 10
+
+func (service *URLService) SetVariants(ctx context.Context, shortURL string, variants []storage.Variant, sticky bool) error {
+	record, err := service.accessRecord(ctx, shortURL, RoleEditor)
+	if err != nil {
+		return err
+	}
+
+	// as for rules, variants would split the traffic of every link to the URL
+	if len(variants) > 0 && sharedCode(record) {
+		return NewInvalidRequestError(fmt.Sprintf(
+			"short URL '%s' is shared by everyone shortening its URL, create a link with \"own_code\" for variants", shortURL))
+	}
+
+	if len(variants) > maxVariantsPerLink {
+		return NewInvalidRequestError(fmt.Sprintf("at most %d variants are allowed", maxVariantsPerLink))
+	}
+
+	for _, variant := range variants {
+		if variant.URL == "" {
+			return NewInvalidRequestError("variant has no url")
+		}
+
+		if variant.Weight <= 0 {
+			return NewInvalidRequestError(fmt.Sprintf("variant '%s' must have a positive weight", variant.URL))
+		}
+
+		if err := service.CheckLongURL(variant.URL); err != nil {
+			return err
+		}
+	}
+
+	if err := service.urlStorage.SetVariants(ctx, shortURL, variants, sticky); err != nil {
+		return err
+	}
+
+	service.record(ctx, audit.ActionEdit, shortURL, record.UserID,
+		map[string]any{"variants": record.Variants, "sticky": record.StickyVariants},
+		map[string]any{"variants": variants, "sticky": sticky})
+	return nil
+}
+
+// GetClickStats returns the number of redirects of the link per served
+// variant URL, redirects to other targets are counted under "".
+func (service *URLService) GetClickStats(ctx context.Context, shortURL string) (*storage.URLRecord, map[string]int, error) {
+	record, err := service.accessRecord(ctx, shortURL, RoleViewer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats, err := service.urlStorage.GetClickStats(ctx, shortURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return record, stats, nil
+}
+
+// RecordClick stores a redirect, failures are only logged so that
+// analytics never break redirects.
+func (service *URLService) RecordClick(ctx context.Context, shortURL, variant string) {
+	click := storage.Click{ShortURL: shortURL, Variant: variant, ClickedAt: time.Now()}
+	if err := service.urlStorage.RecordClick(ctx, click); err != nil {
+		log.Printf("Failed to record click on %s: %v", shortURL, err)
+	}
+}
+
+// pickVariant returns the index of the variant to serve, a valid sticky
+// index from an earlier visit is kept. Returns -1 if the link has no variants.
+func pickVariant(variants []storage.Variant, sticky int) int {
+	if len(variants) == 0 {
+		return -1
+	}
+
+	if sticky >= 0 && sticky < len(variants) {
+		return sticky
+	}
+
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+
+	point := rand.IntN(total)
+	for i, variant := range variants {
+		if point < variant.Weight {
+			return i
+		}
+		point -= variant.Weight
+	}
+
+	return len(variants) - 1
+}
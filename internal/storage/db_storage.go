@@ -6,9 +6,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/lib/pq"
 	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/rules"
 )
 
 type DBState struct {
@@ -45,30 +48,20 @@ type DBStorage struct {
 	deleteCmd *DeleteCmd
 }
 
-func (storage *DBStorage) StoreURL(ctx context.Context, shortURL, longURL string) error {
-	query := fmt.Sprintf(
-		`INSERT INTO %s (userID, longURL, shortURL) 
-		VALUES ($1, $2, $3) 
-		ON CONFLICT (shortURL) 
-		DO NOTHING 
-		RETURNING id;`,
-		pq.QuoteIdentifier(storage.cfg.TableName),
-	)
+func (storage *DBStorage) StoreURL(ctx context.Context, record URLRecord) error {
+	userID, err := GetUserID(ctx)
+	if err != nil {
+		return err
+	}
 
-	userID, err := getUserID(ctx)
+	query, args, err := storage.insertURLQuery(userID, record)
 	if err != nil {
 		return err
 	}
 
 	var result sql.Result
 	if storage.state.Tx != nil {
-		result, err = storage.state.Tx.ExecContext(
-			ctx,
-			query,
-			userID,
-			longURL,
-			shortURL,
-		)
+		result, err = storage.state.Tx.ExecContext(ctx, query, args...)
 
 		if err != nil {
 			if rollbackErr := storage.state.Tx.Rollback(); rollbackErr != nil {
@@ -78,13 +71,7 @@ func (storage *DBStorage) StoreURL(ctx context.Context, shortURL, longURL string
 		}
 
 	} else {
-		result, err = storage.state.DB.ExecContext(
-			ctx,
-			query,
-			userID,
-			longURL,
-			shortURL,
-		)
+		result, err = storage.state.DB.ExecContext(ctx, query, args...)
 	}
 
 	if err != nil {
@@ -97,43 +84,324 @@ func (storage *DBStorage) StoreURL(ctx context.Context, shortURL, longURL string
 	}
 
 	if rowsAffected == 0 {
-		return NewDuplicateURLError(shortURL)
+		return NewDuplicateURLError(record.ShortURL)
 	}
 
-	return nil
+	if len(record.Tags) == 0 {
+		return nil
+	}
+
+	if storage.state.Tx != nil {
+		err = storage.insertTags(ctx, storage.state.Tx, record.ShortURL, record.Tags)
+	} else {
+		err = storage.insertTags(ctx, storage.state.DB, record.ShortURL, record.Tags)
+	}
+
+	return err
 }
 
-func (storage *DBStorage) TryGetLongURL(ctx context.Context, shortURL string) (string, bool, error) {
+// insertURLQuery returns the statement storing the link, it stores nothing
+// if the short URL is taken.
+func (storage *DBStorage) insertURLQuery(userID string, record URLRecord) (string, []any, error) {
 	query := fmt.Sprintf(
-		`SELECT longURL, deletedFlag FROM %s WHERE shortURL = $1 LIMIT 1`,
+		`INSERT INTO %s (userID, longURL, shortURL, title, redirect_code, passthrough, passthrough_conflict, utm_template,
+			variants, sticky_variants, password_hash, max_clicks, not_before, not_after, fallback_url, note, team_id) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) 
+		ON CONFLICT (shortURL) 
+		DO NOTHING 
+		RETURNING id;`,
 		pq.QuoteIdentifier(storage.cfg.TableName),
 	)
 
-	var longURL string
-	var deleted bool
-	err := storage.state.DB.QueryRowContext(
-		ctx,
-		query,
-		shortURL,
-	).Scan(&longURL, &deleted)
+	if record.Variants == nil {
+		record.Variants = []Variant{}
+	}
+
+	variants, err := json.Marshal(record.Variants)
+	if err != nil {
+		return "", nil, err
+	}
+
+	args := []any{
+		userID,
+		record.LongURL,
+		record.ShortURL,
+		record.Title,
+		record.RedirectCode,
+		record.Passthrough,
+		record.PassthroughConflict,
+		record.UTMTemplate,
+		variants,
+		record.StickyVariants,
+		record.PasswordHash,
+		record.MaxClicks,
+		sql.NullTime{Time: record.NotBefore, Valid: !record.NotBefore.IsZero()},
+		sql.NullTime{Time: record.NotAfter, Valid: !record.NotAfter.IsZero()},
+		record.FallbackURL,
+		record.Note,
+		record.TeamID,
+	}
+
+	return query, args, nil
+}
+
+// StoreURLLimited counts and stores in one transaction, the batch one if
+// there is. An advisory lock on the user makes concurrent creations of the
+// user wait for each other, so the count includes their links.
+func (storage *DBStorage) StoreURLLimited(ctx context.Context, record URLRecord, limits Limits) error {
+	userID, err := GetUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx := storage.state.Tx
+	if tx == nil {
+		tx, err = storage.state.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	err = storage.storeLimited(ctx, tx, userID, record, limits)
+	if err != nil {
+		// a batch over the limits is not stored at all
+		if tx == storage.state.Tx && !errors.Is(err, &DuplicateURLError{}) {
+			tx.Rollback()
+			storage.state.Tx = nil
+		}
+
+		return err
+	}
+
+	if tx != storage.state.Tx {
+		return tx.Commit()
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) storeLimited(ctx context.Context, tx *sql.Tx, userID string, record URLRecord, limits Limits) error {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, userID); err != nil {
+		return fmt.Errorf("failed to lock user links: %w", err)
+	}
+
+	var exists bool
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE shortURL = $1)`, pq.QuoteIdentifier(storage.cfg.TableName))
+	if err := tx.QueryRowContext(ctx, query, record.ShortURL).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up URL: %w", err)
+	}
+	if exists {
+		return NewDuplicateURLError(record.ShortURL)
+	}
+
+	usage, err := storage.usage(ctx, tx, userID, limits.Since)
+	if err != nil {
+		return err
+	}
+	if limits.Exceeded(usage) {
+		return NewLimitError(*usage)
+	}
+
+	query, args, err := storage.insertURLQuery(userID, record)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to insert URL: %w", err)
+	}
+
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	} else if rowsAffected == 0 {
+		return NewDuplicateURLError(record.ShortURL)
+	}
+
+	if len(record.Tags) == 0 {
+		return nil
+	}
+
+	return storage.insertTags(ctx, tx, record.ShortURL, record.Tags)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (storage *DBStorage) insertTags(ctx context.Context, db execer, shortURL string, tags []string) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (shortURL, tag) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING;`,
+		auxTable(storage.cfg, "tags"),
+	)
+
+	if _, err := db.ExecContext(ctx, query, shortURL, pq.Array(tags)); err != nil {
+		return fmt.Errorf("failed to insert tags: %w", err)
+	}
+
+	return nil
+}
+
+// loadTags fills in the tags of records, they live in their own table.
+func (storage *DBStorage) loadTags(ctx context.Context, records []URLRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(records))
+	shortURLs := make([]string, len(records))
+	for i, record := range records {
+		index[record.ShortURL] = i
+		shortURLs[i] = record.ShortURL
+	}
+
+	query := fmt.Sprintf(
+		`SELECT shortURL, tag FROM %s WHERE shortURL = ANY($1) ORDER BY tag`,
+		auxTable(storage.cfg, "tags"),
+	)
+
+	rows, err := storage.state.DB.QueryContext(ctx, query, pq.Array(shortURLs))
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var shortURL, tag string
+		if err := rows.Scan(&shortURL, &tag); err != nil {
+			return fmt.Errorf("database error: %w", err)
+		}
+
+		record := &records[index[shortURL]]
+		record.Tags = append(record.Tags, tag)
+	}
+
+	return rows.Err()
+}
+
+// recordColumns are selected by every query that is scanned with scanRecord.
+const recordColumns = `shortURL, userID, longURL, deletedFlag, blocked, last_status, last_checked, created_at, title,
+	redirect_code, passthrough, passthrough_conflict, utm_template, rules,
+	variants, sticky_variants, password_hash, max_clicks, click_count,
+	not_before, not_after, fallback_url, note, image_url, team_id, disabled, disabled_reason`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRecord(row rowScanner) (*URLRecord, error) {
+	var record URLRecord
+	var lastChecked, createdAt, notBefore, notAfter sql.NullTime
+	var redirectRules, variants []byte
+	err := row.Scan(
+		&record.ShortURL,
+		&record.UserID,
+		&record.LongURL,
+		&record.Deleted,
+		&record.Blocked,
+		&record.LastStatus,
+		&lastChecked,
+		&createdAt,
+		&record.Title,
+		&record.RedirectCode,
+		&record.Passthrough,
+		&record.PassthroughConflict,
+		&record.UTMTemplate,
+		&redirectRules,
+		&variants,
+		&record.StickyVariants,
+		&record.PasswordHash,
+		&record.MaxClicks,
+		&record.ClickCount,
+		&notBefore,
+		&notAfter,
+		&record.FallbackURL,
+		&record.Note,
+		&record.ImageURL,
+		&record.TeamID,
+		&record.Disabled,
+		&record.DisabledReason,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(redirectRules, &record.Rules); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(variants, &record.Variants); err != nil {
+		return nil, err
+	}
+
+	record.LastChecked = lastChecked.Time
+	record.CreatedAt = createdAt.Time
+	record.NotBefore = notBefore.Time
+	record.NotAfter = notAfter.Time
+	return &record, nil
+}
+
+func (storage *DBStorage) queryRecords(ctx context.Context, query string, args ...any) ([]URLRecord, error) {
+	rows, err := storage.state.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	defer rows.Close()
+
+	records := make([]URLRecord, 0)
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+
+		records = append(records, *record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	if err := storage.loadTags(ctx, records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (storage *DBStorage) TryGetURL(ctx context.Context, shortURL string) (*URLRecord, error) {
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s WHERE shortURL = $1 LIMIT 1`,
+		recordColumns,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
 
+	record, err := scanRecord(storage.state.DB.QueryRowContext(ctx, query, shortURL))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", deleted, fmt.Errorf("short URL '%s' not found", shortURL)
+			return nil, fmt.Errorf("short URL '%s' not found", shortURL)
 		}
-		return "", deleted, fmt.Errorf("database error: %w", err)
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	records := []URLRecord{*record}
+	if err := storage.loadTags(ctx, records); err != nil {
+		return nil, err
 	}
 
-	return longURL, deleted, nil
+	return &records[0], nil
 }
 
-func (storage *DBStorage) MarkAsDeleted(ctx context.Context, shortURLs []string) {
-	userID, err := getUserID(ctx)
+func (storage *DBStorage) MarkAsDeleted(ctx context.Context, shortURLs []string, onDeleted func(shortURLs []string)) {
+	userID, err := GetUserID(ctx)
 	if err != nil || userID == "" {
 		return
 	}
 
-	storage.deleteCmd.Append(userID, shortURLs)
+	storage.deleteCmd.Append(userID, shortURLs, onDeleted)
 }
 
 func (storage *DBStorage) Finalize() {
@@ -167,78 +435,1073 @@ func (storage *DBStorage) EndTransaction(ctx context.Context) error {
 	return nil
 }
 
-func (storage *DBStorage) GetSummary(ctx context.Context) string {
-	userID, err := getUserID(ctx)
+func (storage *DBStorage) GetUserURLs(ctx context.Context, userID, tag string) ([]URLRecord, error) {
+	if tag == "" {
+		query := fmt.Sprintf(
+			`SELECT %s FROM %s WHERE userID = $1 ORDER BY id`,
+			recordColumns,
+			pq.QuoteIdentifier(storage.cfg.TableName),
+		)
+
+		return storage.queryRecords(ctx, query, userID)
+	}
+
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s WHERE userID = $1 AND shortURL IN (SELECT shortURL FROM %s WHERE tag = $2) ORDER BY id`,
+		recordColumns,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+		auxTable(storage.cfg, "tags"),
+	)
+
+	return storage.queryRecords(ctx, query, userID, tag)
+}
+
+func (storage *DBStorage) SetMetadata(ctx context.Context, shortURL, title, note string, tags []string) error {
+	tx, err := storage.state.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return ""
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
 	query := fmt.Sprintf(
-		`SELECT shortURL, longURL FROM %s WHERE userID = $1`,
+		`UPDATE %s SET title = $1, note = $2 WHERE shortURL = $3;`,
 		pq.QuoteIdentifier(storage.cfg.TableName),
 	)
 
-	rows, err := storage.state.DB.QueryContext(ctx, query, userID)
+	result, err := tx.ExecContext(ctx, query, title, note, shortURL)
 	if err != nil {
-		return ""
+		return fmt.Errorf("failed to update metadata: %w", err)
 	}
 
-	defer rows.Close()
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	} else if rowsAffected == 0 {
+		return NewNotFoundError("short URL", shortURL)
+	}
 
-	urls := make([]UserDataStorageItem, 0)
-	for rows.Next() {
-		var item UserDataStorageItem
-		err = rows.Scan(&item.ShortURL, &item.LongURL)
-		if err != nil {
-			return ""
-		}
+	query = fmt.Sprintf(`DELETE FROM %s WHERE shortURL = $1;`, auxTable(storage.cfg, "tags"))
+	if _, err := tx.ExecContext(ctx, query, shortURL); err != nil {
+		return fmt.Errorf("failed to delete tags: %w", err)
+	}
 
-		item.ShortURL = fmt.Sprintf("%s/%s", storage.cfg.PublishAddr, item.ShortURL)
-		urls = append(urls, item)
+	if len(tags) != 0 {
+		if err := storage.insertTags(ctx, tx, shortURL, tags); err != nil {
+			return err
+		}
 	}
 
-	err = rows.Err()
+	return tx.Commit()
+}
+
+func (storage *DBStorage) SetPageMetadata(ctx context.Context, shortURL, title, imageURL string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET title = CASE WHEN title = '' THEN $1 ELSE title END, image_url = $2 WHERE shortURL = $3;`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	_, err := storage.state.DB.ExecContext(ctx, query, title, imageURL, shortURL)
 	if err != nil {
-		return ""
+		return fmt.Errorf("failed to update page metadata: %w", err)
 	}
 
-	if len(urls) == 0 {
-		return ""
+	return nil
+}
+
+func (storage *DBStorage) ListURLs(ctx context.Context) ([]URLRecord, error) {
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s ORDER BY id`,
+		recordColumns,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	return storage.queryRecords(ctx, query)
+}
+
+func (storage *DBStorage) SetBlocked(ctx context.Context, shortURLs []string, blocked bool) error {
+	if len(shortURLs) == 0 {
+		return nil
 	}
 
-	result, err := json.Marshal(urls)
+	query := fmt.Sprintf(
+		`UPDATE %s SET blocked = $1 WHERE shortURL = ANY($2);`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	_, err := storage.state.DB.ExecContext(ctx, query, blocked, pq.Array(shortURLs))
 	if err != nil {
-		return ""
+		return fmt.Errorf("failed to update blocked flag: %w", err)
 	}
 
-	return string(result)
+	return nil
 }
 
-func NewDBStorage(state *DBState, cfg *config.Config) (*DBStorage, error) {
-	if state.DB == nil {
-		return nil, errors.New("database is not available")
+func (storage *DBStorage) SetHealth(ctx context.Context, shortURL string, status int, checkedAt time.Time) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET last_status = $1, last_checked = $2 WHERE shortURL = $3;`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	_, err := storage.state.DB.ExecContext(ctx, query, status, checkedAt, shortURL)
+	if err != nil {
+		return fmt.Errorf("failed to update health status: %w", err)
 	}
 
-	createTable := `
-		CREATE TABLE IF NOT EXISTS %s ( 
-		id SERIAL PRIMARY KEY,
-		userID TEXT NOT NULL,
-		longURL TEXT UNIQUE NOT NULL, 
-		shortURL VARCHAR(%d) UNIQUE NOT NULL,
-		deletedFlag BOOLEAN NOT NULL DEFAULT FALSE,
-		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP);`
+	return nil
+}
 
-	_, err := state.DB.ExecContext(
-		context.Background(),
-		fmt.Sprintf(
-			createTable,
-			pq.QuoteIdentifier(cfg.TableName),
-			cfg.ShortURLLen,
-		),
+func (storage *DBStorage) SearchURLs(ctx context.Context, query string, limit int) ([]URLRecord, error) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	statement := fmt.Sprintf(
+		`SELECT %s FROM %s WHERE shortURL = $1 OR longURL ILIKE $2 ORDER BY shortURL = $1 DESC, id LIMIT $3`,
+		recordColumns,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	return storage.queryRecords(ctx, statement, query, pattern, limit)
+}
+
+func (storage *DBStorage) CountURLs(ctx context.Context) (int, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, pq.QuoteIdentifier(storage.cfg.TableName))
+
+	var count int
+	if err := storage.state.DB.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count URLs: %w", err)
+	}
+
+	return count, nil
+}
+
+func (storage *DBStorage) CountUsers(ctx context.Context) (int, error) {
+	query := fmt.Sprintf(
+		`SELECT COUNT(DISTINCT userID) FROM %s WHERE userID <> ''`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	var count int
+	if err := storage.state.DB.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	return count, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (storage *DBStorage) SetDisabled(ctx context.Context, shortURLs []string, disabled bool, reason string) error {
+	if len(shortURLs) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(
+		`UPDATE %s SET disabled = $1, disabled_reason = $2 WHERE shortURL = ANY($3);`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	if _, err := storage.state.DB.ExecContext(ctx, query, disabled, reason, pq.Array(shortURLs)); err != nil {
+		return fmt.Errorf("failed to update disabled flags: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) SetOwner(ctx context.Context, shortURL, userID string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET userID = $1 WHERE shortURL = $2;`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
 	)
+
+	result, err := storage.state.DB.ExecContext(ctx, query, userID, shortURL)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to update owner: %w", err)
 	}
 
-	return &DBStorage{state: state, cfg: cfg, deleteCmd: NewDeleteCmd(state, cfg)}, nil
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) ConsumeClick(ctx context.Context, shortURL string) (bool, error) {
+	// the limit is checked and the counter raised by one statement so that
+	// concurrent redirects can not overrun it
+	query := fmt.Sprintf(
+		`UPDATE %s SET click_count = click_count + 1
+		WHERE shortURL = $1 AND max_clicks > 0 AND click_count < max_clicks
+		RETURNING click_count;`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	var clickCount int
+	err := storage.state.DB.QueryRowContext(ctx, query, shortURL).Scan(&clickCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to count click: %w", err)
+	}
+
+	return true, nil
+}
+
+func (storage *DBStorage) SetRules(ctx context.Context, shortURL string, redirectRules []rules.Rule) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET rules = $1 WHERE shortURL = $2;`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	if redirectRules == nil {
+		redirectRules = []rules.Rule{}
+	}
+
+	data, err := json.Marshal(redirectRules)
+	if err != nil {
+		return err
+	}
+
+	result, err := storage.state.DB.ExecContext(ctx, query, data, shortURL)
+	if err != nil {
+		return fmt.Errorf("failed to update rules: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) SetVariants(ctx context.Context, shortURL string, variants []Variant, sticky bool) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET variants = $1, sticky_variants = $2 WHERE shortURL = $3;`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	if variants == nil {
+		variants = []Variant{}
+	}
+
+	data, err := json.Marshal(variants)
+	if err != nil {
+		return err
+	}
+
+	result, err := storage.state.DB.ExecContext(ctx, query, data, sticky, shortURL)
+	if err != nil {
+		return fmt.Errorf("failed to update variants: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) RecordClick(ctx context.Context, click Click) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (shortURL, variant, clicked_at) VALUES ($1, $2, $3);`,
+		auxTable(storage.cfg, "clicks"),
+	)
+
+	_, err := storage.state.DB.ExecContext(ctx, query, click.ShortURL, click.Variant, click.ClickedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record click: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) GetClickStats(ctx context.Context, shortURL string) (map[string]int, error) {
+	query := fmt.Sprintf(
+		`SELECT variant, COUNT(*) FROM %s WHERE shortURL = $1 GROUP BY variant`,
+		auxTable(storage.cfg, "clicks"),
+	)
+
+	rows, err := storage.state.DB.QueryContext(ctx, query, shortURL)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	defer rows.Close()
+
+	stats := make(map[string]int)
+	for rows.Next() {
+		var variant string
+		var count int
+		if err := rows.Scan(&variant, &count); err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+
+		stats[variant] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return stats, nil
+}
+
+func (storage *DBStorage) StoreUTMTemplate(ctx context.Context, template UTMTemplate) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (userID, name, params) 
+		VALUES ($1, $2, $3) 
+		ON CONFLICT (userID, name) 
+		DO UPDATE SET params = EXCLUDED.params;`,
+		auxTable(storage.cfg, "utm_templates"),
+	)
+
+	params, err := json.Marshal(template.Params)
+	if err != nil {
+		return err
+	}
+
+	_, err = storage.state.DB.ExecContext(ctx, query, template.UserID, template.Name, params)
+	if err != nil {
+		return fmt.Errorf("failed to store UTM template: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) TryGetUTMTemplate(ctx context.Context, userID, name string) (*UTMTemplate, error) {
+	query := fmt.Sprintf(
+		`SELECT params FROM %s WHERE userID = $1 AND name = $2`,
+		auxTable(storage.cfg, "utm_templates"),
+	)
+
+	var params []byte
+	err := storage.state.DB.QueryRowContext(ctx, query, userID, name).Scan(&params)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, NewNotFoundError("UTM template", name)
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	template := UTMTemplate{UserID: userID, Name: name}
+	if err := json.Unmarshal(params, &template.Params); err != nil {
+		return nil, err
+	}
+
+	return &template, nil
+}
+
+func (storage *DBStorage) GetUTMTemplates(ctx context.Context, userID string) ([]UTMTemplate, error) {
+	query := fmt.Sprintf(
+		`SELECT name, params FROM %s WHERE userID = $1 ORDER BY name`,
+		auxTable(storage.cfg, "utm_templates"),
+	)
+
+	rows, err := storage.state.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	defer rows.Close()
+
+	templates := make([]UTMTemplate, 0)
+	for rows.Next() {
+		template := UTMTemplate{UserID: userID}
+		var params []byte
+		if err := rows.Scan(&template.Name, &params); err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+
+		if err := json.Unmarshal(params, &template.Params); err != nil {
+			return nil, err
+		}
+
+		templates = append(templates, template)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return templates, nil
+}
+
+func (storage *DBStorage) DeleteUTMTemplate(ctx context.Context, userID, name string) error {
+	query := fmt.Sprintf(
+		`DELETE FROM %s WHERE userID = $1 AND name = $2`,
+		auxTable(storage.cfg, "utm_templates"),
+	)
+
+	result, err := storage.state.DB.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete UTM template: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("UTM template", name)
+	}
+
+	return nil
+}
+
+func NewDBStorage(state *DBState, cfg *config.Config) (*DBStorage, error) {
+	if state.DB == nil {
+		return nil, errors.New("database is not available")
+	}
+
+	createTable := `
+		CREATE TABLE IF NOT EXISTS %s ( 
+		id SERIAL PRIMARY KEY,
+		userID TEXT NOT NULL,
+		longURL TEXT NOT NULL, 
+		shortURL VARCHAR(%d) UNIQUE NOT NULL,
+		deletedFlag BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP);
+		CREATE INDEX IF NOT EXISTS %s ON %s (userID);`
+
+	_, err := state.DB.ExecContext(
+		context.Background(),
+		fmt.Sprintf(
+			createTable,
+			pq.QuoteIdentifier(cfg.TableName),
+			cfg.ShortURLLen,
+			pq.QuoteIdentifier(cfg.TableName+"_userid_idx"),
+			pq.QuoteIdentifier(cfg.TableName),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateTable(state, cfg); err != nil {
+		return nil, err
+	}
+
+	if err := createAuxTables(state, cfg); err != nil {
+		return nil, err
+	}
+
+	return &DBStorage{state: state, cfg: cfg, deleteCmd: NewDeleteCmd(state, cfg)}, nil
+}
+
+// migrateTable adds the columns introduced after the initial schema to existing tables.
+func migrateTable(state *DBState, cfg *config.Config) error {
+	columns := []string{
+		"blocked BOOLEAN NOT NULL DEFAULT FALSE",
+		"last_status INTEGER NOT NULL DEFAULT 0",
+		"last_checked TIMESTAMP WITH TIME ZONE",
+		"title TEXT NOT NULL DEFAULT ''",
+		"redirect_code INTEGER NOT NULL DEFAULT 0",
+		"passthrough BOOLEAN NOT NULL DEFAULT FALSE",
+		"passthrough_conflict TEXT NOT NULL DEFAULT ''",
+		"utm_template TEXT NOT NULL DEFAULT ''",
+		"rules JSONB NOT NULL DEFAULT '[]'",
+		"variants JSONB NOT NULL DEFAULT '[]'",
+		"sticky_variants BOOLEAN NOT NULL DEFAULT FALSE",
+		"password_hash TEXT NOT NULL DEFAULT ''",
+		"max_clicks INTEGER NOT NULL DEFAULT 0",
+		"click_count INTEGER NOT NULL DEFAULT 0",
+		"not_before TIMESTAMP WITH TIME ZONE",
+		"not_after TIMESTAMP WITH TIME ZONE",
+		"fallback_url TEXT NOT NULL DEFAULT ''",
+		"note TEXT NOT NULL DEFAULT ''",
+		"image_url TEXT NOT NULL DEFAULT ''",
+		"team_id TEXT NOT NULL DEFAULT ''",
+		"disabled BOOLEAN NOT NULL DEFAULT FALSE",
+		"disabled_reason TEXT NOT NULL DEFAULT ''",
+	}
+
+	for _, column := range columns {
+		_, err := state.DB.ExecContext(
+			context.Background(),
+			fmt.Sprintf(
+				`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s;`,
+				pq.QuoteIdentifier(cfg.TableName),
+				column,
+			),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to migrate table: %w", err)
+		}
+	}
+
+	// links with their own options have a random short URL, the long URL
+	// may be stored more than once
+	_, err := state.DB.ExecContext(
+		context.Background(),
+		fmt.Sprintf(
+			`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s;`,
+			pq.QuoteIdentifier(cfg.TableName),
+			pq.QuoteIdentifier(cfg.TableName+"_longurl_key"),
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to migrate table: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) StoreAPIKey(ctx context.Context, key APIKey) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (id, userID, name, hash, scopes, created_at) VALUES ($1, $2, $3, $4, $5, $6);`,
+		auxTable(storage.cfg, "api_keys"),
+	)
+
+	_, err := storage.state.DB.ExecContext(ctx, query, key.ID, key.UserID, key.Name, key.Hash, pq.Array(key.Scopes), key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	return nil
+}
+
+const apiKeyColumns = `id, userID, name, hash, scopes, created_at, last_used, revoked`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var lastUsed sql.NullTime
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Hash,
+		pq.Array(&key.Scopes),
+		&key.CreatedAt,
+		&lastUsed,
+		&key.Revoked,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	key.LastUsed = lastUsed.Time
+	return &key, nil
+}
+
+func (storage *DBStorage) TryGetAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s WHERE hash = $1`,
+		apiKeyColumns,
+		auxTable(storage.cfg, "api_keys"),
+	)
+
+	key, err := scanAPIKey(storage.state.DB.QueryRowContext(ctx, query, hash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, NewNotFoundError("API key", "")
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return key, nil
+}
+
+func (storage *DBStorage) GetAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s WHERE userID = $1 ORDER BY created_at`,
+		apiKeyColumns,
+		auxTable(storage.cfg, "api_keys"),
+	)
+
+	rows, err := storage.state.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	defer rows.Close()
+
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+
+		keys = append(keys, *key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (storage *DBStorage) RevokeAPIKey(ctx context.Context, userID, id string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET revoked = TRUE WHERE id = $1 AND userID = $2;`,
+		auxTable(storage.cfg, "api_keys"),
+	)
+
+	result, err := storage.state.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("API key", id)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) SetAPIKeyUsed(ctx context.Context, id string, usedAt time.Time) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET last_used = $1 WHERE id = $2;`,
+		auxTable(storage.cfg, "api_keys"),
+	)
+
+	if _, err := storage.state.DB.ExecContext(ctx, query, usedAt, id); err != nil {
+		return fmt.Errorf("failed to update API key: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) StoreAccount(ctx context.Context, account Account) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (issuer, subject, userID, email, created_at) VALUES ($1, $2, $3, $4, $5);`,
+		auxTable(storage.cfg, "accounts"),
+	)
+
+	_, err := storage.state.DB.ExecContext(ctx, query, account.Issuer, account.Subject, account.UserID, account.Email, account.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store account: %w", err)
+	}
+
+	return nil
+}
+
+const accountColumns = `issuer, subject, userID, email, created_at`
+
+func (storage *DBStorage) queryAccount(ctx context.Context, condition string, args ...any) (*Account, error) {
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s WHERE %s`,
+		accountColumns,
+		auxTable(storage.cfg, "accounts"),
+		condition,
+	)
+
+	var account Account
+	err := storage.state.DB.QueryRowContext(ctx, query, args...).Scan(
+		&account.Issuer,
+		&account.Subject,
+		&account.UserID,
+		&account.Email,
+		&account.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, NewNotFoundError("account", "")
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &account, nil
+}
+
+func (storage *DBStorage) TryGetAccount(ctx context.Context, issuer, subject string) (*Account, error) {
+	return storage.queryAccount(ctx, `issuer = $1 AND subject = $2`, issuer, subject)
+}
+
+func (storage *DBStorage) TryGetUserAccount(ctx context.Context, userID string) (*Account, error) {
+	return storage.queryAccount(ctx, `userID = $1`, userID)
+}
+
+func (storage *DBStorage) MergeUser(ctx context.Context, fromUserID, toUserID string) error {
+	tx, err := storage.state.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		fmt.Sprintf(`UPDATE %s SET userID = $2 WHERE userID = $1;`, pq.QuoteIdentifier(storage.cfg.TableName)),
+		fmt.Sprintf(
+			`DELETE FROM %[1]s AS source WHERE userID = $1
+			AND EXISTS (SELECT 1 FROM %[1]s AS target WHERE target.userID = $2 AND target.name = source.name);`,
+			auxTable(storage.cfg, "utm_templates"),
+		),
+		fmt.Sprintf(`UPDATE %s SET userID = $2 WHERE userID = $1;`, auxTable(storage.cfg, "utm_templates")),
+		fmt.Sprintf(`UPDATE %s SET userID = $2 WHERE userID = $1;`, auxTable(storage.cfg, "api_keys")),
+		fmt.Sprintf(
+			`DELETE FROM %[1]s AS source WHERE userID = $1
+			AND EXISTS (SELECT 1 FROM %[1]s AS target WHERE target.userID = $2 AND target.teamID = source.teamID);`,
+			auxTable(storage.cfg, "team_members"),
+		),
+		fmt.Sprintf(`UPDATE %s SET userID = $2 WHERE userID = $1;`, auxTable(storage.cfg, "team_members")),
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, fromUserID, toUserID); err != nil {
+			return fmt.Errorf("failed to merge user: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (storage *DBStorage) CreateTeam(ctx context.Context, team Team, owner Member) error {
+	tx, err := storage.state.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`INSERT INTO %s (id, name, created_at) VALUES ($1, $2, $3);`, auxTable(storage.cfg, "teams"))
+	if _, err := tx.ExecContext(ctx, query, team.ID, team.Name, team.CreatedAt); err != nil {
+		return fmt.Errorf("failed to store team: %w", err)
+	}
+
+	if err := storage.upsertMember(ctx, tx, owner); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (storage *DBStorage) TryGetTeam(ctx context.Context, id string) (*Team, error) {
+	query := fmt.Sprintf(`SELECT id, name, created_at FROM %s WHERE id = $1`, auxTable(storage.cfg, "teams"))
+
+	var team Team
+	err := storage.state.DB.QueryRowContext(ctx, query, id).Scan(&team.ID, &team.Name, &team.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, NewNotFoundError("team", id)
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &team, nil
+}
+
+func (storage *DBStorage) GetTeamURLs(ctx context.Context, teamID, tag string) ([]URLRecord, error) {
+	if tag == "" {
+		query := fmt.Sprintf(
+			`SELECT %s FROM %s WHERE team_id = $1 ORDER BY id`,
+			recordColumns,
+			pq.QuoteIdentifier(storage.cfg.TableName),
+		)
+
+		return storage.queryRecords(ctx, query, teamID)
+	}
+
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s WHERE team_id = $1 AND shortURL IN (SELECT shortURL FROM %s WHERE tag = $2) ORDER BY id`,
+		recordColumns,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+		auxTable(storage.cfg, "tags"),
+	)
+
+	return storage.queryRecords(ctx, query, teamID, tag)
+}
+
+func (storage *DBStorage) SetTeam(ctx context.Context, shortURL, teamID string) error {
+	query := fmt.Sprintf(
+		`UPDATE %s SET team_id = $1 WHERE shortURL = $2;`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	result, err := storage.state.DB.ExecContext(ctx, query, teamID, shortURL)
+	if err != nil {
+		return fmt.Errorf("failed to update team: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) TryGetMember(ctx context.Context, teamID, userID string) (*Member, error) {
+	query := fmt.Sprintf(`SELECT role FROM %s WHERE teamID = $1 AND userID = $2`, auxTable(storage.cfg, "team_members"))
+
+	member := Member{TeamID: teamID, UserID: userID}
+	err := storage.state.DB.QueryRowContext(ctx, query, teamID, userID).Scan(&member.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, NewNotFoundError("team member", userID)
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &member, nil
+}
+
+func (storage *DBStorage) queryMembers(ctx context.Context, condition, value string) ([]Member, error) {
+	query := fmt.Sprintf(
+		`SELECT teamID, userID, role FROM %s WHERE %s = $1 ORDER BY teamID, userID`,
+		auxTable(storage.cfg, "team_members"),
+		condition,
+	)
+
+	rows, err := storage.state.DB.QueryContext(ctx, query, value)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	defer rows.Close()
+
+	members := make([]Member, 0)
+	for rows.Next() {
+		var member Member
+		if err := rows.Scan(&member.TeamID, &member.UserID, &member.Role); err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+
+		members = append(members, member)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return members, nil
+}
+
+func (storage *DBStorage) GetMembers(ctx context.Context, teamID string) ([]Member, error) {
+	return storage.queryMembers(ctx, "teamID", teamID)
+}
+
+func (storage *DBStorage) GetMemberships(ctx context.Context, userID string) ([]Member, error) {
+	return storage.queryMembers(ctx, "userID", userID)
+}
+
+func (storage *DBStorage) upsertMember(ctx context.Context, db execer, member Member) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (teamID, userID, role) 
+		VALUES ($1, $2, $3) 
+		ON CONFLICT (teamID, userID) 
+		DO UPDATE SET role = EXCLUDED.role;`,
+		auxTable(storage.cfg, "team_members"),
+	)
+
+	if _, err := db.ExecContext(ctx, query, member.TeamID, member.UserID, member.Role); err != nil {
+		return fmt.Errorf("failed to store team member: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) SetMember(ctx context.Context, member Member) error {
+	return storage.upsertMember(ctx, storage.state.DB, member)
+}
+
+func (storage *DBStorage) RemoveMember(ctx context.Context, teamID, userID string) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE teamID = $1 AND userID = $2`, auxTable(storage.cfg, "team_members"))
+
+	result, err := storage.state.DB.ExecContext(ctx, query, teamID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove team member: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("team member", userID)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) GetUsage(ctx context.Context, userID string, since time.Time) (*Usage, error) {
+	return storage.usage(ctx, storage.state.DB, userID, since)
+}
+
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (storage *DBStorage) usage(ctx context.Context, db rowQuerier, userID string, since time.Time) (*Usage, error) {
+	query := fmt.Sprintf(
+		`SELECT COUNT(*) FILTER (WHERE NOT deletedFlag), COUNT(*) FILTER (WHERE created_at >= $2),
+			MIN(created_at) FILTER (WHERE created_at >= $2)
+		FROM %s WHERE userID = $1`,
+		pq.QuoteIdentifier(storage.cfg.TableName),
+	)
+
+	var usage Usage
+	var firstCreated sql.NullTime
+	err := db.QueryRowContext(ctx, query, userID, since).Scan(&usage.Active, &usage.Created, &firstCreated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count user URLs: %w", err)
+	}
+
+	usage.FirstCreated = firstCreated.Time
+	return &usage, nil
+}
+
+func (storage *DBStorage) SetQuota(ctx context.Context, quota Quota) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s (userID, max_active, max_daily) VALUES ($1, $2, $3)
+		ON CONFLICT (userID) DO UPDATE SET max_active = EXCLUDED.max_active, max_daily = EXCLUDED.max_daily;`,
+		auxTable(storage.cfg, "quotas"),
+	)
+
+	if _, err := storage.state.DB.ExecContext(ctx, query, quota.UserID, quota.MaxActive, quota.MaxDaily); err != nil {
+		return fmt.Errorf("failed to store quota: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *DBStorage) TryGetQuota(ctx context.Context, userID string) (*Quota, error) {
+	query := fmt.Sprintf(`SELECT max_active, max_daily FROM %s WHERE userID = $1`, auxTable(storage.cfg, "quotas"))
+
+	quota := Quota{UserID: userID}
+	err := storage.state.DB.QueryRowContext(ctx, query, userID).Scan(&quota.MaxActive, &quota.MaxDaily)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, NewNotFoundError("quota", userID)
+		}
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &quota, nil
+}
+
+func (storage *DBStorage) DeleteQuota(ctx context.Context, userID string) error {
+	query := fmt.Sprintf(`DELETE FROM %s WHERE userID = $1`, auxTable(storage.cfg, "quotas"))
+
+	result, err := storage.state.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete quota: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return NewNotFoundError("quota", userID)
+	}
+
+	return nil
+}
+
+// auxTable names a table that accompanies the main URL table.
+func auxTable(cfg *config.Config, name string) string {
+	return pq.QuoteIdentifier(cfg.TableName + "_" + name)
+}
+
+func createAuxTables(state *DBState, cfg *config.Config) error {
+	tables := []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			userID TEXT NOT NULL,
+			name TEXT NOT NULL,
+			params JSONB NOT NULL,
+			PRIMARY KEY (userID, name));`,
+			auxTable(cfg, "utm_templates"),
+		),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			id BIGSERIAL PRIMARY KEY,
+			shortURL TEXT NOT NULL,
+			variant TEXT NOT NULL DEFAULT '',
+			clicked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP);
+			CREATE INDEX IF NOT EXISTS %s ON %s (shortURL);`,
+			auxTable(cfg, "clicks"),
+			pq.QuoteIdentifier(cfg.TableName+"_clicks_shorturl_idx"),
+			auxTable(cfg, "clicks"),
+		),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			shortURL TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (shortURL, tag));
+			CREATE INDEX IF NOT EXISTS %s ON %s (tag);`,
+			auxTable(cfg, "tags"),
+			pq.QuoteIdentifier(cfg.TableName+"_tags_tag_idx"),
+			auxTable(cfg, "tags"),
+		),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			id TEXT PRIMARY KEY,
+			userID TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			hash TEXT NOT NULL UNIQUE,
+			scopes TEXT[] NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used TIMESTAMP WITH TIME ZONE,
+			revoked BOOLEAN NOT NULL DEFAULT FALSE);`,
+			auxTable(cfg, "api_keys"),
+		),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			userID TEXT NOT NULL UNIQUE,
+			email TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (issuer, subject));`,
+			auxTable(cfg, "accounts"),
+		),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP);`,
+			auxTable(cfg, "teams"),
+		),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			teamID TEXT NOT NULL,
+			userID TEXT NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (teamID, userID));
+			CREATE INDEX IF NOT EXISTS %s ON %s (userID);`,
+			auxTable(cfg, "team_members"),
+			pq.QuoteIdentifier(cfg.TableName+"_team_members_userid_idx"),
+			auxTable(cfg, "team_members"),
+		),
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+			userID TEXT PRIMARY KEY,
+			max_active INTEGER NOT NULL,
+			max_daily INTEGER NOT NULL);`,
+			auxTable(cfg, "quotas"),
+		),
+	}
+
+	for _, table := range tables {
+		if _, err := state.DB.ExecContext(context.Background(), table); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+
+	return nil
 }
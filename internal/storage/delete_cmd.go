@@ -12,8 +12,9 @@ import (
 )
 
 type Task struct {
-	userID string
-	urls   []string
+	userID    string
+	urls      []string
+	onDeleted func(urls []string)
 }
 
 type DeleteCmd struct {
@@ -21,19 +22,19 @@ type DeleteCmd struct {
 	cfg       *config.Config
 	inputChan chan Task
 	mu        sync.Mutex
-	buffers   map[string][]string
+	buffers   map[string][]Task
 }
 
-func (cmd *DeleteCmd) Append(userID string, urls []string) {
-	cmd.inputChan <- Task{userID: userID, urls: urls}
+func (cmd *DeleteCmd) Append(userID string, urls []string, onDeleted func(urls []string)) {
+	cmd.inputChan <- Task{userID: userID, urls: urls, onDeleted: onDeleted}
 }
 
 func (cmd *DeleteCmd) Finalize() {
 	close(cmd.inputChan)
 
 	cmd.mu.Lock()
-	for userID, urls := range cmd.buffers {
-		cmd.flush(userID, urls)
+	for userID, tasks := range cmd.buffers {
+		cmd.flush(userID, tasks)
 	}
 	cmd.mu.Unlock()
 }
@@ -46,8 +47,8 @@ func (cmd *DeleteCmd) RunAsync() {
 		select {
 		case <-ticker.C:
 			cmd.mu.Lock()
-			for userID, urls := range cmd.buffers {
-				cmd.flush(userID, urls)
+			for userID, tasks := range cmd.buffers {
+				cmd.flush(userID, tasks)
 			}
 			cmd.mu.Unlock()
 		case task, ok := <-cmd.inputChan:
@@ -56,40 +57,91 @@ func (cmd *DeleteCmd) RunAsync() {
 			}
 
 			cmd.mu.Lock()
-			urls := cmd.buffers[task.userID]
-			urls = append(urls, task.urls...)
+			tasks := append(cmd.buffers[task.userID], task)
 
 			var limit = 100
-			if len(urls) >= limit {
-				cmd.flush(task.userID, urls)
+			if countURLs(tasks) >= limit {
+				cmd.flush(task.userID, tasks)
 			} else {
-				cmd.buffers[task.userID] = urls
+				cmd.buffers[task.userID] = tasks
 			}
 			cmd.mu.Unlock()
 		}
 	}
 }
 
-func (cmd *DeleteCmd) flush(userID string, urls []string) {
+func countURLs(tasks []Task) int {
+	count := 0
+	for _, task := range tasks {
+		count += len(task.urls)
+	}
+
+	return count
+}
+
+// flush marks the URLs of the tasks as deleted, then tells each task which
+// of its URLs were live and are deleted now.
+func (cmd *DeleteCmd) flush(userID string, tasks []Task) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	delete(cmd.buffers, userID)
+
+	urls := make([]string, 0, countURLs(tasks))
+	for _, task := range tasks {
+		urls = append(urls, task.urls...)
+	}
+
 	query := fmt.Sprintf(
-		`UPDATE %s SET deletedFlag = TRUE WHERE userID = $1 AND shortUrl = ANY($2);`,
+		`UPDATE %s SET deletedFlag = TRUE WHERE userID = $1 AND shortUrl = ANY($2) AND NOT deletedFlag RETURNING shortUrl;`,
 		pq.QuoteIdentifier(cmd.cfg.TableName),
 	)
 
-	_, err := cmd.state.DB.ExecContext(ctx, query, userID, pq.Array(cmd.buffers[userID]))
+	rows, err := cmd.state.DB.QueryContext(ctx, query, userID, pq.Array(urls))
 	if err != nil {
 		log.Printf("Failed to mark URLs as deleted: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	deleted := make(map[string]bool)
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			log.Printf("Failed to read deleted URLs: %v", err)
+			return
+		}
+		deleted[shortURL] = true
 	}
 
-	delete(cmd.buffers, userID)
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to read deleted URLs: %v", err)
+		return
+	}
+
+	for _, task := range tasks {
+		if task.onDeleted == nil {
+			continue
+		}
+
+		taskDeleted := make([]string, 0, len(task.urls))
+		for _, shortURL := range task.urls {
+			if deleted[shortURL] {
+				taskDeleted = append(taskDeleted, shortURL)
+				// a URL listed twice is reported once
+				delete(deleted, shortURL)
+			}
+		}
+
+		if len(taskDeleted) > 0 {
+			task.onDeleted(taskDeleted)
+		}
+	}
 }
 
 func NewDeleteCmd(state *DBState, cfg *config.Config) *DeleteCmd {
 	inputChan := make(chan Task, 100)
-	buffers := make(map[string][]string)
+	buffers := make(map[string][]Task)
 	cmd := &DeleteCmd{state: state, cfg: cfg, buffers: buffers, inputChan: inputChan}
 	go cmd.RunAsync()
 
@@ -18,3 +18,39 @@ func (e *DuplicateURLError) Is(target error) bool {
 func NewDuplicateURLError(url string) error {
 	return &DuplicateURLError{URL: url}
 }
+
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s '%s' not found", e.Kind, e.Name)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	_, ok := target.(*NotFoundError)
+	return ok
+}
+
+func NewNotFoundError(kind, name string) error {
+	return &NotFoundError{Kind: kind, Name: name}
+}
+
+// LimitError reports that a link was not stored as its user is at a limit.
+type LimitError struct {
+	Usage Usage
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("link limit reached: %d active, %d created", e.Usage.Active, e.Usage.Created)
+}
+
+func (e *LimitError) Is(target error) bool {
+	_, ok := target.(*LimitError)
+	return ok
+}
+
+func NewLimitError(usage Usage) error {
+	return &LimitError{Usage: usage}
+}
@@ -5,74 +5,295 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/rules"
 )
 
 type FileStorage struct {
-	urls     map[string]string
-	file     *os.File
-	writer   *bufio.Writer
-	userData *UserDataStorage
+	mu           sync.RWMutex
+	urls         map[string]*URLRecord
+	utmTemplates map[string]map[string]UTMTemplate
+	clicks       map[string]map[string]int
+	apiKeys      map[string]*APIKey
+	accounts     map[accountKey]*Account
+	teams        map[string]*Team
+	members      map[string]map[string]Member
+	quotas       map[string]Quota
+	file         *os.File
+	writer       *bufio.Writer
+	userData     *UserDataStorage
 }
 
-func (storage *FileStorage) StoreURL(ctx context.Context, shortURL, longURL string) error {
-	_, exists := storage.urls[shortURL]
+func (storage *FileStorage) StoreURL(ctx context.Context, record URLRecord) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	_, exists := storage.urls[record.ShortURL]
+	if exists {
+		return NewDuplicateURLError(record.ShortURL)
+	}
+
+	userID, err := GetUserID(ctx)
+	if err != nil {
+		return err
+	}
+
+	return storage.storeURL(userID, record)
+}
+
+func (storage *FileStorage) StoreURLLimited(ctx context.Context, record URLRecord, limits Limits) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	_, exists := storage.urls[record.ShortURL]
 	if exists {
-		return NewDuplicateURLError(shortURL)
+		return NewDuplicateURLError(record.ShortURL)
 	}
 
-	userID, err := getUserID(ctx)
+	userID, err := GetUserID(ctx)
 	if err != nil {
 		return err
 	}
 
-	storage.urls[shortURL] = longURL
-	if err := storage.writeItem(userID, shortURL, longURL); err != nil {
+	if usage := storage.usage(userID, limits.Since); limits.Exceeded(usage) {
+		return NewLimitError(*usage)
+	}
+
+	return storage.storeURL(userID, record)
+}
+
+// storeURL is called with the lock held.
+func (storage *FileStorage) storeURL(userID string, record URLRecord) error {
+	record.UserID = userID
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = time.Now()
+	}
+
+	storage.urls[record.ShortURL] = &record
+	if err := storage.writeItem(&record); err != nil {
 		return err
 	}
 
-	storage.userData.append(userID, longURL, shortURL)
+	storage.userData.append(userID, record.ShortURL)
 	return nil
 }
 
-func (storage *FileStorage) TryGetLongURL(ctx context.Context, shortURL string) (string, bool, error) {
-	originalURL, exists := storage.urls[shortURL]
-	deleted := false
+func (storage *FileStorage) TryGetURL(ctx context.Context, shortURL string) (*URLRecord, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	record, exists := storage.urls[shortURL]
 	if !exists {
-		return "", deleted, errors.New("URL not found")
+		return nil, errors.New("URL not found")
 	}
 
-	return originalURL, deleted, nil
+	result := *record
+	return &result, nil
 }
 
-func (storage *FileStorage) MarkAsDeleted(ctx context.Context, shortURLs []string) {
+func (storage *FileStorage) MarkAsDeleted(ctx context.Context, shortURLs []string, onDeleted func(shortURLs []string)) {
 }
 
 func (storage *FileStorage) Finalize() {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
 	storage.writer.Flush()
 	storage.file.Close()
 }
 
+// Lines of the storage file carry a "kind" tag, lines without it are URL records.
+const (
+	kindUTMTemplate = "utm_template"
+	kindClick       = "click"
+	kindAPIKey      = "api_key"
+	kindAccount     = "account"
+	kindMerge       = "merge"
+	kindTeam        = "team"
+	kindMember      = "member"
+	kindQuota       = "quota"
+)
+
+type itemHeader struct {
+	Kind string `json:"kind"`
+}
+
+// StorageItem is a line of the storage file. A later line with the same
+// short URL replaces the earlier one, so updates are appended as full records.
 type StorageItem struct {
 	ItemID      string `json:"item_id"`
 	UserID      string `json:"user_id"`
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
+	Blocked     bool   `json:"blocked,omitempty"`
+	TeamID      string `json:"team_id,omitempty"`
+
+	Disabled       bool   `json:"disabled,omitempty"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Title     string     `json:"title,omitempty"`
+	ImageURL  string     `json:"image_url,omitempty"`
+	Note      string     `json:"note,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+
+	RedirectCode        int    `json:"redirect_code,omitempty"`
+	Passthrough         bool   `json:"passthrough,omitempty"`
+	PassthroughConflict string `json:"passthrough_conflict,omitempty"`
+	UTMTemplate         string `json:"utm_template,omitempty"`
+
+	Rules          []rules.Rule `json:"rules,omitempty"`
+	Variants       []Variant    `json:"variants,omitempty"`
+	StickyVariants bool         `json:"sticky_variants,omitempty"`
+	PasswordHash   string       `json:"password_hash,omitempty"`
+	MaxClicks      int          `json:"max_clicks,omitempty"`
+	ClickCount     int          `json:"click_count,omitempty"`
+
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	FallbackURL string     `json:"fallback_url,omitempty"`
+
+	LastStatus  int        `json:"last_status,omitempty"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
 }
 
-func (storage *FileStorage) writeItem(userID, shortURL, longURL string) error {
+func newStorageItem(itemID string, record *URLRecord) StorageItem {
 	item := StorageItem{
-		ItemID:      strconv.Itoa(len(storage.urls)),
-		UserID:      userID,
-		ShortURL:    shortURL,
-		OriginalURL: longURL,
+		ItemID:      itemID,
+		UserID:      record.UserID,
+		ShortURL:    record.ShortURL,
+		OriginalURL: record.LongURL,
+		Blocked:     record.Blocked,
+		TeamID:      record.TeamID,
+		Title:       record.Title,
+
+		Disabled:       record.Disabled,
+		DisabledReason: record.DisabledReason,
+
+		ImageURL: record.ImageURL,
+		Note:     record.Note,
+		Tags:     record.Tags,
+
+		RedirectCode:        record.RedirectCode,
+		Passthrough:         record.Passthrough,
+		PassthroughConflict: record.PassthroughConflict,
+		UTMTemplate:         record.UTMTemplate,
+
+		Rules:          record.Rules,
+		Variants:       record.Variants,
+		StickyVariants: record.StickyVariants,
+		PasswordHash:   record.PasswordHash,
+		MaxClicks:      record.MaxClicks,
+		ClickCount:     record.ClickCount,
+		FallbackURL:    record.FallbackURL,
+		LastStatus:     record.LastStatus,
+	}
+
+	if !record.CreatedAt.IsZero() {
+		createdAt := record.CreatedAt
+		item.CreatedAt = &createdAt
+	}
+
+	if !record.LastChecked.IsZero() {
+		lastChecked := record.LastChecked
+		item.LastChecked = &lastChecked
+	}
+
+	if !record.NotBefore.IsZero() {
+		notBefore := record.NotBefore
+		item.NotBefore = &notBefore
+	}
+
+	if !record.NotAfter.IsZero() {
+		notAfter := record.NotAfter
+		item.NotAfter = &notAfter
+	}
+
+	return item
+}
+
+func (item *StorageItem) record() *URLRecord {
+	record := &URLRecord{
+		ShortURL: item.ShortURL,
+		LongURL:  item.OriginalURL,
+		UserID:   item.UserID,
+		Blocked:  item.Blocked,
+		TeamID:   item.TeamID,
+		Title:    item.Title,
+
+		Disabled:       item.Disabled,
+		DisabledReason: item.DisabledReason,
+
+		ImageURL: item.ImageURL,
+		Note:     item.Note,
+		Tags:     item.Tags,
+
+		RedirectCode:        item.RedirectCode,
+		Passthrough:         item.Passthrough,
+		PassthroughConflict: item.PassthroughConflict,
+		UTMTemplate:         item.UTMTemplate,
+
+		Rules:          item.Rules,
+		Variants:       item.Variants,
+		StickyVariants: item.StickyVariants,
+		PasswordHash:   item.PasswordHash,
+		MaxClicks:      item.MaxClicks,
+		ClickCount:     item.ClickCount,
+		FallbackURL:    item.FallbackURL,
+		LastStatus:     item.LastStatus,
 	}
 
-	data, err := json.Marshal(&item)
+	if item.CreatedAt != nil {
+		record.CreatedAt = *item.CreatedAt
+	}
+
+	if item.LastChecked != nil {
+		record.LastChecked = *item.LastChecked
+	}
+
+	if item.NotBefore != nil {
+		record.NotBefore = *item.NotBefore
+	}
+
+	if item.NotAfter != nil {
+		record.NotAfter = *item.NotAfter
+	}
+
+	return record
+}
+
+type UTMTemplateItem struct {
+	Kind    string            `json:"kind"`
+	UserID  string            `json:"user_id"`
+	Name    string            `json:"name"`
+	Params  map[string]string `json:"params,omitempty"`
+	Deleted bool              `json:"deleted,omitempty"`
+}
+
+type ClickItem struct {
+	Kind      string    `json:"kind"`
+	ShortURL  string    `json:"short_url"`
+	Variant   string    `json:"variant,omitempty"`
+	ClickedAt time.Time `json:"clicked_at"`
+}
+
+func (storage *FileStorage) writeItem(record *URLRecord) error {
+	item := newStorageItem(strconv.Itoa(len(storage.urls)), record)
+	return storage.writeLine(&item)
+}
+
+func (storage *FileStorage) writeLine(item any) error {
+	data, err := json.Marshal(item)
 	if err != nil {
 		return err
 	}
@@ -96,8 +317,825 @@ func (storage *FileStorage) EndTransaction(ctx context.Context) error {
 	return nil
 }
 
-func (storage *FileStorage) GetSummary(ctx context.Context) string {
-	return storage.userData.getSummary(ctx)
+func (storage *FileStorage) GetUserURLs(ctx context.Context, userID, tag string) ([]URLRecord, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	shortURLs := storage.userData.get(userID)
+	records := make([]URLRecord, 0, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		record := storage.urls[shortURL]
+		if tag != "" && !slices.Contains(record.Tags, tag) {
+			continue
+		}
+
+		records = append(records, *record)
+	}
+
+	return records, nil
+}
+
+func (storage *FileStorage) SetMetadata(ctx context.Context, shortURL, title, note string, tags []string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	record.Title = title
+	record.Note = note
+	record.Tags = tags
+	return storage.writeItem(record)
+}
+
+func (storage *FileStorage) SetPageMetadata(ctx context.Context, shortURL, title, imageURL string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	if record.Title == "" {
+		record.Title = title
+	}
+	record.ImageURL = imageURL
+	return storage.writeItem(record)
+}
+
+func (storage *FileStorage) ListURLs(ctx context.Context) ([]URLRecord, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	records := make([]URLRecord, 0, len(storage.urls))
+	for _, record := range storage.urls {
+		records = append(records, *record)
+	}
+
+	return records, nil
+}
+
+func (storage *FileStorage) SetBlocked(ctx context.Context, shortURLs []string, blocked bool) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, shortURL := range shortURLs {
+		record, exists := storage.urls[shortURL]
+		if !exists || record.Blocked == blocked {
+			continue
+		}
+
+		record.Blocked = blocked
+		if err := storage.writeItem(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *FileStorage) SetHealth(ctx context.Context, shortURL string, status int, checkedAt time.Time) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return errors.New("URL not found")
+	}
+
+	// a check that keeps the same status is not persisted to avoid growing the file on every pass
+	changed := record.LastStatus != status || record.LastChecked.IsZero()
+	record.LastStatus = status
+	record.LastChecked = checkedAt
+	if !changed {
+		return nil
+	}
+
+	return storage.writeItem(record)
+}
+
+func (storage *FileStorage) SearchURLs(ctx context.Context, query string, limit int) ([]URLRecord, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	records := make([]URLRecord, 0)
+	if record, exists := storage.urls[query]; exists {
+		records = append(records, *record)
+	}
+
+	matches := make([]URLRecord, 0)
+	lowered := strings.ToLower(query)
+	for _, record := range storage.urls {
+		if record.ShortURL != query && strings.Contains(strings.ToLower(record.LongURL), lowered) {
+			matches = append(matches, *record)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].CreatedAt.Before(matches[j].CreatedAt) })
+	records = append(records, matches...)
+	if len(records) > limit {
+		records = records[:limit]
+	}
+
+	return records, nil
+}
+
+func (storage *FileStorage) CountURLs(ctx context.Context) (int, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	return len(storage.urls), nil
+}
+
+func (storage *FileStorage) CountUsers(ctx context.Context) (int, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	return storage.userData.count(), nil
+}
+
+func (storage *FileStorage) SetDisabled(ctx context.Context, shortURLs []string, disabled bool, reason string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, shortURL := range shortURLs {
+		record, exists := storage.urls[shortURL]
+		if !exists {
+			continue
+		}
+
+		record.Disabled = disabled
+		record.DisabledReason = reason
+		if err := storage.writeItem(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *FileStorage) SetOwner(ctx context.Context, shortURL, userID string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	storage.userData.remove(record.UserID, shortURL)
+	storage.userData.append(userID, shortURL)
+	record.UserID = userID
+	return storage.writeItem(record)
+}
+
+func (storage *FileStorage) ConsumeClick(ctx context.Context, shortURL string) (bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return false, NewNotFoundError("short URL", shortURL)
+	}
+
+	if record.MaxClicks == 0 || record.Exhausted() {
+		return false, nil
+	}
+
+	record.ClickCount++
+	if err := storage.writeItem(record); err != nil {
+		record.ClickCount--
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (storage *FileStorage) SetRules(ctx context.Context, shortURL string, redirectRules []rules.Rule) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	record.Rules = redirectRules
+	return storage.writeItem(record)
+}
+
+func (storage *FileStorage) SetVariants(ctx context.Context, shortURL string, variants []Variant, sticky bool) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	record.Variants = variants
+	record.StickyVariants = sticky
+	return storage.writeItem(record)
+}
+
+func (storage *FileStorage) RecordClick(ctx context.Context, click Click) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	item := ClickItem{Kind: kindClick, ShortURL: click.ShortURL, Variant: click.Variant, ClickedAt: click.ClickedAt}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	storage.countClick(click.ShortURL, click.Variant)
+	return nil
+}
+
+func (storage *FileStorage) countClick(shortURL, variant string) {
+	stats, exists := storage.clicks[shortURL]
+	if !exists {
+		stats = make(map[string]int)
+		storage.clicks[shortURL] = stats
+	}
+
+	stats[variant]++
+}
+
+func (storage *FileStorage) GetClickStats(ctx context.Context, shortURL string) (map[string]int, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	stats := make(map[string]int, len(storage.clicks[shortURL]))
+	for variant, count := range storage.clicks[shortURL] {
+		stats[variant] = count
+	}
+
+	return stats, nil
+}
+
+func (storage *FileStorage) StoreUTMTemplate(ctx context.Context, template UTMTemplate) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	item := UTMTemplateItem{Kind: kindUTMTemplate, UserID: template.UserID, Name: template.Name, Params: template.Params}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	storage.putUTMTemplate(template)
+	return nil
+}
+
+func (storage *FileStorage) putUTMTemplate(template UTMTemplate) {
+	templates, exists := storage.utmTemplates[template.UserID]
+	if !exists {
+		templates = make(map[string]UTMTemplate)
+		storage.utmTemplates[template.UserID] = templates
+	}
+
+	templates[template.Name] = template
+}
+
+func (storage *FileStorage) TryGetUTMTemplate(ctx context.Context, userID, name string) (*UTMTemplate, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	template, exists := storage.utmTemplates[userID][name]
+	if !exists {
+		return nil, NewNotFoundError("UTM template", name)
+	}
+
+	return &template, nil
+}
+
+func (storage *FileStorage) GetUTMTemplates(ctx context.Context, userID string) ([]UTMTemplate, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	templates := make([]UTMTemplate, 0, len(storage.utmTemplates[userID]))
+	for _, template := range storage.utmTemplates[userID] {
+		templates = append(templates, template)
+	}
+
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+func (storage *FileStorage) DeleteUTMTemplate(ctx context.Context, userID, name string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, exists := storage.utmTemplates[userID][name]; !exists {
+		return NewNotFoundError("UTM template", name)
+	}
+
+	item := UTMTemplateItem{Kind: kindUTMTemplate, UserID: userID, Name: name, Deleted: true}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	delete(storage.utmTemplates[userID], name)
+	return nil
+}
+
+// APIKeyItem is a snapshot of an API key, the last line of a key wins.
+type APIKeyItem struct {
+	Kind      string     `json:"kind"`
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name,omitempty"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+	Revoked   bool       `json:"revoked,omitempty"`
+}
+
+func (item *APIKeyItem) key() *APIKey {
+	key := &APIKey{
+		ID:        item.ID,
+		UserID:    item.UserID,
+		Name:      item.Name,
+		Hash:      item.Hash,
+		Scopes:    item.Scopes,
+		CreatedAt: item.CreatedAt,
+		Revoked:   item.Revoked,
+	}
+
+	if item.LastUsed != nil {
+		key.LastUsed = *item.LastUsed
+	}
+
+	return key
+}
+
+func (storage *FileStorage) writeAPIKey(key *APIKey) error {
+	item := APIKeyItem{
+		Kind:      kindAPIKey,
+		ID:        key.ID,
+		UserID:    key.UserID,
+		Name:      key.Name,
+		Hash:      key.Hash,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+		Revoked:   key.Revoked,
+	}
+
+	if !key.LastUsed.IsZero() {
+		lastUsed := key.LastUsed
+		item.LastUsed = &lastUsed
+	}
+
+	return storage.writeLine(&item)
+}
+
+func (storage *FileStorage) StoreAPIKey(ctx context.Context, key APIKey) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if err := storage.writeAPIKey(&key); err != nil {
+		return err
+	}
+
+	storage.apiKeys[key.ID] = &key
+	return nil
+}
+
+func (storage *FileStorage) TryGetAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	for _, key := range storage.apiKeys {
+		if key.Hash == hash {
+			result := *key
+			return &result, nil
+		}
+	}
+
+	return nil, NewNotFoundError("API key", "")
+}
+
+func (storage *FileStorage) GetAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	keys := make([]APIKey, 0)
+	for _, key := range storage.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, *key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (storage *FileStorage) RevokeAPIKey(ctx context.Context, userID, id string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	key, exists := storage.apiKeys[id]
+	if !exists || key.UserID != userID {
+		return NewNotFoundError("API key", id)
+	}
+
+	key.Revoked = true
+	return storage.writeAPIKey(key)
+}
+
+func (storage *FileStorage) SetAPIKeyUsed(ctx context.Context, id string, usedAt time.Time) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	key, exists := storage.apiKeys[id]
+	if !exists {
+		return NewNotFoundError("API key", id)
+	}
+
+	key.LastUsed = usedAt
+	return storage.writeAPIKey(key)
+}
+
+type accountKey struct {
+	issuer  string
+	subject string
+}
+
+type AccountItem struct {
+	Kind      string    `json:"kind"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MergeItem records a MergeUser call, replaying it moves everything the
+// source user had by then.
+type MergeItem struct {
+	Kind       string `json:"kind"`
+	FromUserID string `json:"from_user_id"`
+	ToUserID   string `json:"to_user_id"`
+}
+
+func (storage *FileStorage) StoreAccount(ctx context.Context, account Account) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	key := accountKey{issuer: account.Issuer, subject: account.Subject}
+	if _, exists := storage.accounts[key]; exists {
+		return fmt.Errorf("account '%s' already exists", account.Subject)
+	}
+
+	item := AccountItem{
+		Kind:      kindAccount,
+		Issuer:    account.Issuer,
+		Subject:   account.Subject,
+		UserID:    account.UserID,
+		Email:     account.Email,
+		CreatedAt: account.CreatedAt,
+	}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	storage.accounts[key] = &account
+	return nil
+}
+
+func (storage *FileStorage) TryGetAccount(ctx context.Context, issuer, subject string) (*Account, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	account, exists := storage.accounts[accountKey{issuer: issuer, subject: subject}]
+	if !exists {
+		return nil, NewNotFoundError("account", subject)
+	}
+
+	result := *account
+	return &result, nil
+}
+
+func (storage *FileStorage) TryGetUserAccount(ctx context.Context, userID string) (*Account, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	for _, account := range storage.accounts {
+		if account.UserID == userID {
+			result := *account
+			return &result, nil
+		}
+	}
+
+	return nil, NewNotFoundError("account", userID)
+}
+
+func (storage *FileStorage) MergeUser(ctx context.Context, fromUserID, toUserID string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	item := MergeItem{Kind: kindMerge, FromUserID: fromUserID, ToUserID: toUserID}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	storage.mergeUser(fromUserID, toUserID)
+	return nil
+}
+
+func (storage *FileStorage) mergeUser(fromUserID, toUserID string) {
+	for _, shortURL := range storage.userData.get(fromUserID) {
+		storage.urls[shortURL].UserID = toUserID
+		storage.userData.append(toUserID, shortURL)
+	}
+	delete(storage.userData.urls, fromUserID)
+
+	for name, template := range storage.utmTemplates[fromUserID] {
+		if _, exists := storage.utmTemplates[toUserID][name]; !exists {
+			template.UserID = toUserID
+			storage.putUTMTemplate(template)
+		}
+	}
+	delete(storage.utmTemplates, fromUserID)
+
+	for _, key := range storage.apiKeys {
+		if key.UserID == fromUserID {
+			key.UserID = toUserID
+		}
+	}
+
+	for _, members := range storage.members {
+		member, exists := members[fromUserID]
+		if !exists {
+			continue
+		}
+
+		delete(members, fromUserID)
+		if _, exists := members[toUserID]; !exists {
+			member.UserID = toUserID
+			members[toUserID] = member
+		}
+	}
+}
+
+type TeamItem struct {
+	Kind      string    `json:"kind"`
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MemberItem sets the role of a team member or removes the member.
+type MemberItem struct {
+	Kind    string `json:"kind"`
+	TeamID  string `json:"team_id"`
+	UserID  string `json:"user_id"`
+	Role    string `json:"role,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+}
+
+func (storage *FileStorage) CreateTeam(ctx context.Context, team Team, owner Member) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, exists := storage.teams[team.ID]; exists {
+		return fmt.Errorf("team '%s' already exists", team.ID)
+	}
+
+	item := TeamItem{Kind: kindTeam, ID: team.ID, Name: team.Name, CreatedAt: team.CreatedAt}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	storage.teams[team.ID] = &team
+	return storage.writeMember(owner, false)
+}
+
+func (storage *FileStorage) TryGetTeam(ctx context.Context, id string) (*Team, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	team, exists := storage.teams[id]
+	if !exists {
+		return nil, NewNotFoundError("team", id)
+	}
+
+	result := *team
+	return &result, nil
+}
+
+func (storage *FileStorage) GetTeamURLs(ctx context.Context, teamID, tag string) ([]URLRecord, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	records := make([]URLRecord, 0)
+	for _, record := range storage.urls {
+		if record.TeamID != teamID || (tag != "" && !slices.Contains(record.Tags, tag)) {
+			continue
+		}
+
+		records = append(records, *record)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records, nil
+}
+
+func (storage *FileStorage) SetTeam(ctx context.Context, shortURL, teamID string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	record, exists := storage.urls[shortURL]
+	if !exists {
+		return NewNotFoundError("short URL", shortURL)
+	}
+
+	record.TeamID = teamID
+	return storage.writeItem(record)
+}
+
+func (storage *FileStorage) TryGetMember(ctx context.Context, teamID, userID string) (*Member, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	member, exists := storage.members[teamID][userID]
+	if !exists {
+		return nil, NewNotFoundError("team member", userID)
+	}
+
+	return &member, nil
+}
+
+func sortMembers(members []Member) {
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].TeamID != members[j].TeamID {
+			return members[i].TeamID < members[j].TeamID
+		}
+		return members[i].UserID < members[j].UserID
+	})
+}
+
+func (storage *FileStorage) GetMembers(ctx context.Context, teamID string) ([]Member, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	members := make([]Member, 0, len(storage.members[teamID]))
+	for _, member := range storage.members[teamID] {
+		members = append(members, member)
+	}
+
+	sortMembers(members)
+	return members, nil
+}
+
+func (storage *FileStorage) GetMemberships(ctx context.Context, userID string) ([]Member, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	memberships := make([]Member, 0)
+	for _, members := range storage.members {
+		if member, exists := members[userID]; exists {
+			memberships = append(memberships, member)
+		}
+	}
+
+	sortMembers(memberships)
+	return memberships, nil
+}
+
+func (storage *FileStorage) SetMember(ctx context.Context, member Member) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return storage.writeMember(member, false)
+}
+
+func (storage *FileStorage) RemoveMember(ctx context.Context, teamID, userID string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, exists := storage.members[teamID][userID]; !exists {
+		return NewNotFoundError("team member", userID)
+	}
+
+	return storage.writeMember(Member{TeamID: teamID, UserID: userID}, true)
+}
+
+func (storage *FileStorage) writeMember(member Member, removed bool) error {
+	item := MemberItem{Kind: kindMember, TeamID: member.TeamID, UserID: member.UserID, Role: member.Role, Removed: removed}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	storage.putMember(member, removed)
+	return nil
+}
+
+func (storage *FileStorage) putMember(member Member, removed bool) {
+	if removed {
+		delete(storage.members[member.TeamID], member.UserID)
+		return
+	}
+
+	members, exists := storage.members[member.TeamID]
+	if !exists {
+		members = make(map[string]Member)
+		storage.members[member.TeamID] = members
+	}
+
+	members[member.UserID] = member
+}
+
+// QuotaItem sets the quota override of a user or drops it.
+type QuotaItem struct {
+	Kind      string `json:"kind"`
+	UserID    string `json:"user_id"`
+	MaxActive int    `json:"max_active"`
+	MaxDaily  int    `json:"max_daily"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+func (item *QuotaItem) quota() Quota {
+	return Quota{UserID: item.UserID, MaxActive: item.MaxActive, MaxDaily: item.MaxDaily}
+}
+
+func (storage *FileStorage) GetUsage(ctx context.Context, userID string, since time.Time) (*Usage, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	return storage.usage(userID, since), nil
+}
+
+// usage is called with the lock held.
+func (storage *FileStorage) usage(userID string, since time.Time) *Usage {
+	usage := &Usage{}
+	for _, shortURL := range storage.userData.get(userID) {
+		record := storage.urls[shortURL]
+		if !record.Deleted {
+			usage.Active++
+		}
+
+		if !record.CreatedAt.Before(since) {
+			usage.Created++
+			if usage.FirstCreated.IsZero() || record.CreatedAt.Before(usage.FirstCreated) {
+				usage.FirstCreated = record.CreatedAt
+			}
+		}
+	}
+
+	return usage
+}
+
+func (storage *FileStorage) SetQuota(ctx context.Context, quota Quota) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return storage.writeQuota(quota, false)
+}
+
+func (storage *FileStorage) TryGetQuota(ctx context.Context, userID string) (*Quota, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	quota, exists := storage.quotas[userID]
+	if !exists {
+		return nil, NewNotFoundError("quota", userID)
+	}
+
+	return &quota, nil
+}
+
+func (storage *FileStorage) DeleteQuota(ctx context.Context, userID string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, exists := storage.quotas[userID]; !exists {
+		return NewNotFoundError("quota", userID)
+	}
+
+	return storage.writeQuota(Quota{UserID: userID}, true)
+}
+
+func (storage *FileStorage) writeQuota(quota Quota, deleted bool) error {
+	item := QuotaItem{Kind: kindQuota, UserID: quota.UserID, MaxActive: quota.MaxActive, MaxDaily: quota.MaxDaily, Deleted: deleted}
+	if err := storage.writeLine(&item); err != nil {
+		return err
+	}
+
+	storage.putQuota(quota, deleted)
+	return nil
+}
+
+func (storage *FileStorage) putQuota(quota Quota, deleted bool) {
+	if deleted {
+		delete(storage.quotas, quota.UserID)
+		return
+	}
+
+	storage.quotas[quota.UserID] = quota
 }
 
 func NewFileStorage(cfg *config.Config) (*FileStorage, error) {
@@ -106,22 +1144,128 @@ func NewFileStorage(cfg *config.Config) (*FileStorage, error) {
 		return nil, err
 	}
 
-	urls := make(map[string]string)
-	userData := NewUserDataStorage(cfg)
+	storage := &FileStorage{
+		urls:         make(map[string]*URLRecord),
+		utmTemplates: make(map[string]map[string]UTMTemplate),
+		clicks:       make(map[string]map[string]int),
+		apiKeys:      make(map[string]*APIKey),
+		accounts:     make(map[accountKey]*Account),
+		teams:        make(map[string]*Team),
+		members:      make(map[string]map[string]Member),
+		quotas:       make(map[string]Quota),
+		file:         file,
+		writer:       bufio.NewWriter(file),
+		userData:     NewUserDataStorage(),
+	}
 
 	decoder := json.NewDecoder(file)
-	var item StorageItem
 	for {
-		if err := decoder.Decode(&item); err != nil {
+		var line json.RawMessage
+		if err := decoder.Decode(&line); err != nil {
 			if err == io.EOF {
 				break
 			}
 			return nil, err
 		}
 
-		urls[item.ShortURL] = item.OriginalURL
-		userData.append(item.UserID, item.OriginalURL, item.ShortURL)
+		if err := storage.loadLine(line); err != nil {
+			return nil, err
+		}
 	}
 
-	return &FileStorage{urls: urls, file: file, writer: bufio.NewWriter(file), userData: userData}, nil
+	return storage, nil
+}
+
+func (storage *FileStorage) loadLine(line json.RawMessage) error {
+	var header itemHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return err
+	}
+
+	switch header.Kind {
+	case "":
+		var item StorageItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		if previous, exists := storage.urls[item.ShortURL]; !exists {
+			storage.userData.append(item.UserID, item.ShortURL)
+		} else if previous.UserID != item.UserID {
+			storage.userData.remove(previous.UserID, item.ShortURL)
+			storage.userData.append(item.UserID, item.ShortURL)
+		}
+
+		storage.urls[item.ShortURL] = item.record()
+	case kindUTMTemplate:
+		var item UTMTemplateItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		if item.Deleted {
+			delete(storage.utmTemplates[item.UserID], item.Name)
+		} else {
+			storage.putUTMTemplate(UTMTemplate{UserID: item.UserID, Name: item.Name, Params: item.Params})
+		}
+	case kindAPIKey:
+		var item APIKeyItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		storage.apiKeys[item.ID] = item.key()
+	case kindAccount:
+		var item AccountItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		storage.accounts[accountKey{issuer: item.Issuer, subject: item.Subject}] = &Account{
+			Issuer:    item.Issuer,
+			Subject:   item.Subject,
+			UserID:    item.UserID,
+			Email:     item.Email,
+			CreatedAt: item.CreatedAt,
+		}
+	case kindMerge:
+		var item MergeItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		storage.mergeUser(item.FromUserID, item.ToUserID)
+	case kindTeam:
+		var item TeamItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		storage.teams[item.ID] = &Team{ID: item.ID, Name: item.Name, CreatedAt: item.CreatedAt}
+	case kindMember:
+		var item MemberItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		storage.putMember(Member{TeamID: item.TeamID, UserID: item.UserID, Role: item.Role}, item.Removed)
+	case kindQuota:
+		var item QuotaItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		storage.putQuota(item.quota(), item.Deleted)
+	case kindClick:
+		var item ClickItem
+		if err := json.Unmarshal(line, &item); err != nil {
+			return err
+		}
+
+		storage.countClick(item.ShortURL, item.Variant)
+	default:
+		return fmt.Errorf("unknown storage item kind '%s'", header.Kind)
+	}
+
+	return nil
 }
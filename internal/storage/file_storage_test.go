@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rvkarpov/url_shortener/internal/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorageReload(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	ctx := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "user1")
+
+	fileStorage, err := NewFileStorage(&cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "abc", LongURL: "https://foo.com", Title: "Foo"}))
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "def", LongURL: "https://bar.com"}))
+	require.NoError(t, fileStorage.SetBlocked(ctx, []string{"def"}, true))
+	require.NoError(t, fileStorage.SetHealth(ctx, "abc", 404, time.Now()))
+	require.NoError(t, fileStorage.SetMetadata(ctx, "def", "Bar", "landing page", []string{"promo", "spring"}))
+
+	template := UTMTemplate{UserID: "user1", Name: "spring", Params: map[string]string{"utm_source": "mail"}}
+	require.NoError(t, fileStorage.StoreUTMTemplate(ctx, template))
+	require.NoError(t, fileStorage.StoreUTMTemplate(ctx, UTMTemplate{UserID: "user1", Name: "old", Params: template.Params}))
+	require.NoError(t, fileStorage.DeleteUTMTemplate(ctx, "user1", "old"))
+
+	variants := []Variant{{URL: "https://foo.com/a", Weight: 1}, {URL: "https://foo.com/b", Weight: 2}}
+	require.NoError(t, fileStorage.SetVariants(ctx, "abc", variants, true))
+	require.NoError(t, fileStorage.RecordClick(ctx, Click{ShortURL: "abc", Variant: "https://foo.com/a", ClickedAt: time.Now()}))
+	require.NoError(t, fileStorage.RecordClick(ctx, Click{ShortURL: "abc", Variant: "https://foo.com/a", ClickedAt: time.Now()}))
+	require.NoError(t, fileStorage.RecordClick(ctx, Click{ShortURL: "def", ClickedAt: time.Now()}))
+	fileStorage.Finalize()
+
+	fileStorage, err = NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer fileStorage.Finalize()
+
+	records, err := fileStorage.GetUserURLs(ctx, "user1", "")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	assert.Equal(t, "Foo", records[0].Title)
+	assert.Equal(t, 404, records[0].LastStatus)
+	assert.True(t, records[0].Broken())
+	assert.False(t, records[0].CreatedAt.IsZero())
+	assert.True(t, records[1].Blocked)
+	assert.Equal(t, "landing page", records[1].Note)
+	assert.Equal(t, variants, records[0].Variants)
+	assert.True(t, records[0].StickyVariants)
+
+	tagged, err := fileStorage.GetUserURLs(ctx, "user1", "promo")
+	require.NoError(t, err)
+	require.Len(t, tagged, 1)
+	assert.Equal(t, []string{"promo", "spring"}, tagged[0].Tags)
+
+	stats, err := fileStorage.GetClickStats(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"https://foo.com/a": 2}, stats)
+
+	templates, err := fileStorage.GetUTMTemplates(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []UTMTemplate{template}, templates)
+}
+
+func TestFileStorageConsumeClick(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	ctx := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "user1")
+
+	fileStorage, err := NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer fileStorage.Finalize()
+
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "abc", LongURL: "https://foo.com", MaxClicks: 10}))
+
+	var consumed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := fileStorage.ConsumeClick(ctx, "abc")
+			assert.NoError(t, err)
+			if ok {
+				consumed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(10), consumed.Load())
+
+	record, err := fileStorage.TryGetURL(ctx, "abc")
+	require.NoError(t, err)
+	assert.True(t, record.Exhausted())
+}
+
+func TestFileStorageMergeUser(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	anonymous := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "anonymous")
+	owner := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "owner")
+
+	fileStorage, err := NewFileStorage(&cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, fileStorage.StoreAccount(owner, Account{Issuer: "https://idp", Subject: "alice", UserID: "owner"}))
+	require.NoError(t, fileStorage.StoreURL(owner, URLRecord{ShortURL: "owned", LongURL: "https://owned.com"}))
+	require.NoError(t, fileStorage.StoreURL(anonymous, URLRecord{ShortURL: "anon", LongURL: "https://anon.com"}))
+	require.NoError(t, fileStorage.StoreUTMTemplate(owner, UTMTemplate{UserID: "owner", Name: "news", Params: map[string]string{"utm_source": "owner"}}))
+	require.NoError(t, fileStorage.StoreUTMTemplate(anonymous, UTMTemplate{UserID: "anonymous", Name: "news", Params: map[string]string{"utm_source": "anonymous"}}))
+	require.NoError(t, fileStorage.StoreUTMTemplate(anonymous, UTMTemplate{UserID: "anonymous", Name: "ads", Params: map[string]string{"utm_source": "ads"}}))
+	require.NoError(t, fileStorage.StoreAPIKey(anonymous, APIKey{ID: "key", UserID: "anonymous", Hash: "hash"}))
+
+	require.NoError(t, fileStorage.MergeUser(owner, "anonymous", "owner"))
+	require.NoError(t, fileStorage.SetMetadata(owner, "anon", "merged", "", nil))
+
+	check := func(fileStorage *FileStorage) {
+		records, err := fileStorage.GetUserURLs(owner, "owner", "")
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		assert.Equal(t, "merged", records[1].Title)
+
+		records, err = fileStorage.GetUserURLs(anonymous, "anonymous", "")
+		require.NoError(t, err)
+		assert.Empty(t, records)
+
+		templates, err := fileStorage.GetUTMTemplates(owner, "owner")
+		require.NoError(t, err)
+		require.Len(t, templates, 2)
+		assert.Equal(t, "ads", templates[0].Name)
+		assert.Equal(t, "owner", templates[1].Params["utm_source"])
+
+		key, err := fileStorage.TryGetAPIKey(owner, "hash")
+		require.NoError(t, err)
+		assert.Equal(t, "owner", key.UserID)
+
+		account, err := fileStorage.TryGetUserAccount(owner, "owner")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", account.Subject)
+	}
+
+	check(fileStorage)
+	fileStorage.Finalize()
+
+	fileStorage, err = NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer fileStorage.Finalize()
+
+	check(fileStorage)
+}
+
+func TestFileStorageTeams(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	ctx := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "alice")
+
+	fileStorage, err := NewFileStorage(&cfg)
+	require.NoError(t, err)
+
+	team := Team{ID: "team1", Name: "growth", CreatedAt: time.Now().UTC()}
+	require.NoError(t, fileStorage.CreateTeam(ctx, team, Member{TeamID: "team1", UserID: "alice", Role: "owner"}))
+	require.NoError(t, fileStorage.SetMember(ctx, Member{TeamID: "team1", UserID: "bob", Role: "viewer"}))
+	require.NoError(t, fileStorage.SetMember(ctx, Member{TeamID: "team1", UserID: "carol", Role: "editor"}))
+	require.NoError(t, fileStorage.RemoveMember(ctx, "team1", "carol"))
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "shared", LongURL: "https://shared.com"}))
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "private", LongURL: "https://private.com"}))
+	require.NoError(t, fileStorage.SetTeam(ctx, "shared", "team1"))
+
+	check := func(fileStorage *FileStorage) {
+		stored, err := fileStorage.TryGetTeam(ctx, "team1")
+		require.NoError(t, err)
+		assert.Equal(t, "growth", stored.Name)
+
+		members, err := fileStorage.GetMembers(ctx, "team1")
+		require.NoError(t, err)
+		assert.Equal(t, []Member{
+			{TeamID: "team1", UserID: "alice", Role: "owner"},
+			{TeamID: "team1", UserID: "bob", Role: "viewer"},
+		}, members)
+
+		records, err := fileStorage.GetTeamURLs(ctx, "team1", "")
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "shared", records[0].ShortURL)
+	}
+
+	check(fileStorage)
+	fileStorage.Finalize()
+
+	fileStorage, err = NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer fileStorage.Finalize()
+
+	check(fileStorage)
+}
+
+func TestFileStorageAdmin(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	ctx := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "alice")
+
+	fileStorage, err := NewFileStorage(&cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "spam", LongURL: "https://Spam.example.com"}))
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "docs", LongURL: "https://docs.example.com/spam"}))
+	require.NoError(t, fileStorage.SetDisabled(ctx, []string{"spam", "missing"}, true, "phishing"))
+	require.NoError(t, fileStorage.SetOwner(ctx, "docs", "bob"))
+	assert.True(t, errors.Is(fileStorage.SetOwner(ctx, "missing", "bob"), NewNotFoundError("", "")))
+
+	check := func(fileStorage *FileStorage) {
+		records, err := fileStorage.SearchURLs(ctx, "spam", 10)
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		assert.Equal(t, "spam", records[0].ShortURL)
+		assert.True(t, records[0].Disabled)
+		assert.Equal(t, "phishing", records[0].DisabledReason)
+
+		records, err = fileStorage.SearchURLs(ctx, "SPAM", 1)
+		require.NoError(t, err)
+		assert.Len(t, records, 1)
+
+		records, err = fileStorage.GetUserURLs(ctx, "bob", "")
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "docs", records[0].ShortURL)
+
+		records, err = fileStorage.GetUserURLs(ctx, "alice", "")
+		require.NoError(t, err)
+		assert.Len(t, records, 1)
+
+		count, err := fileStorage.CountURLs(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		count, err = fileStorage.CountUsers(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+	}
+
+	check(fileStorage)
+	fileStorage.Finalize()
+
+	fileStorage, err = NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer fileStorage.Finalize()
+
+	check(fileStorage)
+}
+
+func TestFileStorageQuotas(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	ctx := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "alice")
+
+	fileStorage, err := NewFileStorage(&cfg)
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "old", LongURL: "https://old.com", CreatedAt: now.Add(-48 * time.Hour)}))
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "new", LongURL: "https://new.com", CreatedAt: now.Add(-time.Hour)}))
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "newest", LongURL: "https://newest.com", CreatedAt: now}))
+	require.NoError(t, fileStorage.SetQuota(ctx, Quota{UserID: "alice", MaxActive: 10, MaxDaily: -1}))
+	require.NoError(t, fileStorage.SetQuota(ctx, Quota{UserID: "bob", MaxActive: 1, MaxDaily: 1}))
+	require.NoError(t, fileStorage.DeleteQuota(ctx, "bob"))
+	assert.True(t, errors.Is(fileStorage.DeleteQuota(ctx, "bob"), NewNotFoundError("", "")))
+
+	check := func(fileStorage *FileStorage) {
+		usage, err := fileStorage.GetUsage(ctx, "alice", now.Add(-24*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 3, usage.Active)
+		assert.Equal(t, 2, usage.Created)
+		assert.True(t, usage.FirstCreated.Equal(now.Add(-time.Hour)))
+
+		quota, err := fileStorage.TryGetQuota(ctx, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, Quota{UserID: "alice", MaxActive: 10, MaxDaily: -1}, *quota)
+
+		_, err = fileStorage.TryGetQuota(ctx, "bob")
+		assert.True(t, errors.Is(err, NewNotFoundError("", "")))
+	}
+
+	check(fileStorage)
+	fileStorage.Finalize()
+
+	fileStorage, err = NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer fileStorage.Finalize()
+
+	check(fileStorage)
+}
+
+func TestFileStorageStoreURLLimited(t *testing.T) {
+	cfg := testutils.LoadTestConfig()
+	cfg.StorageFile = filepath.Join(t.TempDir(), "storage.dat")
+	ctx := context.WithValue(context.Background(), UserIDKey{Name: "userID"}, "alice")
+
+	fileStorage, err := NewFileStorage(&cfg)
+	require.NoError(t, err)
+	defer fileStorage.Finalize()
+
+	require.NoError(t, fileStorage.StoreURL(ctx, URLRecord{ShortURL: "first", LongURL: "https://first.com", CreatedAt: time.Now().UTC()}))
+	limits := Limits{MaxActive: 4, Since: time.Now().Add(-24 * time.Hour)}
+
+	var stored, limited atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			record := URLRecord{ShortURL: fmt.Sprintf("short%d", i), LongURL: fmt.Sprintf("https://%d.com", i), CreatedAt: time.Now().UTC()}
+			err := fileStorage.StoreURLLimited(ctx, record, limits)
+			switch {
+			case err == nil:
+				stored.Add(1)
+			case errors.Is(err, &LimitError{}):
+				limited.Add(1)
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 3, stored.Load())
+	assert.EqualValues(t, 17, limited.Load())
+
+	// duplicates are reported before the limit
+	err = fileStorage.StoreURLLimited(ctx, URLRecord{ShortURL: "first", LongURL: "https://first.com"}, limits)
+	assert.True(t, errors.Is(err, &DuplicateURLError{}))
+
+	usage, err := fileStorage.GetUsage(ctx, "alice", limits.Since)
+	require.NoError(t, err)
+	assert.Equal(t, 4, usage.Active)
+}
@@ -2,20 +2,267 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/rvkarpov/url_shortener/internal/rules"
 )
 
+type URLRecord struct {
+	ShortURL string
+	LongURL  string
+	UserID   string
+	Deleted  bool
+	Blocked  bool
+
+	// Disabled links are taken down by an operator, only operators enable them again
+	Disabled       bool
+	DisabledReason string
+
+	// TeamID shares the link with the members of the team when not empty
+	TeamID string
+
+	CreatedAt time.Time
+	Title     string
+	ImageURL  string
+	Note      string
+	Tags      []string
+
+	// RedirectCode overrides the configured redirect status when non-zero
+	RedirectCode int
+
+	// Passthrough forwards the extra path and query of a visit to the target,
+	// PassthroughConflict is "incoming" or "target", empty means the configured default
+	Passthrough         bool
+	PassthroughConflict string
+
+	LastStatus  int
+	LastChecked time.Time
+
+	// UTMTemplate names the template whose parameters were merged into LongURL
+	UTMTemplate string
+
+	// Rules select another target for some visitors, LongURL is the fallback
+	Rules []rules.Rule
+
+	// Variants split the visits that no rule matched between weighted targets
+	Variants       []Variant
+	StickyVariants bool
+
+	// PasswordHash is the bcrypt hash of the password required to follow the link
+	PasswordHash string
+
+	// MaxClicks disables the link after that many redirects when non-zero
+	MaxClicks  int
+	ClickCount int
+
+	// NotBefore and NotAfter bound the activation window when non-zero,
+	// FallbackURL is shown instead of the target before the window opens
+	NotBefore   time.Time
+	NotAfter    time.Time
+	FallbackURL string
+}
+
+type Variant struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Click is a served redirect, Variant holds the variant URL or is empty.
+type Click struct {
+	ShortURL  string
+	Variant   string
+	ClickedAt time.Time
+}
+
+// UTMTemplate is a named set of utm_* query parameters owned by a user.
+type UTMTemplate struct {
+	UserID string
+	Name   string
+	Params map[string]string
+}
+
+// Exhausted reports whether the link has used up its redirect limit.
+func (record *URLRecord) Exhausted() bool {
+	return record.MaxClicks > 0 && record.ClickCount >= record.MaxClicks
+}
+
+// Pending reports whether the activation window of the link has not opened yet.
+func (record *URLRecord) Pending(now time.Time) bool {
+	return !record.NotBefore.IsZero() && now.Before(record.NotBefore)
+}
+
+// Expired reports whether the activation window of the link has closed.
+func (record *URLRecord) Expired(now time.Time) bool {
+	return !record.NotAfter.IsZero() && !now.Before(record.NotAfter)
+}
+
+// APIKey lets a machine client act on behalf of its user, only the hash of
+// the key itself is stored.
+type APIKey struct {
+	ID        string
+	UserID    string
+	Name      string
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+	LastUsed  time.Time
+	Revoked   bool
+}
+
+// Account binds an identity of an external OpenID Connect provider to a user.
+type Account struct {
+	Issuer    string
+	Subject   string
+	UserID    string
+	Email     string
+	CreatedAt time.Time
+}
+
+// Team shares the links assigned to it between its members.
+type Team struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+}
+
+// Member is the role of a user in a team.
+type Member struct {
+	TeamID string
+	UserID string
+	Role   string
+}
+
+// Quota overrides the link creation limits of a user, a negative limit
+// leaves the configured one in place and 0 lifts it.
+type Quota struct {
+	UserID    string
+	MaxActive int
+	MaxDaily  int
+}
+
+// Usage counts the links of a user, Created and FirstCreated cover the links
+// created since a moment, deleted ones too.
+type Usage struct {
+	Active       int
+	Created      int
+	FirstCreated time.Time
+}
+
+// Dynamic reports whether visits of the link are decided one by one, by a
+// password, a click limit, an activation window, rules or variants.
+func (record *URLRecord) Dynamic() bool {
+	return record.PasswordHash != "" || record.MaxClicks > 0 ||
+		!record.NotBefore.IsZero() || !record.NotAfter.IsZero() || record.FallbackURL != "" ||
+		len(record.Rules) != 0 || len(record.Variants) != 0
+}
+
+// Limits cap the links of a user, a limit of 0 means no limit. The daily
+// limit counts the links created since Since.
+type Limits struct {
+	MaxActive int
+	MaxDaily  int
+	Since     time.Time
+}
+
+// Exceeded reports whether one more link would go over the limits.
+func (limits *Limits) Exceeded(usage *Usage) bool {
+	return (limits.MaxActive > 0 && usage.Active+1 > limits.MaxActive) ||
+		(limits.MaxDaily > 0 && usage.Created+1 > limits.MaxDaily)
+}
+
+// Broken reports whether the last health check failed to reach the target or got an error status.
+func (record *URLRecord) Broken() bool {
+	return !record.LastChecked.IsZero() && (record.LastStatus == 0 || record.LastStatus >= 400)
+}
+
 type URLStorage interface {
-	StoreURL(ctx context.Context, shortURL, longURL string) error
-	TryGetLongURL(ctx context.Context, shortURL string) (string, bool, error)
-	MarkAsDeleted(ctx context.Context, shortURL []string)
+	StoreURL(ctx context.Context, record URLRecord) error
+	TryGetURL(ctx context.Context, shortURL string) (*URLRecord, error)
+	// MarkAsDeleted deletes the links of the user of the context, possibly
+	// later. onDeleted, if set, is called once they are deleted with those
+	// that were live before.
+	MarkAsDeleted(ctx context.Context, shortURL []string, onDeleted func(shortURLs []string))
 	Finalize()
 
 	BeginTransaction(ctx context.Context) error
 	EndTransaction(ctx context.Context) error
 
-	GetSummary(ctx context.Context) string
+	// GetUserURLs returns the links of the user, only those with the tag if it is not empty.
+	GetUserURLs(ctx context.Context, userID, tag string) ([]URLRecord, error)
+	SetMetadata(ctx context.Context, shortURL, title, note string, tags []string) error
+
+	// SetPageMetadata stores what the target page says about itself, the
+	// title is only set if the link has none.
+	SetPageMetadata(ctx context.Context, shortURL, title, imageURL string) error
+
+	ListURLs(ctx context.Context) ([]URLRecord, error)
+	SetBlocked(ctx context.Context, shortURLs []string, blocked bool) error
+	SetHealth(ctx context.Context, shortURL string, status int, checkedAt time.Time) error
+
+	// SearchURLs returns up to limit links whose short URL is query or whose
+	// target contains it, an exact short URL match comes first.
+	SearchURLs(ctx context.Context, query string, limit int) ([]URLRecord, error)
+	SetDisabled(ctx context.Context, shortURLs []string, disabled bool, reason string) error
+	SetOwner(ctx context.Context, shortURL, userID string) error
+
+	// CountURLs and CountUsers count every stored link, deleted ones too,
+	// and the distinct users owning them.
+	CountURLs(ctx context.Context) (int, error)
+	CountUsers(ctx context.Context) (int, error)
+
+	GetUsage(ctx context.Context, userID string, since time.Time) (*Usage, error)
+
+	// StoreURLLimited stores the link unless that takes its user over the
+	// limits, counting and storing are not interleaved with other links of
+	// the user. A duplicate is reported before the limits are checked.
+	StoreURLLimited(ctx context.Context, record URLRecord, limits Limits) error
+
+	SetQuota(ctx context.Context, quota Quota) error
+	TryGetQuota(ctx context.Context, userID string) (*Quota, error)
+	DeleteQuota(ctx context.Context, userID string) error
+
+	// ConsumeClick atomically counts a redirect of a click limited link and
+	// reports false if the limit had already been reached.
+	ConsumeClick(ctx context.Context, shortURL string) (bool, error)
+
+	StoreUTMTemplate(ctx context.Context, template UTMTemplate) error
+	TryGetUTMTemplate(ctx context.Context, userID, name string) (*UTMTemplate, error)
+	GetUTMTemplates(ctx context.Context, userID string) ([]UTMTemplate, error)
+	DeleteUTMTemplate(ctx context.Context, userID, name string) error
+
+	SetRules(ctx context.Context, shortURL string, rules []rules.Rule) error
+	SetVariants(ctx context.Context, shortURL string, variants []Variant, sticky bool) error
+
+	RecordClick(ctx context.Context, click Click) error
+	GetClickStats(ctx context.Context, shortURL string) (map[string]int, error)
+
+	StoreAPIKey(ctx context.Context, key APIKey) error
+	TryGetAPIKey(ctx context.Context, hash string) (*APIKey, error)
+	GetAPIKeys(ctx context.Context, userID string) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID, id string) error
+	SetAPIKeyUsed(ctx context.Context, id string, usedAt time.Time) error
+
+	StoreAccount(ctx context.Context, account Account) error
+	TryGetAccount(ctx context.Context, issuer, subject string) (*Account, error)
+	TryGetUserAccount(ctx context.Context, userID string) (*Account, error)
+
+	// MergeUser hands the links, UTM templates, API keys and team memberships
+	// of fromUserID over to toUserID. Templates and memberships toUserID
+	// already has are kept.
+	MergeUser(ctx context.Context, fromUserID, toUserID string) error
+
+	// CreateTeam stores the team together with its first member.
+	CreateTeam(ctx context.Context, team Team, owner Member) error
+	TryGetTeam(ctx context.Context, id string) (*Team, error)
+	GetTeamURLs(ctx context.Context, teamID, tag string) ([]URLRecord, error)
+	SetTeam(ctx context.Context, shortURL, teamID string) error
+
+	TryGetMember(ctx context.Context, teamID, userID string) (*Member, error)
+	GetMembers(ctx context.Context, teamID string) ([]Member, error)
+	GetMemberships(ctx context.Context, userID string) ([]Member, error)
+	SetMember(ctx context.Context, member Member) error
+	RemoveMember(ctx context.Context, teamID, userID string) error
 }
 
 func NewURLStorage(dbState *DBState, cfg *config.Config) (URLStorage, error) {
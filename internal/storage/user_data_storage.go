@@ -2,13 +2,11 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-
-	"github.com/rvkarpov/url_shortener/internal/config"
+	"slices"
 )
 
-func getUserID(ctx context.Context) (string, error) {
+func GetUserID(ctx context.Context) (string, error) {
 	val := ctx.Value(UserIDKey{Name: "userID"})
 	if val == nil {
 		return "", fmt.Errorf("no userID value in context")
@@ -22,51 +20,56 @@ func getUserID(ctx context.Context) (string, error) {
 	return userID, nil
 }
 
-type UserIDKey struct {
-	Name string
+// newSessionKey marks requests that came without a session. Their user is
+// only created for them, so they are told apart by the client address.
+type newSessionKey struct{}
+
+func WithNewSession(ctx context.Context, clientIP string) context.Context {
+	return context.WithValue(ctx, newSessionKey{}, clientIP)
 }
 
-type UserDataStorageItem struct {
-	ShortURL string `json:"short_url"`
-	LongURL  string `json:"original_url"`
+// NewSessionIP returns the client address of a request that came without a session.
+func NewSessionIP(ctx context.Context) (string, bool) {
+	clientIP, ok := ctx.Value(newSessionKey{}).(string)
+	return clientIP, ok
 }
 
+type UserIDKey struct {
+	Name string
+}
+
+// UserDataStorage keeps the short URLs of every user in creation order.
 type UserDataStorage struct {
-	urls map[string][]UserDataStorageItem
-	cfg  *config.Config
+	urls map[string][]string
 }
 
-func NewUserDataStorage(cfg *config.Config) *UserDataStorage {
-	return &UserDataStorage{urls: make(map[string][]UserDataStorageItem), cfg: cfg}
+func NewUserDataStorage() *UserDataStorage {
+	return &UserDataStorage{urls: make(map[string][]string)}
 }
 
-func (storage *UserDataStorage) append(userID, longURL, shortURL string) {
+func (storage *UserDataStorage) append(userID, shortURL string) {
 	if userID == "" {
 		return
 	}
 
-	urls := storage.urls[userID]
-
-	shortURLnorm := fmt.Sprintf("%s/%s", storage.cfg.PublishAddr, shortURL)
-	urls = append(urls, UserDataStorageItem{ShortURL: shortURLnorm, LongURL: longURL})
-	storage.urls[userID] = urls
+	storage.urls[userID] = append(storage.urls[userID], shortURL)
 }
 
-func (storage *UserDataStorage) getSummary(ctx context.Context) string {
-	userID, err := getUserID(ctx)
-	if err != nil {
-		return ""
-	}
+func (storage *UserDataStorage) get(userID string) []string {
+	return storage.urls[userID]
+}
 
+func (storage *UserDataStorage) remove(userID, shortURL string) {
 	urls := storage.urls[userID]
-	if len(urls) == 0 {
-		return ""
+	if index := slices.Index(urls, shortURL); index >= 0 {
+		storage.urls[userID] = slices.Delete(urls, index, index+1)
 	}
 
-	out, err := json.Marshal(urls)
-	if err != nil {
-		return ""
+	if len(storage.urls[userID]) == 0 {
+		delete(storage.urls, userID)
 	}
+}
 
-	return string(out)
+func (storage *UserDataStorage) count() int {
+	return len(storage.urls)
 }
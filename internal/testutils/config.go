@@ -1,6 +1,9 @@
 package testutils
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/rvkarpov/url_shortener/internal/config"
 )
 
@@ -9,5 +12,25 @@ func LoadTestConfig() config.Config {
 		LaunchAddr:  config.NewNetAddress(),
 		PublishAddr: "http://localhost:8080",
 		ShortURLLen: 8,
+
+		SigningKeys:       config.SigningKeys{{ID: "test", Secret: "test_secret_key"}},
+		SessionIssuer:     "url_shortener",
+		SessionTTL:        24 * time.Hour,
+		SessionRenewAfter: time.Hour,
+
+		InvalidSessionPolicy: "renew",
+		CookiePath:           "/",
+		CookieHTTPOnly:       true,
+		CookieSameSite:       "lax",
+
+		AllowedSchemes:  "http,https",
+		BlockPrivateIPs: true,
+
+		DefaultRedirectCode: http.StatusTemporaryRedirect,
+		RedirectCacheMaxAge: 24 * time.Hour,
+		PassthroughConflict: "incoming",
+
+		PasswordAttempts:      5,
+		PasswordAttemptWindow: time.Minute,
 	}
 }
@@ -0,0 +1,189 @@
+package testutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// OIDCProvider is a stand-in OpenID Connect provider that logs in Subject
+// without asking and checks the PKCE code verifier.
+type OIDCProvider struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	Subject      string
+	Email        string
+
+	// Nonce and Audience replace the claims of the ID token when not empty
+	Nonce    string
+	Audience string
+
+	mu     sync.Mutex
+	kid    string
+	key    *rsa.PrivateKey
+	grants map[string]oidcGrant
+}
+
+type oidcGrant struct {
+	subject     string
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func NewOIDCProvider() *OIDCProvider {
+	provider := &OIDCProvider{
+		ClientID:     "shortener",
+		ClientSecret: "shortener_secret",
+		Subject:      "alice",
+		Email:        "alice@example.com",
+		grants:       make(map[string]oidcGrant),
+	}
+	provider.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("/authorize", provider.authorize)
+	mux.HandleFunc("/token", provider.token)
+	mux.HandleFunc("/jwks", provider.jwks)
+	provider.Server = httptest.NewServer(mux)
+
+	return provider
+}
+
+// RotateKey makes the provider sign with a new key under a new id.
+func (provider *OIDCProvider) RotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	provider.kid = uuid.New().String()
+	provider.key = key
+}
+
+func (provider *OIDCProvider) discovery(rsp http.ResponseWriter, rqs *http.Request) {
+	writeJSON(rsp, http.StatusOK, map[string]string{
+		"issuer":                 provider.URL,
+		"authorization_endpoint": provider.URL + "/authorize",
+		"token_endpoint":         provider.URL + "/token",
+		"jwks_uri":               provider.URL + "/jwks",
+	})
+}
+
+func (provider *OIDCProvider) authorize(rsp http.ResponseWriter, rqs *http.Request) {
+	query := rqs.URL.Query()
+	if query.Get("client_id") != provider.ClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(rsp, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	provider.mu.Lock()
+	code := uuid.New().String()
+	provider.grants[code] = oidcGrant{
+		subject:     provider.Subject,
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		redirectURI: query.Get("redirect_uri"),
+	}
+	provider.mu.Unlock()
+
+	target, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(rsp, "invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+
+	params := url.Values{"code": {code}, "state": {query.Get("state")}}
+	target.RawQuery = params.Encode()
+	http.Redirect(rsp, rqs, target.String(), http.StatusFound)
+}
+
+func (provider *OIDCProvider) token(rsp http.ResponseWriter, rqs *http.Request) {
+	clientID, clientSecret, _ := rqs.BasicAuth()
+	if clientID != provider.ClientID || clientSecret != provider.ClientSecret {
+		writeJSON(rsp, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	code := rqs.PostFormValue("code")
+	grant, exists := provider.grants[code]
+	delete(provider.grants, code)
+
+	challenge := sha256.Sum256([]byte(rqs.PostFormValue("code_verifier")))
+	if !exists || grant.redirectURI != rqs.PostFormValue("redirect_uri") ||
+		grant.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		writeJSON(rsp, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	nonce := grant.nonce
+	if provider.Nonce != "" {
+		nonce = provider.Nonce
+	}
+
+	audience := provider.ClientID
+	if provider.Audience != "" {
+		audience = provider.Audience
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   provider.URL,
+		"sub":   grant.subject,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute).Unix(),
+		"nonce": nonce,
+		"email": provider.Email,
+	})
+	token.Header["kid"] = provider.kid
+
+	idToken, err := token.SignedString(provider.key)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(rsp, http.StatusOK, map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func (provider *OIDCProvider) jwks(rsp http.ResponseWriter, rqs *http.Request) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	writeJSON(rsp, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": provider.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(provider.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(provider.key.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(rsp http.ResponseWriter, status int, value any) {
+	rsp.Header().Set("Content-Type", "application/json")
+	rsp.WriteHeader(status)
+	json.NewEncoder(rsp).Encode(value)
+}
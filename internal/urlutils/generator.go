@@ -2,6 +2,7 @@ package urlutils
 
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/base64"
 	"strings"
 )
@@ -11,3 +12,15 @@ func GenerateShortURL(longURL string, len uint) string {
 	encoded := base64.URLEncoding.EncodeToString(hash[:])
 	return strings.TrimRight(encoded, "=")[:len]
 }
+
+// GenerateRandomShortURL returns a short URL that does not depend on the
+// long URL, for links that must not be shared with other shortenings of it.
+func GenerateRandomShortURL(len uint) (string, error) {
+	random := make([]byte, len)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	encoded := base64.URLEncoding.EncodeToString(random)
+	return strings.TrimRight(encoded, "=")[:len], nil
+}
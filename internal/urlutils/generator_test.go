@@ -10,3 +10,14 @@ func TestGenerateKey(t *testing.T) {
 	key := GenerateShortURL("https://foo.com", 8)
 	assert.Len(t, key, 8, "Generated key should have the correct length")
 }
+
+func TestGenerateRandomKey(t *testing.T) {
+	first, err := GenerateRandomShortURL(8)
+	assert.NoError(t, err)
+	assert.Len(t, first, 8)
+
+	second, err := GenerateRandomShortURL(8)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	assert.NotEqual(t, GenerateShortURL("https://foo.com", 8), first)
+}
@@ -3,9 +3,13 @@ package urlutils
 import (
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"strings"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
 )
 
 func tryParseURL(urlRaw string) (string, error) {
@@ -22,6 +26,26 @@ func tryParseURL(urlRaw string) (string, error) {
 	return normURL.String(), nil
 }
 
+// ClientIP returns the peer address of the request. The X-Real-IP header is
+// only taken when the peer is one of the trusted proxies, anyone else could
+// pick the address to be known by.
+func ClientIP(rqs *http.Request, proxies config.TrustedProxies) string {
+	host, _, err := net.SplitHostPort(rqs.RemoteAddr)
+	if err != nil {
+		host = rqs.RemoteAddr
+	}
+
+	if !proxies.Contains(net.ParseIP(host)) {
+		return host
+	}
+
+	if realIP := net.ParseIP(strings.TrimSpace(rqs.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+
+	return host
+}
+
 func TryGetURLFromPostRqs(rqs *http.Request) (string, error) {
 	body, err := io.ReadAll(rqs.Body)
 	if err != nil {
@@ -31,3 +55,35 @@ func TryGetURLFromPostRqs(rqs *http.Request) (string, error) {
 
 	return tryParseURL(string(body))
 }
+
+// MergeURL appends extraPath to the target path and merges query into the
+// target query. On a parameter conflict the incoming value replaces the
+// target one only when incomingWins is set.
+func MergeURL(target, extraPath string, query url.Values, incomingWins bool) (string, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	if extraPath != "" {
+		// cleaning a rooted path keeps "../" segments from climbing above the target path
+		extraPath = path.Clean("/" + extraPath)
+		targetURL.Path = strings.TrimSuffix(targetURL.Path, "/") + extraPath
+		targetURL.RawPath = ""
+	}
+
+	if len(query) != 0 {
+		targetQuery := targetURL.Query()
+		for key, values := range query {
+			if _, exists := targetQuery[key]; exists && !incomingWins {
+				continue
+			}
+
+			targetQuery[key] = values
+		}
+
+		targetURL.RawQuery = targetQuery.Encode()
+	}
+
+	return targetURL.String(), nil
+}
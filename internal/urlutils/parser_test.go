@@ -0,0 +1,98 @@
+package urlutils
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rvkarpov/url_shortener/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		target       string
+		extraPath    string
+		query        string
+		incomingWins bool
+		want         string
+	}{
+		{
+			name:   "nothing to merge",
+			target: "https://foo.com/landing?a=1",
+			want:   "https://foo.com/landing?a=1",
+		},
+		{
+			name:      "path and query",
+			target:    "https://foo.com/landing/",
+			extraPath: "extra/path",
+			query:     "ref=newsletter",
+			want:      "https://foo.com/landing/extra/path?ref=newsletter",
+		},
+		{
+			name:         "incoming wins",
+			target:       "https://foo.com/?ref=site&a=1",
+			query:        "ref=newsletter",
+			incomingWins: true,
+			want:         "https://foo.com/?a=1&ref=newsletter",
+		},
+		{
+			name:         "target wins",
+			target:       "https://foo.com/?ref=site&a=1",
+			query:        "ref=newsletter&b=2",
+			incomingWins: false,
+			want:         "https://foo.com/?a=1&b=2&ref=site",
+		},
+		{
+			name:      "no path traversal",
+			target:    "https://foo.com/docs",
+			extraPath: "../../admin",
+			want:      "https://foo.com/docs/admin",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			assert.NoError(t, err)
+
+			merged, err := MergeURL(test.target, test.extraPath, query, test.incomingWins)
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, merged)
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var proxies config.TrustedProxies
+	require.NoError(t, proxies.Set("10.0.0.0/8, 192.168.1.1/32"))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{name: "peer address", remoteAddr: "203.0.113.5:4321", want: "203.0.113.5"},
+		{name: "untrusted peer", remoteAddr: "203.0.113.5:4321", realIP: "198.51.100.7", want: "203.0.113.5"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:4321", realIP: "198.51.100.7", want: "198.51.100.7"},
+		{name: "trusted proxy without header", remoteAddr: "192.168.1.1:4321", want: "192.168.1.1"},
+		{name: "garbage header", remoteAddr: "10.1.2.3:4321", realIP: "not an ip", want: "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rqs := httptest.NewRequest("GET", "/", nil)
+			rqs.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				rqs.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			assert.Equal(t, tt.want, ClientIP(rqs, proxies))
+		})
+	}
+
+	assert.False(t, config.TrustedProxies(nil).Contains(net.ParseIP("10.1.2.3")))
+}
@@ -0,0 +1,60 @@
+package urlutils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+var recoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// GenerateQRCode encodes content as a PNG or SVG image of size x size pixels
+// using the error correction level L, M, Q or H.
+func GenerateQRCode(content string, size int, level string, format string) ([]byte, error) {
+	recoveryLevel, ok := recoveryLevels[strings.ToUpper(level)]
+	if !ok {
+		return nil, fmt.Errorf("unknown error correction level '%s'", level)
+	}
+
+	code, err := qrcode.New(content, recoveryLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "png":
+		return code.PNG(size)
+	case "svg":
+		return renderSVG(code.Bitmap(), size), nil
+	default:
+		return nil, fmt.Errorf("unknown image format '%s'", format)
+	}
+}
+
+func renderSVG(bitmap [][]bool, size int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(
+		&buf,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap),
+	)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, len(bitmap), len(bitmap))
+
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}